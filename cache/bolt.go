@@ -0,0 +1,187 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Hosts are kept in this bucket, keyed by address, as JSON
+var hostsBucket = []byte("hosts")
+
+// Group vars are kept in this bucket, keyed by group name, as JSON
+var groupsBucket = []byte("groups")
+
+// Persister keeps the hosts of a Store on disk. Every change is written before the store makes it.
+type Persister interface {
+	// Load returns the hosts that have been kept. ok is false if nothing has ever been kept.
+	Load() (hosts map[string]rt.Hosts, ok bool, err error)
+	// Update deletes the hosts at del and writes put, all or nothing
+	Update(del []string, put map[string]rt.Hosts) error
+	// Replace swaps every host kept for hosts, all or nothing
+	Replace(hosts map[string]rt.Hosts) error
+	// LoadGroups returns the vars of each group that has been kept. ok is false if no groups have ever been kept.
+	LoadGroups() (groups map[string]rt.Vars, ok bool, err error)
+	// UpdateGroups deletes the groups in del and writes put, all or nothing
+	UpdateGroups(del []string, put map[string]rt.Vars) error
+	// ReplaceGroups swaps every group kept for groups, all or nothing
+	ReplaceGroups(groups map[string]rt.Vars) error
+	Close() error
+}
+
+// BoltDB keeps hosts in a bbolt database file. Each change is synced to disk before it returns.
+type BoltDB struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens the database at path, creating it if there isn't one.
+// Only one process can have it open, a second one gives up after a second.
+func OpenBolt(path string) (*BoltDB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening host database %s: %s", path, err)
+	}
+	return &BoltDB{db: db}, nil
+}
+
+// Load returns the hosts in the database
+func (b *BoltDB) Load() (map[string]rt.Hosts, bool, error) {
+	hosts := map[string]rt.Hosts{}
+	ok := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(hostsBucket)
+		if bucket == nil {
+			return nil
+		}
+		ok = true
+		return bucket.ForEach(func(k, v []byte) error {
+			h := rt.Hosts{}
+			if err := json.Unmarshal(v, &h); err != nil {
+				return fmt.Errorf("host %s: %s", k, err)
+			}
+			hosts[string(k)] = h
+			return nil
+		})
+	})
+	return hosts, ok, err
+}
+
+// Update deletes the hosts at del and writes put in a single transaction
+func (b *BoltDB) Update(del []string, put map[string]rt.Hosts) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(hostsBucket)
+		if err != nil {
+			return err
+		}
+		for _, k := range del {
+			if err := bucket.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return putHosts(bucket, put)
+	})
+}
+
+// Replace empties the database and writes hosts in a single transaction
+func (b *BoltDB) Replace(hosts map[string]rt.Hosts) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(hostsBucket) != nil {
+			if err := tx.DeleteBucket(hostsBucket); err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucket(hostsBucket)
+		if err != nil {
+			return err
+		}
+		return putHosts(bucket, hosts)
+	})
+}
+
+// LoadGroups returns the groups in the database
+func (b *BoltDB) LoadGroups() (map[string]rt.Vars, bool, error) {
+	groups := map[string]rt.Vars{}
+	ok := false
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(groupsBucket)
+		if bucket == nil {
+			return nil
+		}
+		ok = true
+		return bucket.ForEach(func(k, v []byte) error {
+			vars := rt.Vars{}
+			if err := json.Unmarshal(v, &vars); err != nil {
+				return fmt.Errorf("group %s: %s", k, err)
+			}
+			groups[string(k)] = vars
+			return nil
+		})
+	})
+	return groups, ok, err
+}
+
+// UpdateGroups deletes the groups in del and writes put in a single transaction
+func (b *BoltDB) UpdateGroups(del []string, put map[string]rt.Vars) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(groupsBucket)
+		if err != nil {
+			return err
+		}
+		for _, k := range del {
+			if err := bucket.Delete([]byte(k)); err != nil {
+				return err
+			}
+		}
+		return putGroups(bucket, put)
+	})
+}
+
+// ReplaceGroups empties the groups bucket and writes groups in a single transaction
+func (b *BoltDB) ReplaceGroups(groups map[string]rt.Vars) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(groupsBucket) != nil {
+			if err := tx.DeleteBucket(groupsBucket); err != nil {
+				return err
+			}
+		}
+		bucket, err := tx.CreateBucket(groupsBucket)
+		if err != nil {
+			return err
+		}
+		return putGroups(bucket, groups)
+	})
+}
+
+// Close closes the database file
+func (b *BoltDB) Close() error {
+	return b.db.Close()
+}
+
+func putHosts(bucket *bolt.Bucket, hosts map[string]rt.Hosts) error {
+	for k, h := range hosts {
+		v, err := json.Marshal(h)
+		if err != nil {
+			return fmt.Errorf("host %s: %s", k, err)
+		}
+		if err = bucket.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func putGroups(bucket *bolt.Bucket, groups map[string]rt.Vars) error {
+	for k, vars := range groups {
+		v, err := json.Marshal(vars)
+		if err != nil {
+			return fmt.Errorf("group %s: %s", k, err)
+		}
+		if err = bucket.Put([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
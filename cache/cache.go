@@ -3,161 +3,562 @@ package cache
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/networkbootstrap/ztpmanagercode/events"
 	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
 )
 
-// Create creates and runs a CRUD based cache
-//func Create(cache map[string]rt.Hosts, wg *sync.WaitGroup, recvch chan rt.Envelope, finish chan struct{}) {
-func Create(cache map[string]rt.Hosts, wg *sync.WaitGroup) (recvch chan rt.Envelope, finish chan struct{}) {
-	recvch = make(chan rt.Envelope, 1)
-	finish = make(chan struct{})
-
-	go func() {
-		locked := false
-		for {
-			select {
-			case recv := <-recvch:
-
-				switch recv.CRUD {
-				case rt.CREATE:
-					if !locked {
-						insert := rt.Hosts{}
-						insert.CfgFile = recv.CfgFile
-						insert.CfgImage = recv.CfgImage
-						insert.Ethernet = recv.Ethernet
-						insert.FixedIP = recv.FixedIP
-						insert.HostName = recv.HostName
-						insert.Vendor = recv.Vendor
-						// Insert
-						cache[insert.FixedIP] = insert
-						// Now check
-						if _, ok := cache[insert.FixedIP]; ok {
-							resp := rt.Envelope{}
-							resp.Response = recv.Response
-							resp.CRUD = rt.OK
-							resp.Hosts = insert
-							resp.Response <- resp
-						} else {
-							resp := rt.Envelope{}
-							resp.Response = recv.Response
-							resp.CRUD = rt.ERROR
-							resp.Hosts = insert
-							resp.Response <- resp
-						}
-					}
-
-				case rt.READHOST:
-					if !locked {
-						read := rt.Hosts{}
-						read.CfgFile = cache[recv.FixedIP].CfgFile
-						read.CfgImage = cache[recv.FixedIP].CfgImage
-						read.Ethernet = cache[recv.FixedIP].Ethernet
-						read.FixedIP = cache[recv.FixedIP].FixedIP
-						read.HostName = cache[recv.FixedIP].HostName
-						read.Vendor = cache[recv.FixedIP].Vendor
-						if _, ok := cache[read.FixedIP]; ok {
-							resp := rt.Envelope{}
-							resp.Response = recv.Response
-							resp.CRUD = rt.OK
-							resp.Hosts = read
-							resp.Response <- resp
-						} else {
-							resp := rt.Envelope{}
-							resp.Response = recv.Response
-							resp.CRUD = rt.ERROR
-							resp.Hosts = read
-							resp.Response <- resp
-						}
-					}
-				case rt.READHOSTS:
-					if !locked {
-						hosts := rt.Envelope{}
-						for k := range cache {
-							hosts.HostList = append(hosts.HostList, k)
-						}
-						hosts.Response = recv.Response
-						hosts.CRUD = rt.OK
-						hosts.Response <- hosts
-					}
-
-				case rt.UPDATE:
-					if !locked {
-						update := rt.Hosts{}
-						update.CfgFile = recv.CfgFile
-						update.CfgImage = recv.CfgImage
-						update.Ethernet = recv.Ethernet
-						update.FixedIP = recv.FixedIP
-						update.HostName = recv.HostName
-						delete(cache, recv.UpdateIP)
-						cache[recv.FixedIP] = update
-
-						// Now check
-						if _, ok := cache[recv.FixedIP]; ok {
-							resp := rt.Envelope{}
-							resp.Response = recv.Response
-							resp.CRUD = rt.OK
-							resp.Response <- resp
-						}
-					}
-				case rt.DELETE:
-					if !locked {
-						deleted := false
-						if _, ok := cache[recv.FixedIP]; ok {
-							deleted = true
-						}
-						delete(cache, recv.FixedIP)
-						if _, ok := cache[recv.FixedIP]; !ok && deleted {
-							resp := rt.Envelope{}
-							resp.Response = recv.Response
-							resp.CRUD = rt.OK
-							resp.Response <- resp
-						} else {
-							resp := rt.Envelope{}
-							resp.Response = recv.Response
-							resp.CRUD = rt.ERROR
-							resp.Response <- resp
-						}
-					}
-				case rt.STRING:
-					if !locked {
-						var b []byte
-						buf := bytes.NewBuffer(b)
-						tomlEncoder := toml.NewEncoder(buf)
-						err := tomlEncoder.Encode(cache)
-						if err != nil {
-							resp := rt.Envelope{}
-							resp.Response = recv.Response
-							resp.CRUD = rt.ERROR
-							resp.Response <- resp
-						}
-						resp := rt.Envelope{}
-						resp.Response = recv.Response
-						resp.CRUD = rt.OK
-						resp.String = buf.String()
-						resp.Response <- resp
-					}
-				case rt.LOCK:
-					locked = true
-					resp := rt.Envelope{}
-					resp.Response = recv.Response
-					resp.CRUD = rt.OK
-					resp.Response <- resp
-				case rt.UNLOCK:
-					locked = false
-					resp := rt.Envelope{}
-					resp.Response = recv.Response
-					resp.CRUD = rt.OK
-					resp.Response <- resp
-				}
-			case <-finish:
-				// We're finished *sob*
-				wg.Done()
-				return
+// ErrNotFound is returned when no host has the address, ethernet address or hostname asked for
+var ErrNotFound = errors.New("host not found")
+
+// ConflictError is returned when a host would share its address, ethernet address or hostname with another
+type ConflictError struct {
+	Field string // "address", "ethernet address" or "hostname"
+	Value string
+	Key   string // The host that already has it
+}
+
+func (e *ConflictError) Error() string {
+	if e.Field == "address" {
+		return fmt.Sprintf("host %s already exists", e.Key)
+	}
+	return fmt.Sprintf("%s %s is already used by host %s", e.Field, e.Value, e.Key)
+}
+
+// PersistError is returned when a change couldn't be written to the database. The change isn't made.
+type PersistError struct {
+	Err error
+}
+
+func (e *PersistError) Error() string {
+	return fmt.Sprintf("writing to the host database: %s", e.Err)
+}
+
+// RevisionError is returned when a compare-and-swap finds the host has changed since the revision it was given
+type RevisionError struct {
+	Key  string
+	Want uint64
+	Have uint64
+}
+
+func (e *RevisionError) Error() string {
+	return fmt.Sprintf("host %s is at revision %d, not %d", e.Key, e.Have, e.Want)
+}
+
+// RowError is what's wrong with one host of a batch
+type RowError struct {
+	Row     int    `json:"row"` // Counted from 1, 0 is the header of a CSV
+	Key     string `json:"key,omitempty"`
+	Message string `json:"message"`
+}
+
+// BatchError is returned when hosts of a batch can't be created. None of them are.
+type BatchError struct {
+	Rows []RowError
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d problems with the batch, no hosts were created", len(e.Rows))
+}
+
+// Store holds the hosts by address, with indexes on ethernet address and hostname.
+// No two hosts can share any of them. Every change gives the host changed the next revision of the store,
+// so a revision is never handed out twice while the store is open. It's safe to use from any number of goroutines.
+// Hosts go in and come out as copies, so nothing outside can change a stored host behind its back.
+type Store struct {
+	mu    sync.RWMutex
+	hosts map[string]rt.Hosts
+	macs  map[string]string // Normalised ethernet address to host address
+	names map[string]string // Lower case hostname to host address
+	db    Persister         // Where changes are written as they're made, nil if they aren't
+	bus   *events.Broker    // Where changes are published, nil if they aren't
+	rev   uint64            // Revision of the latest change, each change gets the next one
+
+	saved   map[string]rt.Hosts  // Hosts as of the last save
+	fetched map[string]time.Time // When hosts fetched their files, since they were last saved
+}
+
+// New returns a store holding hosts, keyed as they are in the map. It fails if any two of them clash.
+// Nothing is kept beyond memory.
+func New(hosts map[string]rt.Hosts) (*Store, error) {
+	s := &Store{}
+	if err := s.Replace(hosts); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Open returns a store that writes every change to db as it's made. It starts off with the hosts already in db,
+// or, the first time round, with hosts, which are written to db. seeded is true if hosts were used.
+func Open(db Persister, hosts map[string]rt.Hosts) (s *Store, seeded bool, err error) {
+	kept, ok, err := db.Load()
+	if err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		kept = hosts
+	}
+
+	s = &Store{}
+	if err = s.Replace(kept); err != nil {
+		return nil, false, err
+	}
+	// The database is only written to once the hosts are known to be fine, and have their revisions
+	if !ok {
+		if err = db.Replace(s.hosts); err != nil {
+			return nil, false, err
+		}
+	}
+	s.db = db
+	return s, !ok, nil
+}
+
+// SetBroker has every change from now on published to b
+func (s *Store) SetBroker(b *events.Broker) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bus = b
+}
+
+// Close closes the store's database, if it has one
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// Get returns the host with address key
+func (s *Store) Get(key string) (rt.Hosts, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	h, ok := s.hosts[key]
+	if !ok {
+		return rt.Hosts{}, ErrNotFound
+	}
+	return copyHost(h), nil
+}
+
+// GetByMAC returns the host with ethernet address mac, in any case or separator style
+func (s *Store) GetByMAC(mac string) (rt.Hosts, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.macs[normalMAC(mac)]
+	if !ok {
+		return rt.Hosts{}, ErrNotFound
+	}
+	return copyHost(s.hosts[key]), nil
+}
+
+// GetByName returns the host with hostname name, in any case
+func (s *Store) GetByName(name string) (rt.Hosts, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	key, ok := s.names[strings.ToLower(name)]
+	if !ok {
+		return rt.Hosts{}, ErrNotFound
+	}
+	return copyHost(s.hosts[key]), nil
+}
+
+// Keys returns the address of every host in address order, IPv4 before IPv6
+func (s *Store) Keys() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	keys := make([]string, 0, len(s.hosts))
+	for k := range s.hosts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return rt.AddrLess(keys[i], keys[j]) })
+	return keys
+}
+
+// Snapshot returns a copy of every host, keyed by address
+func (s *Store) Snapshot() map[string]rt.Hosts {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	hosts := make(map[string]rt.Hosts, len(s.hosts))
+	for k, h := range s.hosts {
+		hosts[k] = copyHost(h)
+	}
+	return hosts
+}
+
+// Create adds h under its address. It fails if the address, ethernet address or hostname is taken.
+func (s *Store) Create(h rt.Hosts) (rt.Hosts, error) {
+	key := h.Key()
+	if key == "" {
+		return rt.Hosts{}, errors.New("a host needs a fixed IPv4 or IPv6 address")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.hosts[key]; ok {
+		return rt.Hosts{}, &ConflictError{Field: "address", Value: key, Key: key}
+	}
+	if err := s.clashes(key, h, ""); err != nil {
+		return rt.Hosts{}, err
+	}
+	h.Revision = s.rev + 1
+	if err := s.persist(nil, key, h); err != nil {
+		return rt.Hosts{}, err
+	}
+	s.rev = h.Revision
+	s.put(key, h)
+	after := copyHost(h)
+	s.bus.Publish(events.HostEvent(key, nil, &after))
+	return copyHost(h), nil
+}
+
+// CheckMany returns what would stop each of hosts from being created along with the rest, without creating any
+func (s *Store) CheckMany(hosts []rt.Hosts) []RowError {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.checkMany(hosts)
+}
+
+// CreateMany adds every one of hosts, or none of them. A BatchError lists every host that clashes with one
+// already in the store or with another host of the batch. The hosts created all get the same revision.
+func (s *Store) CreateMany(hosts []rt.Hosts) ([]rt.Hosts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rows := s.checkMany(hosts); len(rows) > 0 {
+		return nil, &BatchError{Rows: rows}
+	}
+
+	// The caller's hosts are left as they are
+	rev := s.rev + 1
+	batch := make([]rt.Hosts, len(hosts))
+	put := make(map[string]rt.Hosts, len(hosts))
+	for i, h := range hosts {
+		h.Revision = rev
+		batch[i] = h
+		put[h.Key()] = h
+	}
+	if s.db != nil {
+		if err := s.db.Update(nil, put); err != nil {
+			return nil, &PersistError{Err: err}
+		}
+	}
+	s.rev = rev
+
+	created := make([]rt.Hosts, 0, len(batch))
+	for _, h := range batch {
+		s.put(h.Key(), h)
+		after := copyHost(h)
+		s.bus.Publish(events.HostEvent(h.Key(), nil, &after))
+		created = append(created, copyHost(h))
+	}
+	return created, nil
+}
+
+// checkMany checks hosts against the store and each other. The caller holds the lock.
+func (s *Store) checkMany(hosts []rt.Hosts) []RowError {
+	// The batch goes in on top of a copy of the indexes, so rows clash with each other too
+	n := &Store{hosts: map[string]rt.Hosts{}, macs: map[string]string{}, names: map[string]string{}}
+	for k, h := range s.hosts {
+		n.hosts[k] = h
+	}
+	for k, v := range s.macs {
+		n.macs[k] = v
+	}
+	for k, v := range s.names {
+		n.names[k] = v
+	}
+	// Which row put each address in, for clashes within the batch
+	rowOf := map[string]int{}
+
+	rows := []RowError{}
+	for i, h := range hosts {
+		key := h.Key()
+		fail := func(msg string) {
+			rows = append(rows, RowError{Row: i + 1, Key: key, Message: msg})
+		}
+		if key == "" {
+			fail("a host needs a fixed IPv4 or IPv6 address")
+			continue
+		}
+
+		var err error
+		if _, ok := n.hosts[key]; ok {
+			err = &ConflictError{Field: "address", Value: key, Key: key}
+		} else {
+			err = n.clashes(key, h, "")
+		}
+		if ce, ok := err.(*ConflictError); ok {
+			if row, inBatch := rowOf[ce.Key]; inBatch {
+				fail(fmt.Sprintf("%s %s is also in row %d", ce.Field, ce.Value, row))
+			} else {
+				fail(ce.Error())
 			}
+			continue
+		}
+		n.put(key, h)
+		rowOf[key] = i + 1
+	}
+	return rows
+}
+
+// Update replaces the host at address key with h, which can move it to a new address
+func (s *Store) Update(key string, h rt.Hosts) (rt.Hosts, error) {
+	return s.CompareAndSwap(key, 0, h)
+}
+
+// CompareAndSwap replaces the host at address key with h, like Update, but only if the host is still at revision.
+// A revision of 0 matches any. If the host has moved on, a RevisionError is returned and nothing changes.
+func (s *Store) CompareAndSwap(key string, revision uint64, h rt.Hosts) (rt.Hosts, error) {
+	newkey := h.Key()
+	if newkey == "" {
+		return rt.Hosts{}, errors.New("a host needs a fixed IPv4 or IPv6 address")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	old, ok := s.hosts[key]
+	if !ok {
+		return rt.Hosts{}, ErrNotFound
+	}
+	if revision != 0 && old.Revision != revision {
+		return rt.Hosts{}, &RevisionError{Key: key, Want: revision, Have: old.Revision}
+	}
+	if _, ok := s.hosts[newkey]; ok && newkey != key {
+		return rt.Hosts{}, &ConflictError{Field: "address", Value: newkey, Key: newkey}
+	}
+	if err := s.clashes(newkey, h, key); err != nil {
+		return rt.Hosts{}, err
+	}
+	h.Revision = s.rev + 1
+	if err := s.persist([]string{key}, newkey, h); err != nil {
+		return rt.Hosts{}, err
+	}
+	s.rev = h.Revision
+	before := copyHost(old)
+	s.remove(key)
+	s.put(newkey, h)
+	after := copyHost(h)
+	s.bus.Publish(events.HostEvent(newkey, &before, &after))
+	return copyHost(h), nil
+}
+
+// Delete removes the host at address key and returns it
+func (s *Store) Delete(key string) (rt.Hosts, error) {
+	return s.CompareAndDelete(key, 0)
+}
+
+// CompareAndDelete removes the host at address key, like Delete, but only if the host is still at revision.
+// A revision of 0 matches any. If the host has moved on, a RevisionError is returned and nothing changes.
+func (s *Store) CompareAndDelete(key string, revision uint64) (rt.Hosts, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	h, ok := s.hosts[key]
+	if !ok {
+		return rt.Hosts{}, ErrNotFound
+	}
+	if revision != 0 && h.Revision != revision {
+		return rt.Hosts{}, &RevisionError{Key: key, Want: revision, Have: h.Revision}
+	}
+	if err := s.persist([]string{key}, "", rt.Hosts{}); err != nil {
+		return rt.Hosts{}, err
+	}
+	s.remove(key)
+	before := copyHost(h)
+	s.bus.Publish(events.HostEvent(key, &before, nil))
+	return copyHost(h), nil
+}
+
+// Replace swaps every host for hosts, keyed as they are in the map. Nothing changes if any two of them clash.
+// Hosts that are the same as the ones they replace keep their revision, and so do hosts that come with one,
+// such as the ones loaded from the database. Every other host gets a new revision.
+func (s *Store) Replace(hosts map[string]rt.Hosts) error {
+	return s.replace(hosts, false)
+}
+
+// Restore puts back hosts taken from Snapshot, to undo a Replace. It's Replace, except that every host keeps
+// the revision it comes with, so the ETags handed out before the Replace match again.
+func (s *Store) Restore(hosts map[string]rt.Hosts) error {
+	return s.replace(hosts, true)
+}
+
+// replace does the work of Replace, and of Restore if keep is set
+func (s *Store) replace(hosts map[string]rt.Hosts, keep bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := &Store{hosts: map[string]rt.Hosts{}, macs: map[string]string{}, names: map[string]string{}, rev: s.rev}
+	// In order, so the same clash is always reported against the same host
+	keys := make([]string, 0, len(hosts))
+	for k, h := range hosts {
+		keys = append(keys, k)
+		if h.Revision > n.rev {
+			n.rev = h.Revision
+		}
+	}
+	sort.Strings(keys)
+
+	changed := n.rev + 1
+	for _, k := range keys {
+		h := hosts[k]
+		if err := n.clashes(k, h, ""); err != nil {
+			return fmt.Errorf("host %s: %s", k, err)
+		}
+		if old, ok := s.hosts[k]; ok && sameHost(old, h) {
+			h.Revision = old.Revision
+		} else if h.Revision == 0 || (ok && !keep) {
+			h.Revision = changed
+			n.rev = changed
+		}
+		n.put(k, h)
+	}
+
+	if s.db != nil {
+		if err := s.db.Replace(n.hosts); err != nil {
+			return &PersistError{Err: err}
+		}
+	}
+	old := s.hosts
+	s.hosts, s.macs, s.names, s.rev = n.hosts, n.macs, n.names, n.rev
+	s.publishChanges(old, keys)
+	return nil
+}
+
+// publishChanges publishes an event for every host that isn't the same as it was in old.
+// keys are the addresses of the hosts now, sorted. The caller holds the lock.
+func (s *Store) publishChanges(old map[string]rt.Hosts, keys []string) {
+	if s.bus == nil {
+		return
+	}
+	gone := []string{}
+	for k := range old {
+		if _, ok := s.hosts[k]; !ok {
+			gone = append(gone, k)
+		}
+	}
+	sort.Strings(gone)
+	for _, k := range gone {
+		before := copyHost(old[k])
+		s.bus.Publish(events.HostEvent(k, &before, nil))
+	}
+
+	for _, k := range keys {
+		after := copyHost(s.hosts[k])
+		if b, ok := old[k]; !ok {
+			s.bus.Publish(events.HostEvent(k, nil, &after))
+		} else if !sameHost(b, s.hosts[k]) {
+			before := copyHost(b)
+			s.bus.Publish(events.HostEvent(k, &before, &after))
+		}
+	}
+}
+
+// String returns the hosts as TOML
+func (s *Store) String() (string, error) {
+	buf := new(bytes.Buffer)
+	if err := toml.NewEncoder(buf).Encode(s.Snapshot()); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// clashes returns a ConflictError if another host than the one at self already has h's ethernet address or hostname
+func (s *Store) clashes(key string, h rt.Hosts, self string) error {
+	if mac := normalMAC(h.Ethernet); mac != "" {
+		if other, ok := s.macs[mac]; ok && other != self && other != key {
+			return &ConflictError{Field: "ethernet address", Value: h.Ethernet, Key: other}
 		}
-	}()
-	return
+	}
+	if name := strings.ToLower(h.HostName); name != "" {
+		if other, ok := s.names[name]; ok && other != self && other != key {
+			return &ConflictError{Field: "hostname", Value: h.HostName, Key: other}
+		}
+	}
+	return nil
+}
+
+// persist writes a change to the database before it's made, deleting the hosts at del and writing h at key
+// if key is set. The caller holds the lock.
+func (s *Store) persist(del []string, key string, h rt.Hosts) error {
+	if s.db == nil {
+		return nil
+	}
+	put := map[string]rt.Hosts{}
+	if key != "" {
+		put[key] = h
+	}
+	if err := s.db.Update(del, put); err != nil {
+		return &PersistError{Err: err}
+	}
+	return nil
+}
+
+// put stores h at key and indexes it. The caller holds the lock.
+func (s *Store) put(key string, h rt.Hosts) {
+	s.hosts[key] = copyHost(h)
+	if mac := normalMAC(h.Ethernet); mac != "" {
+		s.macs[mac] = key
+	}
+	if name := strings.ToLower(h.HostName); name != "" {
+		s.names[name] = key
+	}
+}
+
+// remove drops the host at key and its index entries. The caller holds the lock.
+func (s *Store) remove(key string) {
+	h := s.hosts[key]
+	if mac := normalMAC(h.Ethernet); mac != "" && s.macs[mac] == key {
+		delete(s.macs, mac)
+	}
+	if name := strings.ToLower(h.HostName); name != "" && s.names[name] == key {
+		delete(s.names, name)
+	}
+	delete(s.hosts, key)
+}
+
+// sameHost compares two hosts, leaving out their revisions
+func sameHost(a rt.Hosts, b rt.Hosts) bool {
+	a.Revision, b.Revision = 0, 0
+	return reflect.DeepEqual(a, b)
+}
+
+// copyHost returns h with its own copy of the groups and vars
+func copyHost(h rt.Hosts) rt.Hosts {
+	if h.Groups != nil {
+		h.Groups = append([]string{}, h.Groups...)
+	}
+	if h.Vars != nil {
+		vars := make(rt.Vars, len(h.Vars))
+		for k, v := range h.Vars {
+			vars[k] = v
+		}
+		h.Vars = vars
+	}
+	return h
+}
+
+// normalMAC returns an ethernet address in lower case with colons, so the same address always indexes the same
+// way whatever style it was written in. Anything that doesn't parse is only lower cased.
+func normalMAC(mac string) string {
+	if m, err := net.ParseMAC(mac); err == nil {
+		return m.String()
+	}
+	return strings.ToLower(mac)
 }
@@ -0,0 +1,78 @@
+// Protected by BSD 3 clause license
+
+package cache
+
+import (
+	"reflect"
+	"testing"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+func TestCreateManyKeys(t *testing.T) {
+	s, err := New(map[string]rt.Hosts{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hosts := []rt.Hosts{
+		{FixedIP: "10.0.0.10", HostName: "a"},
+		{FixedIPv6: "2001:db8::1", HostName: "b"},
+		{FixedIP: "10.0.0.9", HostName: "c"},
+		{FixedIP: "9.0.0.1", HostName: "d"},
+		{FixedIPv6: "2001:db8::a", HostName: "e"},
+	}
+	if _, err := s.CreateMany(hosts); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"9.0.0.1", "10.0.0.9", "10.0.0.10", "2001:db8::1", "2001:db8::a"}
+	if got := s.Keys(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Keys() = %v, expected %v", got, want)
+	}
+	for _, h := range hosts {
+		if h.Revision != 0 {
+			t.Errorf("CreateMany set the revision of the caller's host %s to %d", h.Key(), h.Revision)
+		}
+	}
+}
+
+func TestRestoreKeepsRevisions(t *testing.T) {
+	s, err := New(map[string]rt.Hosts{
+		"10.0.0.1": {FixedIP: "10.0.0.1", HostName: "a"},
+		"10.0.0.2": {FixedIP: "10.0.0.2", HostName: "b"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.Update("10.0.0.2", rt.Hosts{FixedIP: "10.0.0.2", HostName: "b2"}); err != nil {
+		t.Fatal(err)
+	}
+	before := s.Snapshot()
+
+	if err = s.Replace(map[string]rt.Hosts{
+		"10.0.0.1": {FixedIP: "10.0.0.1", HostName: "a"},
+		"10.0.0.2": {FixedIP: "10.0.0.2", HostName: "b"},
+		"10.0.0.3": {FixedIP: "10.0.0.3", HostName: "c"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if h, _ := s.Get("10.0.0.2"); h.Revision == before["10.0.0.2"].Revision {
+		t.Fatalf("Replace kept revision %d of a host it changed", h.Revision)
+	}
+	latest, _ := s.Get("10.0.0.3")
+
+	if err = s.Restore(before); err != nil {
+		t.Fatal(err)
+	}
+	if got := s.Snapshot(); !reflect.DeepEqual(got, before) {
+		t.Errorf("restored %v, expected %v", got, before)
+	}
+	// Revisions already handed out aren't handed out again
+	h, err := s.Create(rt.Hosts{FixedIP: "10.0.0.4", HostName: "d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Revision <= latest.Revision {
+		t.Errorf("new host has revision %d, expected one after %d", h.Revision, latest.Revision)
+	}
+}
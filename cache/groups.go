@@ -0,0 +1,52 @@
+package cache
+
+import (
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// LoadGroups returns the vars of each group kept in the database. Groups live with the config, the store only
+// keeps them beside the hosts so a group change outlasts a restart the way a host change does.
+// ok is false if the store has no database, or the database has never kept any groups.
+func (s *Store) LoadGroups() (groups map[string]rt.Vars, ok bool, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.db == nil {
+		return nil, false, nil
+	}
+	return s.db.LoadGroups()
+}
+
+// PutGroup writes the vars of group name to the database
+func (s *Store) PutGroup(name string, vars rt.Vars) error {
+	return s.persistGroups(nil, map[string]rt.Vars{name: vars})
+}
+
+// DeleteGroup removes group name from the database
+func (s *Store) DeleteGroup(name string) error {
+	return s.persistGroups([]string{name}, nil)
+}
+
+// ReplaceGroups swaps every group in the database for groups
+func (s *Store) ReplaceGroups(groups map[string]rt.Vars) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return nil
+	}
+	if err := s.db.ReplaceGroups(groups); err != nil {
+		return &PersistError{Err: err}
+	}
+	return nil
+}
+
+func (s *Store) persistGroups(del []string, put map[string]rt.Vars) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return nil
+	}
+	if err := s.db.UpdateGroups(del, put); err != nil {
+		return &PersistError{Err: err}
+	}
+	return nil
+}
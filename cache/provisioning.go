@@ -0,0 +1,113 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"time"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// Provisioning states of a host
+const (
+	// Pending = the host was created or changed since the last save, its files aren't written yet
+	Pending = "pending"
+	// Saved = the host's files are written, but it hasn't fetched them yet
+	Saved = "saved"
+	// Provisioned = the host fetched its files since they were last written
+	Provisioned = "provisioned"
+)
+
+// Provisioning is how far along a host is with getting its config
+type Provisioning struct {
+	State   string
+	Fetched time.Time // When the host last fetched its files, zero if it hasn't since they were written
+}
+
+// MarkSaved records hosts as what the last save wrote out. Hosts that are new or different to the save
+// before have to fetch their files again to be provisioned.
+func (s *Store) MarkSaved(hosts map[string]rt.Hosts) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fetched == nil {
+		s.fetched = map[string]time.Time{}
+	}
+	saved := make(map[string]rt.Hosts, len(hosts))
+	for k, h := range hosts {
+		if old, ok := s.saved[k]; !ok || !savedAs(k, old, h) {
+			delete(s.fetched, k)
+		}
+		saved[k] = copyHost(h)
+	}
+	for k := range s.fetched {
+		if _, ok := saved[k]; !ok {
+			delete(s.fetched, k)
+		}
+	}
+	s.saved = saved
+}
+
+// MarkFetched records that the host at addr, IPv4 or IPv6, fetched its files. It returns false if no host has addr.
+func (s *Store) MarkFetched(addr string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := ""
+	if _, ok := s.hosts[addr]; ok {
+		key = addr
+	} else if ip := net.ParseIP(addr); ip != nil {
+		for k, h := range s.hosts {
+			if other := net.ParseIP(h.FixedIPv6); other != nil && other.Equal(ip) {
+				key = k
+				break
+			}
+		}
+	}
+	if key == "" {
+		return false
+	}
+	if s.fetched == nil {
+		s.fetched = map[string]time.Time{}
+	}
+	s.fetched[key] = time.Now()
+	return true
+}
+
+// Provisioning returns how far along every host is, keyed by address
+func (s *Store) Provisioning() map[string]Provisioning {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	states := make(map[string]Provisioning, len(s.hosts))
+	for k, h := range s.hosts {
+		p := Provisioning{State: Pending}
+		if old, ok := s.saved[k]; ok && savedAs(k, old, h) {
+			p.State = Saved
+			if t, ok := s.fetched[k]; ok {
+				p.State, p.Fetched = Provisioned, t
+			}
+		}
+		states[k] = p
+	}
+	return states
+}
+
+// savedAs compares the host at key as it was saved with how it is now. Hosts from the config file don't
+// always carry their address, and their vars may have been through JSON since, so both are evened out.
+func savedAs(key string, saved rt.Hosts, now rt.Hosts) bool {
+	for _, h := range []*rt.Hosts{&saved, &now} {
+		*h = h.WithKey(key)
+		h.CfgFile, h.Revision = "", 0
+		if len(h.Groups) == 0 {
+			h.Groups = nil
+		}
+		if len(h.Vars) == 0 {
+			h.Vars = nil
+		}
+	}
+	a, errA := json.Marshal(saved)
+	b, errB := json.Marshal(now)
+	return errA == nil && errB == nil && bytes.Equal(a, b)
+}
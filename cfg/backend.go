@@ -0,0 +1,83 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// Artifact is a single file generated for a DHCP backend
+type Artifact struct {
+	Path    string
+	Content string
+	Check   string // Command that checks the file before it goes live, with {file} standing in for it
+}
+
+// DHCPBackend is implemented by each DHCP server flavour the tool can drive
+type DHCPBackend interface {
+	// Name returns the name used for the backend in the [Core] section
+	Name() string
+	// Render returns the files the DHCP server needs, built from c
+	Render(c Cfg) ([]Artifact, error)
+	// RenderHost returns what Render would write for a single host, without the rest of the file
+	RenderHost(c Cfg, h rt.Hosts) (string, error)
+	// ReloadCommands returns the commands that make the DHCP server pick up freshly written files.
+	// ReloadCommand in [Core] replaces them.
+	ReloadCommands() []string
+}
+
+// backends holds the constructors for every known DHCPBackend, keyed by name
+var backends = map[string]func(c Cfg) DHCPBackend{
+	"isc":      func(c Cfg) DHCPBackend { return ISCBackend{V6: c.HasV6()} },
+	"kea":      func(c Cfg) DHCPBackend { return KeaBackend{V6: c.HasV6()} },
+	"dnsmasq":  func(c Cfg) DHCPBackend { return DnsmasqBackend{} },
+	"embedded": func(c Cfg) DHCPBackend { return EmbeddedBackend{} },
+}
+
+// Backends that only write DHCPv4 files, the IPv6 side of a host would be left out
+var v4OnlyBackends = map[string]bool{
+	"dnsmasq": true,
+}
+
+// Backend returns the DHCP backend chosen in [Core]. ISC dhcpd is the default if none is set.
+func (c Cfg) Backend() (DHCPBackend, error) {
+	name := strings.ToLower(c.Core.DHCPBackend)
+	if name == "" {
+		name = "isc"
+	}
+
+	newBackend, ok := backends[name]
+	if !ok {
+		known := []string{}
+		for k := range backends {
+			known = append(known, k)
+		}
+		sort.Strings(known)
+		return nil, fmt.Errorf("unknown DHCP backend %q, expected one of: %s", c.Core.DHCPBackend, strings.Join(known, ", "))
+	}
+	return newBackend(c), nil
+}
+
+// hostScopes returns the scopes a host's addresses live in. A scope is left empty if the host has no address for it.
+func (c Cfg) hostScopes(h rt.Hosts) (scope ScopeCfg, scope6 ScopeCfg, err error) {
+	if h.FixedIP != "" {
+		if scope, err = c.ScopeFor(h.FixedIP); err != nil {
+			return scope, scope6, err
+		}
+	}
+	if h.FixedIPv6 != "" {
+		if scope6, err = c.ScopeFor(h.FixedIPv6); err != nil {
+			return scope, scope6, err
+		}
+	}
+	return scope, scope6, nil
+}
+
+// WriteArtifact replaces the file at a.Path with the content of a, in one go
+func WriteArtifact(a Artifact) error {
+	return Plan{Writes: []Artifact{a}}.Apply(nil)
+}
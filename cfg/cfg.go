@@ -4,40 +4,35 @@
 package cfg
 
 import (
-	"bufio"
 	"bytes"
-	"errors"
 	"fmt"
-	"log"
-	"os"
-	"os/exec"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
-	"time"
 
 	"github.com/BurntSushi/toml"
+	"github.com/networkbootstrap/ztpmanagercode/cache"
+	"github.com/networkbootstrap/ztpmanagercode/events"
 	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
-	templategen "github.com/networkbootstrap/ztpmanagercode/templategen/junos"
+	"github.com/networkbootstrap/ztpmanagercode/templategen"
 )
 
 const ifacetmpl = `# /etc/default/isc-dhcp-server
 #
 # Generated: by "EZJunosZTP" Tool
 #
-# Timestamp: %s
-# 
 # On what interfaces should the DHCP server (dhcpd) serve DHCP requests?
 #     Separate multiple interfaces with spaces, e.g. "eth0 eth1".
 
 INTERFACESv4="%s"
+INTERFACESv6="%s"
 `
 
 const dhcpdtmpl = `# /etc/dhcpd/dhcpd.conf
 # dhcpd.conf
 #
 # Generated: by "EZJunosZTP" Tool
-#
-# Timestamp: %s
 
 # The ddns-updates-style parameter controls
 ddns-update-style none;
@@ -60,24 +55,23 @@ option ezjunosztp-encap code 43 = encapsulate ezjunosztp;
 option ezjunosztp-file-server code 150 = ip-address;
 `
 
-const subnettmpl = `# Subnet definition
+const subnettmpl = `# Subnet definition: %s
 subnet %s netmask %s {
-	range dynamic-bootp %s %s;
-	option routers %s;
-}
 `
 
-const hosttmpl = `	# Host definition
-	host %s.%s {
-		hardware ethernet %s;
-		fixed-address %s;
-		option host-name "%s";
+const hosttmpl = `		# Host definition
+		host %s.%s {
+			hardware ethernet %s;
+			fixed-address %s;
+			option host-name "%s";
 `
 
 // Cfg type holds core DHCP ISC configuration
 type Cfg struct {
-	Core  CoreCfg             `json:"core"`
-	Hosts map[string]rt.Hosts `json:"hosts"`
+	Core   CoreCfg             `json:"core"`
+	Hosts  map[string]rt.Hosts `json:"hosts"`
+	Scopes []ScopeCfg          `json:"scopes"`
+	Groups map[string]GroupCfg `json:"groups"`
 }
 
 // CoreCfg holds core info
@@ -86,12 +80,31 @@ type CoreCfg struct {
 	HTTPPasswd          string   `json:"httppasswd"`
 	ServerURL           string   `json:"serverurl"`
 	ServerPort          int      `json:"srverport"`
-	HTTPConfigsLocation string   `json:"-"` // Directory for serving configurations "configs"
-	HTTPImagesLocation  string   `json:"-"` // Directory for serving configurations "images"
-	FileConfigsLocation string   `json:"-"` // Directory for generating configurations "./configs"
-	FileImagesLocation  string   `json:"-"` // Directory for generating configurations "./configs"
-	DHCPDPath           string   `json:"-"` // /etc/dhcpd/dhcpd.conf
-	DHCPPath            string   `json:"-"` // /etc/default/isc-dhcp-server
+	HTTPConfigsLocation string   `json:"-"`           // Directory for serving configurations "configs"
+	HTTPImagesLocation  string   `json:"-"`           // Directory for serving configurations "images"
+	FileConfigsLocation string   `json:"-"`           // Directory for generating configurations "./configs"
+	FileImagesLocation  string   `json:"-"`           // Directory for generating configurations "./configs"
+	TemplatesLocation   string   `json:"-"`           // Directory holding the vendor templates "./templates"
+	DHCPDPath           string   `json:"-"`           // /etc/dhcpd/dhcpd.conf
+	DHCPPath            string   `json:"-"`           // /etc/default/isc-dhcp-server
+	DHCPD6Path          string   `json:"-"`           // /etc/dhcp/dhcpd6.conf
+	DHCPCheckCommand    string   `json:"-"`           // Checks the DHCP server config before it goes live "dhcpd -t -cf {file}"
+	DHCP6CheckCommand   string   `json:"-"`           // Same for the DHCPv6 config "dhcpd -6 -t -cf {file}"
+	PreSaveCommand      string   `json:"-"`           // Run before a save touches any file, a failure stops the save
+	ReloadCommand       string   `json:"-"`           // Reloads the DHCP server instead of the backend's systemctl call
+	PostSaveCommand     string   `json:"-"`           // Run once a save is done
+	HookTimeout         int      `json:"-"`           // Seconds a hook gets before it's killed, 30 if not set
+	HistoryLocation     string   `json:"-"`           // Directory saved generations are kept in "./history"
+	HistoryKeep         int      `json:"-"`           // How many generations to keep, all of them if not set
+	GitRepository       string   `json:"-"`           // Commit each save to this git repository "." (off if not set)
+	HostDB              string   `json:"-"`           // Host database, each change is kept in it as it's made "./hosts.db"
+	DHCPBackend         string   `json:"dhcpbackend"` // "isc" (default), "kea", "dnsmasq" or "embedded"
+	DHCPListen          string   `json:"-"`           // Listen address for the embedded server ":67"
+	KeaPath             string   `json:"-"`           // /etc/kea/kea-dhcp4.conf
+	Kea6Path            string   `json:"-"`           // /etc/kea/kea-dhcp6.conf
+	DnsmasqPath         string   `json:"-"`           // /etc/dnsmasq.d/ztpmanager.conf
+	DnsmasqHostsPath    string   `json:"-"`           // /var/lib/ztpmanager/dnsmasq.hosts
+	DnsmasqOptsPath     string   `json:"-"`           // /var/lib/ztpmanager/dnsmasq.opts
 	DHCPIface           string   `json:"dhcpiface" dhcpd:"INTERFACESv4"`
 	DomainName          string   `json:"domainname" dhcpd:"option domain-name "`
 	DNSServers          []string `json:"dnservers" dhcpd:"option domain-name-servers"`
@@ -105,6 +118,12 @@ type CoreCfg struct {
 	TransferMode        string   `toml:"-" json:"transfermode" dhcpd:"option ezjunosztp.transfer-mode"`
 	FileServer          string   `json:"fileserver" dhcpd:"option ezjunosztp-file-server"`
 	NTPServers          []string `json:"ntpservers" dhcpd:"option ntp-servers"`
+	Subnet6             string   `json:"subnet6" dhcpd:"subnet6"`
+	NonCfgRange6Low     string   `json:"noncfgrange6low"`
+	NonCfgRange6High    string   `json:"noncfgrange6high"`
+	SubnetRouter6       string   `json:"subnetrouter6"`
+	FileServer6         string   `json:"fileserver6"`
+	Vars                rt.Vars  `json:"vars" toml:",omitempty"` // Template variables every host gets
 }
 
 // NewCfg returns a new empty Cfg struct
@@ -112,6 +131,7 @@ func NewCfg() Cfg {
 	rtn := Cfg{}
 	// Nil pointer panic error bug. Sometimes the config file is empty, so this never gets initd.
 	rtn.Hosts = make(map[string]rt.Hosts)
+	rtn.Groups = make(map[string]GroupCfg)
 	return rtn
 }
 
@@ -124,62 +144,85 @@ func (c *Cfg) Parse(cfgfile string) error {
 	// Let's hardwire this right here.
 	c.Core.TransferMode = "http"
 
-	return nil
+	return c.CheckScopes()
 }
 
-// Save marshals and saves the content of c
-// The REST API handler is blocking (Go routine single buffered channel), so no need to block here
-//func (c *Cfg) Save(cfgfile string, send chan rt.Envelope) error {
-func (c *Cfg) Save(cfgfile string) error {
-
-	// We need to quickly load up the FixedIP address fields, ConfigLocations and image files
-	for k, v := range c.Hosts {
-		v.FixedIP = k
-		v.CfgFile = c.Core.HTTPConfigsLocation + "/" + v.HostName + ".conf"
-		if v.CfgImage != "" {
-			tmpImage := v.CfgImage
-			v.CfgImage = c.Core.HTTPImagesLocation + "/" + tmpImage
-		}
-		c.Hosts[k] = v
+// ParseString unmarshalls TOML configuration text that doesn't come from the config file
+func ParseString(content string) (Cfg, error) {
+	c := NewCfg()
+	if _, err := toml.Decode(content, &c); err != nil {
+		return c, err
 	}
-
-	os.Remove(cfgfile)
-	f, err := os.OpenFile(cfgfile, os.O_RDWR|os.O_CREATE, 0755)
-	if err != nil {
-		log.Fatal(err)
+	if err := c.CheckScopes(); err != nil {
+		return c, err
 	}
+	if c.Hosts == nil {
+		c.Hosts = make(map[string]rt.Hosts)
+	}
+	if c.Groups == nil {
+		c.Groups = make(map[string]GroupCfg)
+	}
+	return c, nil
+}
 
-	w := bufio.NewWriter(f)
-	tomlEncoder := toml.NewEncoder(w)
-
-	err = tomlEncoder.Encode(c)
-	if err != nil {
+// prepare checks c is fit to be saved, and fills in the host fields derived from the rest of the config
+func (c *Cfg) prepare() error {
+	// Every host address has to land in a scope, otherwise it'd never get a lease, and nothing the DHCP server
+	// would choke on or two hosts would fight over gets past here
+	if err := c.CheckHosts(); err != nil {
 		return err
 	}
 
-	err = w.Flush()
-
-	if err != nil {
+	if err := c.CheckVendors(); err != nil {
 		return err
 	}
-
-	if err = f.Close(); err != nil {
+	if err := c.CheckGroups(); err != nil {
 		return err
 	}
 
+	// We need to quickly load up the FixedIP address fields, ConfigLocations and image files
+	for k, v := range c.Hosts {
+		v = v.WithKey(k)
+		v.CfgFile, v.CfgImage = c.HostFiles(v)
+		c.Hosts[k] = v
+	}
 	return nil
 }
 
+// Encode returns c as the TOML text of the config file
+func (c Cfg) Encode() (string, error) {
+	buf := new(bytes.Buffer)
+	tomlEncoder := toml.NewEncoder(buf)
+
+	if err := tomlEncoder.Encode(c); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// HostFiles returns the config file and image paths a host fetches from the file server.
+// It is safe to call on a host that has already been through Save.
+func (c Cfg) HostFiles(h rt.Hosts) (cfgfile string, image string) {
+	cfgfile = c.Core.HTTPConfigsLocation + "/" + ConfigFileName(h)
+	image = h.CfgImage
+	if image != "" && !strings.HasPrefix(image, c.Core.HTTPImagesLocation+"/") {
+		image = c.Core.HTTPImagesLocation + "/" + image
+	}
+	return cfgfile, image
+}
+
 // CreateIfaceSetting is a func that returns a stringified version of the cache for the DHCPd configuration
 // func (c Cfg) CreateIfaceSetting(send chan rt.Envelope) (string, error) {
 func (c Cfg) CreateIfaceSetting() (string, error) {
-	// Get timestamp
-	timeStamp := time.Now()
-	strtimeStamp := timeStamp.String()
-
 	buf := new(bytes.Buffer)
 
-	buf.Write([]byte(fmt.Sprintf(ifacetmpl, strtimeStamp, c.Core.DHCPIface)))
+	// dhcpd -6 only gets started on the interfaces if there's something to serve
+	ifacev6 := ""
+	if c.HasV6() {
+		ifacev6 = c.Core.DHCPIface
+	}
+
+	buf.Write([]byte(fmt.Sprintf(ifacetmpl, c.Core.DHCPIface, ifacev6)))
 	buf.Write([]byte(fmt.Sprint("\n")))
 
 	return buf.String(), nil
@@ -187,12 +230,10 @@ func (c Cfg) CreateIfaceSetting() (string, error) {
 
 // CreateDHCPd is a func that returns a stringified version of the cache for the DHCPd configuration
 func (c Cfg) CreateDHCPd() (string, error) {
-	// Get timestamp
-	timeStamp := time.Now()
-	strtimeStamp := timeStamp.String()
-
 	buf := new(bytes.Buffer)
-	buf.Write([]byte(fmt.Sprintf(dhcpdtmpl, strtimeStamp)))
+	buf.Write([]byte(dhcpdtmpl))
+	// Vendors can ask for options dhcpd doesn't know about
+	buf.Write([]byte(c.iscOptionDefs()))
 	buf.Write([]byte(fmt.Sprint("\n")))
 
 	// Let's deal with the core
@@ -205,7 +246,7 @@ func (c Cfg) CreateDHCPd() (string, error) {
 
 	field, _ = tcore.FieldByName("DNSServers")
 	buf.Write([]byte(field.Tag.Get("dhcpd")))
-	for k, v := range c.Core.DNSServers {
+	for k, v := range onlyV4(c.Core.DNSServers) {
 		if k == 0 {
 			buf.Write([]byte(fmt.Sprintf(" %s", v)))
 		} else {
@@ -222,24 +263,55 @@ func (c Cfg) CreateDHCPd() (string, error) {
 	buf.Write([]byte(field.Tag.Get("dhcpd")))
 	buf.Write([]byte(fmt.Sprintf("%v;\n", c.Core.MaxLease)))
 
-	field, _ = tcore.FieldByName("Subnet")
-	subnetStr := c.MakeSubnet()
-	buf.Write(subnetStr.Bytes())
+	// Each scope gets a subnet declaration, with the hosts that live in it grouped inside
+	for _, scope := range c.AllScopes() {
+		if !scope.IsV4() {
+			continue
+		}
+		buf.Write(c.MakeSubnet(scope).Bytes())
+	}
+
+	return buf.String(), nil
+}
+
+// MakeSubnet returns a subnet string with the group of hosts belonging to the scope
+func (c Cfg) MakeSubnet(s ScopeCfg) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	buf.Write([]byte("\n"))
+	buf.Write([]byte(fmt.Sprintf(subnettmpl, s.Name, s.Subnet, s.SubnetMask)))
+
+	tscope := reflect.TypeOf(s)
+
+	if s.NonCfgRangeLow != "" && s.NonCfgRangeHigh != "" {
+		buf.Write([]byte(fmt.Sprintf("\trange dynamic-bootp %s %s;\n", s.NonCfgRangeLow, s.NonCfgRangeHigh)))
+	}
+
+	// dhcpd won't take an empty routers option
+	field, _ := tscope.FieldByName("SubnetRouter")
+	if s.SubnetRouter != "" {
+		buf.Write([]byte(fmt.Sprintf("\t%s %s;\n", field.Tag.Get("dhcpd"), s.SubnetRouter)))
+	}
+
+	// Only write the DNS servers if the scope overrides the global ones
+	if dns := onlyV4(s.DNSServers); len(dns) > 0 && !reflect.DeepEqual(dns, onlyV4(c.Core.DNSServers)) {
+		field, _ = tscope.FieldByName("DNSServers")
+		buf.Write([]byte(fmt.Sprintf("\t%s %s;\n", field.Tag.Get("dhcpd"), strings.Join(dns, ", "))))
+	}
 
 	// Deal with Group creation
-	buf.Write([]byte("\ngroup {\n"))
+	buf.Write([]byte("\n\tgroup {\n"))
 
-	field, _ = tcore.FieldByName("FileServer")
-	buf.Write([]byte(fmt.Sprintf("\t%s", field.Tag.Get("dhcpd"))))
-	buf.Write([]byte(fmt.Sprintf(" %s;\n", c.Core.FileServer)))
+	field, _ = tscope.FieldByName("FileServer")
+	buf.Write([]byte(fmt.Sprintf("\t\t%s", field.Tag.Get("dhcpd"))))
+	buf.Write([]byte(fmt.Sprintf(" %s;\n", s.FileServer)))
 
-	field, _ = tcore.FieldByName("TransferMode")
-	buf.Write([]byte(fmt.Sprintf("\t%s", field.Tag.Get("dhcpd"))))
+	field, _ = reflect.TypeOf(c.Core).FieldByName("TransferMode")
+	buf.Write([]byte(fmt.Sprintf("\t\t%s", field.Tag.Get("dhcpd"))))
 	buf.Write([]byte(fmt.Sprintf(" \"%s\";\n", c.Core.TransferMode)))
 
-	field, _ = tcore.FieldByName("NTPServers")
-	buf.Write([]byte(fmt.Sprintf("\t%s", field.Tag.Get("dhcpd"))))
-	for k, v := range c.Core.NTPServers {
+	field, _ = tscope.FieldByName("NTPServers")
+	buf.Write([]byte(fmt.Sprintf("\t\t%s", field.Tag.Get("dhcpd"))))
+	for k, v := range onlyV4(s.NTPServers) {
 		if k == 0 {
 			buf.Write([]byte(fmt.Sprintf(" %s", v)))
 		} else {
@@ -248,224 +320,337 @@ func (c Cfg) CreateDHCPd() (string, error) {
 	}
 	buf.Write([]byte(fmt.Sprint(";\n")))
 
-	// Now deal with host creation. We must indent by 2x tabs here.
-	for _, v := range c.Hosts {
-		buf.Write(MakeHost(v, c.Core.DomainName, c.Core.HTTPConfigsLocation, c.Core.HTTPImagesLocation).Bytes())
+	// Now deal with host creation for the hosts inside this scope.
+	for _, v := range c.HostsIn(s) {
+		buf.Write(MakeHost(v, c.Core.DomainName, c.HostOptions(v, s)).Bytes())
 	}
 	// End Group creation
+	buf.Write([]byte("\t}\n"))
 	buf.Write([]byte("}\n"))
-
-	return buf.String(), nil
-}
-
-// MakeSubnet returns a subnet string
-func (c Cfg) MakeSubnet() *bytes.Buffer {
-	buf := new(bytes.Buffer)
-	buf.Write([]byte("\n"))
-	buf.Write([]byte(fmt.Sprintf(subnettmpl, c.Core.Subnet, c.Core.SubnetMask, c.Core.NonCfgRangeLow, c.Core.NonCfgRangeHigh, c.Core.SubnetRouter)))
 	return buf
 }
 
-// MakeHost returns a subnet string
-func MakeHost(h rt.Hosts, d string, cdir, imgdir string) *bytes.Buffer {
+// MakeHost returns a host string carrying the vendor DHCP options
+func MakeHost(h rt.Hosts, d string, opts []templategen.DHCPOption) *bytes.Buffer {
 	buf := new(bytes.Buffer)
 	buf.Write([]byte("\n"))
 
-	thost := reflect.TypeOf(h)
-
 	buf.Write([]byte(fmt.Sprintf(hosttmpl, h.HostName, d, h.Ethernet, h.FixedIP, h.HostName)))
-	if h.CfgFile != "" {
-		field, _ := thost.FieldByName("CfgFile")
-		buf.Write([]byte(fmt.Sprintf("\t\t%s", field.Tag.Get("dhcpd"))))
-		buf.Write([]byte(fmt.Sprintf("\"%s\";\n", h.CfgFile)))
+	for _, o := range opts {
+		buf.Write([]byte(fmt.Sprintf("\t\t\toption %s %s;\n", iscOptionName(o), iscOptionValue(o))))
 	}
-	if h.CfgImage != "" {
-		field, _ := thost.FieldByName("CfgImage")
-		buf.Write([]byte(fmt.Sprintf("\t\t%s ", field.Tag.Get("dhcpd"))))
-		buf.Write([]byte(fmt.Sprintf("\"%s\";\n", h.CfgImage)))
-	}
-	buf.Write([]byte("\t}\n"))
+	buf.Write([]byte("\t\t}\n"))
 	return buf
 }
 
-// String gets the map of hosts and combines it, then returns the data
-func (c *Cfg) String(send chan rt.Envelope) (string, error) {
-	var b []byte
-	buf := bytes.NewBuffer(b)
-	tomlEncoder := toml.NewEncoder(buf)
-	err := tomlEncoder.Encode(c.Core)
-	if err != nil {
-		return "", nil
-	}
-	returnString := buf.String()
-
-	// Now let's get the stringified version of our TOML from the Hosts map
-	reqChan := make(chan rt.Envelope, 1)
-	req := rt.Envelope{}
-	req.CRUD = rt.STRING
-	req.Response = reqChan
-	send <- req
-	resp := <-req.Response
-
-	if resp.CRUD == rt.OK {
-		returnString += "\n"
-		returnString += resp.String
-		return returnString, nil
-	}
-	err = errors.New("Error retrieving stringified map hosts")
-
-	return "", err
-}
-
 // APIResponder is a GR that responds to REST API calls
-// Note, the cache doesn't need to be locked. If we try, we'll get deadlocked.
-func (c *Cfg) APIResponder(cachesend chan rt.Envelope, fname string, wg *sync.WaitGroup) (recvch chan rt.Envelope, finish chan struct{}) {
+// Hosts are edited in the store directly. Each call works on a snapshot of them taken as it comes in.
+func (c *Cfg) APIResponder(store *cache.Store, bus *events.Broker, fname string, wg *sync.WaitGroup) (recvch chan rt.Envelope, finish chan struct{}) {
 	recvch = make(chan rt.Envelope, 1)
 	finish = make(chan struct{})
 	deletelist := []string{}
+	// Hosts as of the last save, to tell which ones the next commit touches and which are provisioned
+	saved := c.clone().Hosts
+	store.MarkSaved(saved)
 
 	go func() {
 		for {
 			select {
 			case recv := <-recvch:
+				c.Hosts = store.Snapshot()
 
 				switch recv.CRUD {
 				case rt.DELETE:
+					// The host has already left the store
 					resp := rt.Envelope{}
-					hostname := c.Hosts[recv.FixedIP].HostName
-					deletelist = append(deletelist, hostname)
+					deletelist = append(deletelist, DeviceFiles(recv.Hosts)...)
 					resp.CRUD = rt.OK
 					recv.Response <- resp
 
-				case rt.SAVECFG:
-					// Delete the entries from the delete list and kill the list
-					for _, v := range deletelist {
-						filename := fmt.Sprintf("%s/%s.conf", c.Core.FileConfigsLocation, v)
-
-						err := os.Remove(filename)
-						if err != nil {
-							fmt.Print(err)
-						}
+				case rt.READGROUP:
+					resp := rt.Envelope{}
+					resp.CRUD = rt.ERROR
+					if g, ok := c.Groups[recv.Group]; ok {
+						resp.CRUD = rt.OK
+						resp.Group = recv.Group
+						resp.Vars = g.Vars
 					}
-					// Kill deletelist and rebirth
-					deletelist = []string{}
+					recv.Response <- resp
 
+				case rt.READGROUPS:
 					resp := rt.Envelope{}
-					err := c.Save(fname)
-					if err != nil {
-						fmt.Print(err)
+					resp.CRUD = rt.OK
+					resp.GroupList = c.GroupNames()
+					recv.Response <- resp
+
+				case rt.UPDATEGROUP:
+					resp := rt.Envelope{}
+					if err := store.PutGroup(recv.Group, recv.Vars); err != nil {
 						resp.CRUD = rt.ERROR
+						resp.String = err.Error()
 						recv.Response <- resp
-						// We're done here
 						break
 					}
+					if c.Groups == nil {
+						c.Groups = make(map[string]GroupCfg)
+					}
+					c.Groups[recv.Group] = GroupCfg{Vars: recv.Vars}
+					bus.Publish(events.GroupEvent(recv.Group, &recv.Vars))
+					resp.CRUD = rt.OK
+					recv.Response <- resp
+
+				case rt.DELETEGROUP:
+					resp := rt.Envelope{}
+					resp.CRUD = rt.ERROR
+					if _, ok := c.Groups[recv.Group]; !ok {
+						resp.String = fmt.Sprintf("unknown group %q", recv.Group)
+					} else if members := c.groupMembers(recv.Group); len(members) > 0 {
+						// Hosts would be left pointing at nothing. Group is set, as with READGROUP, because it's there.
+						resp.Group = recv.Group
+						resp.String = fmt.Sprintf("group %q still has hosts: %s", recv.Group, strings.Join(members, ", "))
+					} else if err := store.DeleteGroup(recv.Group); err != nil {
+						resp.Group = recv.Group
+						resp.String = err.Error()
+					} else {
+						delete(c.Groups, recv.Group)
+						bus.Publish(events.GroupEvent(recv.Group, nil))
+						resp.CRUD = rt.OK
+					}
+					recv.Response <- resp
 
-					dhcpdStr, err := c.CreateDHCPd()
+				case rt.RENDERHOST:
+					// Previews only, nothing here touches the disk
+					resp := rt.Envelope{}
+					resp.CRUD = rt.ERROR
+					artifacts, err := c.GenerateDevice(recv.Hosts)
 					if err != nil {
-						fmt.Print(err)
-						resp.CRUD = rt.ERROR
+						resp.String = err.Error()
 						recv.Response <- resp
 						break
 					}
+					// Defaults to the config, scripts are asked for by name
+					want := artifacts[0].Path
+					if recv.String != "" {
+						want = filepath.Join(c.Core.FileConfigsLocation, recv.String)
+					}
+					resp.String = fmt.Sprintf("no file %q is generated for host %s", recv.String, recv.Key())
+					for _, a := range artifacts {
+						if a.Path == want {
+							resp.CRUD = rt.OK
+							resp.String = a.Content
+						}
+					}
+					recv.Response <- resp
+
+				case rt.RENDERDHCP:
+					resp := rt.Envelope{}
+					resp.CRUD = rt.ERROR
+					backend, err := c.Backend()
+					if err == nil {
+						resp.String, err = backend.RenderHost(*c, recv.Hosts)
+					}
+					if err != nil {
+						resp.String = err.Error()
+					} else {
+						resp.CRUD = rt.OK
+					}
+					recv.Response <- resp
 
-					// Save the contents of the dhcpdStr string to the file for the DHCPD path
-					os.Remove(c.Core.DHCPDPath)
-					f, err := os.OpenFile(c.Core.DHCPDPath, os.O_RDWR|os.O_CREATE, 0755)
+				case rt.DRYRUN:
+					resp := rt.Envelope{}
+					resp.CRUD = rt.ERROR
+					plan, err := c.DryRun(fname, deletelist)
+					if err == nil {
+						resp.Changes, err = plan.Changes()
+					}
 					if err != nil {
-						log.Fatal(err)
+						resp.String = err.Error()
+						resp.Problems = problemsOf(err)
+						resp.Step = stepOf(err)
+					} else {
+						resp.CRUD = rt.OK
 					}
+					recv.Response <- resp
 
-					w := bufio.NewWriter(f)
-					_, err = w.WriteString(dhcpdStr)
+				case rt.SAVECFG:
+					resp := rt.Envelope{}
+					resp.CRUD = rt.ERROR
+					hooks := &Hooks{Timeout: c.HookTimeout(), Results: []rt.HookResult{}}
+					// The hosts as the store has them, the save fills in their config and image paths
+					hosts := c.clone().Hosts
+					plan, err := c.save(fname, deletelist, hooks)
+					resp.Hooks = hooks.Results
 					if err != nil {
-						fmt.Print(err)
-						resp.CRUD = rt.ERROR
+						fmt.Printf("Save failed: %s\n", err)
+						resp.String = err.Error()
+						resp.Problems = problemsOf(err)
+						resp.Step = stepOf(err)
+						bus.Publish(events.Event{Type: events.SaveFailed, User: recv.User, Message: resp.String})
 						recv.Response <- resp
+						// We're done here
 						break
 					}
-					err = w.Flush()
 
+					// Kill deletelist and rebirth
+					deletelist = []string{}
+
+					resp.CRUD = rt.OK
+					resp.To = c.keepGeneration(plan, fname, recv.User, "")
+					c.Hosts = hosts
+					resp.String = c.commitSave(fname, recv.User, "Save", resp.To, saved)
+					saved = hosts
+					store.MarkSaved(saved)
+					bus.Publish(events.Event{Type: events.Save, User: recv.User, Generation: resp.To, Commit: resp.String})
+					recv.Response <- resp
+
+				case rt.READGENS:
+					resp := rt.Envelope{}
+					resp.CRUD = rt.ERROR
+					gens, err := c.Generations()
 					if err != nil {
-						log.Fatal(err)
+						resp.String = err.Error()
+					} else {
+						resp.CRUD = rt.OK
+						resp.Gens = gens
 					}
+					recv.Response <- resp
 
-					if err = f.Close(); err != nil {
-						fmt.Print(err)
-						resp.CRUD = rt.ERROR
-						recv.Response <- resp
-						break
+				case rt.DIFFGENS:
+					resp := rt.Envelope{}
+					resp.CRUD = rt.ERROR
+					changes, err := c.DiffGenerations(recv.From, recv.To)
+					if err != nil {
+						resp.String = err.Error()
+					} else {
+						resp.CRUD = rt.OK
+						resp.Changes = changes
 					}
+					recv.Response <- resp
 
-					// Get the dhcp (iface) configs and save
-					dhcpStr, err := c.CreateIfaceSetting()
+				case rt.ROLLBACK:
+					resp := rt.Envelope{}
+					resp.CRUD = rt.ERROR
+					g, err := c.LoadGeneration(recv.To)
+					var snap Cfg
+					if err == nil {
+						snap, err = g.Config()
+					}
 					if err != nil {
-						fmt.Print(err)
-						resp.CRUD = rt.ERROR
+						resp.String = err.Error()
+						resp.Step = "generation"
 						recv.Response <- resp
 						break
 					}
 
-					// Save the contents of the dhcpdStr string to the file for the DHCPD path
-					os.Remove(c.Core.DHCPPath)
-					f, err = os.OpenFile(c.Core.DHCPPath, os.O_RDWR|os.O_CREATE, 0755)
-					if err != nil {
-						log.Fatal(err)
+					// Files of hosts that aren't in the generation have to go. The rest get rewritten anyway.
+					before := c.clone()
+					gone := append([]string{}, deletelist...)
+					for _, h := range before.Hosts {
+						gone = append(gone, DeviceFiles(h)...)
 					}
 
-					w = bufio.NewWriter(f)
-					_, err = w.WriteString(dhcpStr)
+					hooks := &Hooks{Timeout: c.HookTimeout(), Results: []rt.HookResult{}}
+					var plan Plan
+					var hosts map[string]rt.Hosts
+					if err = c.replaceHosts(store, snap.Hosts); err != nil {
+						// Hosts of the generation clash with each other
+						resp.Step = "conflict"
+					} else if err = c.replaceGroups(store, bus, snap.Groups); err == nil {
+						hosts = c.clone().Hosts
+						plan, err = c.save(fname, gone, hooks)
+						resp.Step = stepOf(err)
+					}
+					if _, ok := err.(*cache.PersistError); ok {
+						resp.Step = "persist"
+					}
+					resp.Hooks = hooks.Results
 					if err != nil {
-						fmt.Print(err)
-						resp.CRUD = rt.ERROR
+						// Back to how things were, revisions and all. The files already are.
+						c.restoreHosts(store, before.Hosts)
+						c.replaceGroups(store, bus, before.Groups)
+						fmt.Printf("Rollback to generation %d failed: %s\n", recv.To, err)
+						resp.String = err.Error()
+						resp.Problems = problemsOf(err)
+						bus.Publish(events.Event{Type: events.SaveFailed, User: recv.User, Message: fmt.Sprintf("rollback to generation %d: %s", recv.To, resp.String)})
 						recv.Response <- resp
 						break
 					}
-					err = w.Flush()
-					if err := f.Close(); err != nil {
-						fmt.Print(err)
-						resp.CRUD = rt.ERROR
+
+					deletelist = []string{}
+
+					resp.CRUD = rt.OK
+					resp.To = c.keepGeneration(plan, fname, recv.User, fmt.Sprintf("rollback to generation %d", g.Number))
+					c.Hosts = hosts
+					resp.String = c.commitSave(fname, recv.User, fmt.Sprintf("Rollback to generation %d", g.Number), resp.To, saved)
+					saved = hosts
+					store.MarkSaved(saved)
+					bus.Publish(events.Event{Type: events.Rollback, User: recv.User, Generation: resp.To, Commit: resp.String,
+						Message: fmt.Sprintf("rollback to generation %d", g.Number)})
+					recv.Response <- resp
+
+				case rt.EXPORTCFG:
+					resp := rt.Envelope{}
+					resp.CRUD = rt.ERROR
+					content, err := c.Encode()
+					if err != nil {
+						resp.String = err.Error()
+					} else {
+						resp.CRUD = rt.OK
+						resp.String = content
+					}
+					recv.Response <- resp
+
+				case rt.IMPORTCFG:
+					// Only takes the hosts and groups, they're deployed by the next save
+					resp := rt.Envelope{}
+					resp.CRUD = rt.ERROR
+					imported, err := ParseString(recv.String)
+					if err != nil {
+						resp.String = err.Error()
 						recv.Response <- resp
 						break
 					}
 
-					// Now for the fun part, let's generate the device configurations! Whoop whoop.
-					// Get device template payload for each device
-					for _, v := range c.Hosts {
-						tmplPayload := templategen.JunosTemplatePayload{}
-						tmplPayload.DNSServers = c.Core.DNSServers
-						tmplPayload.DomainName = c.Core.DomainName
-						tmplPayload.Gateway = c.Core.SubnetRouter
-						tmplPayload.NTPServers = c.Core.NTPServers
-						tmplPayload.FixedIP = v.FixedIP
-						tmplPayload.HostName = v.HostName
-
-						// Send parameters to method to save file
-						cfgFileLoc := c.Core.FileConfigsLocation + "/" + v.HostName + ".conf"
-
-						// If you want to extend and insert another vendor, start here!
-						switch v.Vendor {
-						case "junos":
-							err := templategen.SaveJunosConfig(cfgFileLoc, "./templates/junos/junos.template", tmplPayload)
-							if err != nil {
-								fmt.Print(err)
-								resp.CRUD = rt.ERROR
-								recv.Response <- resp
-								break
-							}
-						}
+					before := c.clone()
+					gone := []string{}
+					for _, h := range before.Hosts {
+						gone = append(gone, DeviceFiles(h)...)
 					}
-
-					// Find a way
-					go func() {
-						cmd := exec.Command("systemctl", "restart", "isc-dhcp-server")
-						err := cmd.Run()
-						if err != nil {
-							fmt.Printf("Issue restarting ISC service: %s \n", err)
+					if err = c.replaceHosts(store, imported.Hosts); err == nil {
+						if err = c.replaceGroups(store, bus, imported.Groups); err != nil {
+							// The hosts go back with the groups they were in
+							c.restoreHosts(store, before.Hosts)
+							c.Groups = before.Groups
 						}
-					}()
+					}
+					if err != nil {
+						resp.String = err.Error()
+						recv.Response <- resp
+						break
+					}
+					// Files of hosts that didn't come back get removed, the rest get rewritten anyway
+					deletelist = append(deletelist, gone...)
 
 					resp.CRUD = rt.OK
+					resp.HostList = c.sortedHostKeys()
+					resp.GroupList = c.GroupNames()
+					recv.Response <- resp
 
+				case rt.GITLOG:
+					resp := rt.Envelope{}
+					resp.CRUD = rt.ERROR
+					if !c.GitEnabled() {
+						resp.String = "saves aren't committed to git, GitRepository isn't set"
+						recv.Response <- resp
+						break
+					}
+					commits, err := c.GitLog(recv.Limit)
+					if err != nil {
+						resp.String = err.Error()
+					} else {
+						resp.CRUD = rt.OK
+						resp.Commits = commits
+					}
 					recv.Response <- resp
 				}
 			case <-finish:
@@ -477,3 +662,85 @@ func (c *Cfg) APIResponder(cachesend chan rt.Envelope, fname string, wg *sync.Wa
 	}()
 	return
 }
+
+// save renders and checks everything, runs the pre-save hook, swaps the files in and reloads the DHCP server,
+// then runs the post-save hook. The plan is returned so it can be kept as a generation.
+func (c *Cfg) save(fname string, deletelist []string, hooks *Hooks) (Plan, error) {
+	// Render everything up front, so a bad host or template doesn't leave a half written mess
+	plan, err := c.Plan(fname, deletelist)
+	if err != nil {
+		return plan, err
+	}
+
+	backend, err := c.Backend()
+	if err != nil {
+		return plan, &SaveError{Step: "render", Err: err}
+	}
+
+	// Nothing has been touched yet, so a failing pre-save hook just stops the save
+	if err = hooks.Run("pre-save", c.Core.PreSaveCommand); err != nil {
+		return plan, &SaveError{Step: "pre-save", Err: err}
+	}
+
+	// The files go in together and the DHCP server is reloaded before we answer,
+	// anything going wrong puts the previous generation back
+	err = plan.Apply(func() error {
+		return hooks.Run("reload", c.ReloadCommands(backend)...)
+	})
+	if err != nil {
+		return plan, err
+	}
+
+	// The save stands whatever the post-save hook makes of it, the caller gets to see how it went
+	hooks.Run("post-save", c.Core.PostSaveCommand)
+	return plan, nil
+}
+
+// keepGeneration keeps a successful save in the history and returns its generation number.
+// The save has happened either way, so a failure is only logged and 0 returned.
+func (c Cfg) keepGeneration(p Plan, fname string, author string, note string) int {
+	n, err := c.KeepGeneration(p, fname, author, note)
+	if err != nil {
+		fmt.Printf("Issue keeping the generation: %s\n", err)
+		return 0
+	}
+	return n
+}
+
+// commitSave commits a successful save to the git repository, if there is one, and returns the commit.
+// The save stands if that fails, it's only logged. before is the hosts as of the last save.
+func (c Cfg) commitSave(fname string, author string, what string, generation int, before map[string]rt.Hosts) string {
+	if !c.GitEnabled() {
+		return ""
+	}
+	commit, err := c.CommitSave(fname, author, commitMessage(what, author, generation, before, c.Hosts))
+	if err != nil {
+		fmt.Printf("Issue committing the save: %s\n", err)
+		return ""
+	}
+	return commit
+}
+
+// replaceHosts swaps every host in the store for hosts
+func (c *Cfg) replaceHosts(store *cache.Store, hosts map[string]rt.Hosts) error {
+	return c.swapHosts(store, store.Replace, hosts)
+}
+
+// restoreHosts puts the hosts of the store back as they were before a replaceHosts. hosts come from the
+// store, and keep their revisions.
+func (c *Cfg) restoreHosts(store *cache.Store, hosts map[string]rt.Hosts) error {
+	return c.swapHosts(store, store.Restore, hosts)
+}
+
+// swapHosts does the work of replaceHosts and restoreHosts, swapping the hosts of store for hosts with swap
+func (c *Cfg) swapHosts(store *cache.Store, swap func(map[string]rt.Hosts) error, hosts map[string]rt.Hosts) error {
+	keyed := make(map[string]rt.Hosts, len(hosts))
+	for k, h := range hosts {
+		keyed[k] = h.WithKey(k)
+	}
+	if err := swap(keyed); err != nil {
+		return err
+	}
+	c.Hosts = store.Snapshot()
+	return nil
+}
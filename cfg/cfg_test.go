@@ -0,0 +1,271 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/networkbootstrap/ztpmanagercode/cache"
+	"github.com/networkbootstrap/ztpmanagercode/events"
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+	_ "github.com/networkbootstrap/ztpmanagercode/templategen/junos"
+)
+
+// memDB keeps hosts and groups in memory. Writing groups fails while failGroups is set.
+type memDB struct {
+	hosts      map[string]rt.Hosts
+	groups     map[string]rt.Vars
+	failGroups bool
+}
+
+func (m *memDB) Load() (map[string]rt.Hosts, bool, error) { return m.hosts, m.hosts != nil, nil }
+
+func (m *memDB) Update(del []string, put map[string]rt.Hosts) error {
+	for _, k := range del {
+		delete(m.hosts, k)
+	}
+	for k, h := range put {
+		m.hosts[k] = h
+	}
+	return nil
+}
+
+func (m *memDB) Replace(hosts map[string]rt.Hosts) error {
+	m.hosts = map[string]rt.Hosts{}
+	return m.Update(nil, hosts)
+}
+
+func (m *memDB) LoadGroups() (map[string]rt.Vars, bool, error) { return m.groups, m.groups != nil, nil }
+
+func (m *memDB) UpdateGroups(del []string, put map[string]rt.Vars) error {
+	if m.failGroups {
+		return errors.New("disk full")
+	}
+	for _, k := range del {
+		delete(m.groups, k)
+	}
+	for k, v := range put {
+		m.groups[k] = v
+	}
+	return nil
+}
+
+func (m *memDB) ReplaceGroups(groups map[string]rt.Vars) error {
+	if m.failGroups {
+		return errors.New("disk full")
+	}
+	m.groups = map[string]rt.Vars{}
+	return m.UpdateGroups(nil, groups)
+}
+
+func (m *memDB) Close() error { return nil }
+
+// labCfg returns a config for the embedded DHCP server with one scope, 10.9.0.0/24, and no hosts
+func labCfg() Cfg {
+	c := NewCfg()
+	c.Core.DHCPBackend = "embedded"
+	c.Core.HTTPConfigsLocation = "configs"
+	c.Core.HTTPImagesLocation = "images"
+	c.Core.TemplatesLocation = "../cmd/templates"
+	c.Core.FileServer = "10.9.0.254"
+	c.Core.TransferMode = "http"
+	c.Scopes = []ScopeCfg{{
+		Name:            "lab",
+		Subnet:          "10.9.0.0",
+		SubnetMask:      "255.255.255.0",
+		SubnetRouter:    "10.9.0.1",
+		NonCfgRangeLow:  "10.9.0.100",
+		NonCfgRangeHigh: "10.9.0.199",
+	}}
+	return c
+}
+
+// responder starts c's APIResponder on a store kept in db. Saves write to a temporary directory.
+// stop ends it, c can be looked at after.
+func responder(t *testing.T, c *Cfg, db cache.Persister) (store *cache.Store, send func(rt.Envelope) rt.Envelope, stop func()) {
+	store, _, err := cache.Open(db, c.Hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "cfg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Core.FileConfigsLocation = filepath.Join(dir, "configs")
+	if err = os.Mkdir(c.Core.FileConfigsLocation, 0755); err != nil {
+		t.Fatal(err)
+	}
+	c.Core.HistoryLocation = filepath.Join(dir, "history")
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	recvch, finish := c.APIResponder(store, events.NewBroker(), filepath.Join(dir, "config.toml"), wg)
+
+	send = func(req rt.Envelope) rt.Envelope {
+		req.Response = make(chan rt.Envelope, 1)
+		recvch <- req
+		return <-req.Response
+	}
+	stop = func() {
+		close(finish)
+		wg.Wait()
+		os.RemoveAll(dir)
+	}
+	return store, send, stop
+}
+
+func TestImportKeepsHostsWhenGroupsFail(t *testing.T) {
+	c := NewCfg()
+	c.Hosts["10.0.0.1"] = rt.Hosts{FixedIP: "10.0.0.1", HostName: "old", Ethernet: "02:00:00:00:00:01", Groups: []string{"lab"}}
+	c.Groups["lab"] = GroupCfg{Vars: rt.Vars{"ntp": "10.0.0.254"}}
+	db := &memDB{failGroups: true}
+	store, send, stop := responder(t, &c, db)
+	before := store.Snapshot()
+
+	resp := send(rt.Envelope{CRUD: rt.IMPORTCFG, String: `
+[Hosts."10.0.0.1"]
+  FixedIP = "10.0.0.1"
+  HostName = "renamed"
+  Ethernet = "02:00:00:00:00:01"
+  Groups = ["core"]
+
+[Hosts."10.0.0.2"]
+  FixedIP = "10.0.0.2"
+  HostName = "new"
+  Ethernet = "02:00:00:00:00:02"
+  Groups = ["core"]
+
+[Groups.core.Vars]
+  ntp = "10.0.0.253"
+`})
+	stop()
+
+	if resp.CRUD != rt.ERROR {
+		t.Fatalf("import succeeded although its groups couldn't be written")
+	}
+	if got := store.Snapshot(); !reflect.DeepEqual(got, before) {
+		t.Errorf("store holds %v after the failed import, expected %v", got, before)
+	}
+	if !reflect.DeepEqual(db.hosts, before) {
+		t.Errorf("database holds %v after the failed import, expected %v", db.hosts, before)
+	}
+	if _, ok := c.Groups["lab"]; !ok || len(c.Groups) != 1 {
+		t.Errorf("groups are %v after the failed import, expected only lab", c.Groups)
+	}
+}
+
+func TestSaveMarksHostsSaved(t *testing.T) {
+	c := labCfg()
+	c.Hosts["10.9.0.10"] = rt.Hosts{FixedIP: "10.9.0.10", HostName: "sw1", Ethernet: "02:00:00:00:00:0a", Vendor: "junos", CfgImage: "jinstall.tgz"}
+	c.Hosts["10.9.0.11"] = rt.Hosts{FixedIP: "10.9.0.11", HostName: "sw2", Ethernet: "02:00:00:00:00:0b", Vendor: "junos"}
+	store, send, stop := responder(t, &c, &memDB{})
+	defer stop()
+
+	if resp := send(rt.Envelope{CRUD: rt.SAVECFG}); resp.CRUD != rt.OK {
+		t.Fatalf("save failed: %s", resp.String)
+	}
+	for k, p := range store.Provisioning() {
+		if p.State != cache.Saved {
+			t.Errorf("host %s is %s after the save, expected %s", k, p.State, cache.Saved)
+		}
+	}
+	if h, _ := store.Get("10.9.0.10"); h.CfgImage != "jinstall.tgz" {
+		t.Errorf("store has image %q, expected it as it was created", h.CfgImage)
+	}
+}
+
+// generations returns the numbers of the kept generations and the notes on them
+func generations(t *testing.T, send func(rt.Envelope) rt.Envelope) []string {
+	resp := send(rt.Envelope{CRUD: rt.READGENS})
+	if resp.CRUD != rt.OK {
+		t.Fatalf("generations can't be read: %s", resp.String)
+	}
+	gens := []string{}
+	for _, g := range resp.Gens {
+		gens = append(gens, fmt.Sprintf("%d %s", g.Number, g.Note))
+	}
+	return gens
+}
+
+// savedTwice returns a responder with two generations kept. sw1 is at 10.9.0.10 in the first, and renamed
+// to sw1-new next to sw2 in the second.
+func savedTwice(t *testing.T, db *memDB) (store *cache.Store, send func(rt.Envelope) rt.Envelope, stop func()) {
+	c := labCfg()
+	c.Hosts["10.9.0.10"] = rt.Hosts{FixedIP: "10.9.0.10", HostName: "sw1", Ethernet: "02:00:00:00:00:0a", Vendor: "junos"}
+	store, send, stop = responder(t, &c, db)
+
+	if resp := send(rt.Envelope{CRUD: rt.SAVECFG}); resp.CRUD != rt.OK {
+		t.Fatalf("first save failed: %s", resp.String)
+	}
+	if _, err := store.Update("10.9.0.10", rt.Hosts{FixedIP: "10.9.0.10", HostName: "sw1-new", Ethernet: "02:00:00:00:00:0a", Vendor: "junos"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Create(rt.Hosts{FixedIP: "10.9.0.11", HostName: "sw2", Ethernet: "02:00:00:00:00:0b", Vendor: "junos"}); err != nil {
+		t.Fatal(err)
+	}
+	if resp := send(rt.Envelope{CRUD: rt.SAVECFG}); resp.CRUD != rt.OK {
+		t.Fatalf("second save failed: %s", resp.String)
+	}
+	return store, send, stop
+}
+
+func TestRollback(t *testing.T) {
+	store, send, stop := savedTwice(t, &memDB{})
+	defer stop()
+
+	resp := send(rt.Envelope{CRUD: rt.ROLLBACK, To: 1})
+	if resp.CRUD != rt.OK {
+		t.Fatalf("rollback failed: %s", resp.String)
+	}
+	if resp.To != 3 {
+		t.Errorf("rollback kept generation %d, expected 3", resp.To)
+	}
+	want := []string{"1 ", "2 ", "3 rollback to generation 1"}
+	if got := generations(t, send); !reflect.DeepEqual(got, want) {
+		t.Errorf("generations are %q, expected %q", got, want)
+	}
+
+	if keys := store.Keys(); !reflect.DeepEqual(keys, []string{"10.9.0.10"}) {
+		t.Errorf("store has hosts %v after the rollback, expected only 10.9.0.10", keys)
+	}
+	if h, _ := store.Get("10.9.0.10"); h.HostName != "sw1" {
+		t.Errorf("host 10.9.0.10 is %s after the rollback, expected sw1", h.HostName)
+	}
+	if p := store.Provisioning()["10.9.0.10"]; p.State != cache.Saved {
+		t.Errorf("host 10.9.0.10 is %s after the rollback, expected %s", p.State, cache.Saved)
+	}
+}
+
+func TestRollbackFailureKeepsRevisions(t *testing.T) {
+	db := &memDB{}
+	store, send, stop := savedTwice(t, db)
+	defer stop()
+	before := store.Snapshot()
+	gens := generations(t, send)
+
+	db.failGroups = true
+	resp := send(rt.Envelope{CRUD: rt.ROLLBACK, To: 1})
+	if resp.CRUD != rt.ERROR {
+		t.Fatalf("rollback succeeded although its groups couldn't be written")
+	}
+	if resp.Step != "persist" {
+		t.Errorf("rollback failed at step %q, expected persist", resp.Step)
+	}
+
+	// Revisions included, so ETags from before the rollback still match
+	if got := store.Snapshot(); !reflect.DeepEqual(got, before) {
+		t.Errorf("store holds %v after the failed rollback, expected %v", got, before)
+	}
+	if !reflect.DeepEqual(db.hosts, before) {
+		t.Errorf("database holds %v after the failed rollback, expected %v", db.hosts, before)
+	}
+	if got := generations(t, send); !reflect.DeepEqual(got, gens) {
+		t.Errorf("generations are %q after the failed rollback, expected %q", got, gens)
+	}
+}
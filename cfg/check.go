@@ -0,0 +1,272 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// Host names end up in dhcpd host declarations and in file names
+var hostNameRe = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_.-]*[A-Za-z0-9])?$`)
+
+// Where check commands say the trouble is: "dhcpd.conf line 12:" from dhcpd, "error at line 12 of" from dnsmasq
+// and "(kea-dhcp4.conf:12:5)" from Kea
+var lineRes = []*regexp.Regexp{
+	regexp.MustCompile(`\bline (\d+)\b`),
+	regexp.MustCompile(`:(\d+):\d+\)`),
+}
+
+// ProblemError is returned when checking the config, or a file generated from it, turns up problems
+type ProblemError struct {
+	Problems []rt.Problem
+}
+
+func (e *ProblemError) Error() string {
+	p := e.Problems[0]
+	msg := p.Message
+	// Problems with a line number are quoted from the check command, which names the file itself
+	if p.Host != "" {
+		msg = fmt.Sprintf("host %s: %s", p.Host, msg)
+	} else if p.File != "" && p.Line == 0 {
+		msg = fmt.Sprintf("%s: %s", p.File, msg)
+	}
+	if len(e.Problems) > 1 {
+		msg += fmt.Sprintf(" (and %d more)", len(e.Problems)-1)
+	}
+	return msg
+}
+
+// problemsOf returns the problems behind err, if it has any
+func problemsOf(err error) []rt.Problem {
+	if se, ok := err.(*SaveError); ok {
+		err = se.Err
+	}
+	if pe, ok := err.(*ProblemError); ok {
+		return pe.Problems
+	}
+	return nil
+}
+
+// CheckHosts looks for hosts that would break the DHCP server config or clash with each other.
+// Every problem found is returned, not just the first.
+func (c Cfg) CheckHosts() error {
+	problems := []rt.Problem{}
+	names := map[string]string{}
+	macs := map[string]string{}
+	duids := map[string]string{}
+	addrs6 := map[string]string{}
+
+	for _, k := range c.sortedHostKeys() {
+		h := c.Hosts[k].WithKey(k)
+
+		found := []string{}
+		add := func(format string, a ...interface{}) {
+			found = append(found, fmt.Sprintf(format, a...))
+		}
+		// seen reports a value another host already has
+		seen := func(what string, value string, m map[string]string) {
+			if other, ok := m[value]; ok {
+				add("%s %s is also used by host %s", what, value, other)
+				return
+			}
+			m[value] = k
+		}
+
+		if h.FixedIP != "" {
+			addr := net.ParseIP(h.FixedIP).To4()
+			if addr == nil {
+				add("%q is not an IPv4 address", h.FixedIP)
+			} else if s, err := c.ScopeFor(h.FixedIP); err != nil {
+				add("%s", err)
+			} else if msg := reservedIn(addr, s); msg != "" {
+				add("%s %s", h.FixedIP, msg)
+			}
+			if h.Ethernet == "" {
+				add("an IPv4 host needs an ethernet address")
+			}
+		}
+
+		if h.FixedIPv6 != "" {
+			if addr := net.ParseIP(h.FixedIPv6); addr == nil || addr.To4() != nil {
+				add("%q is not an IPv6 address", h.FixedIPv6)
+			} else if _, err := c.ScopeFor(h.FixedIPv6); err != nil {
+				add("%s", err)
+			} else if backend := strings.ToLower(c.Core.DHCPBackend); v4OnlyBackends[backend] {
+				add("%s is an IPv6 address, the %s backend only serves IPv4", h.FixedIPv6, backend)
+			} else {
+				seen("IPv6 address", addr.String(), addrs6)
+			}
+			if h.DUID == "" && h.Ethernet == "" {
+				add("an IPv6 host needs a DUID or an ethernet address")
+			}
+		}
+
+		if h.Ethernet != "" {
+			if mac, err := net.ParseMAC(h.Ethernet); err != nil {
+				add("ethernet address %q is invalid", h.Ethernet)
+			} else {
+				seen("ethernet address", mac.String(), macs)
+			}
+		}
+
+		if h.DUID != "" {
+			if duid, ok := normalDUID(h.DUID); !ok {
+				add("DUID %q is invalid, it should be hex octets separated by colons", h.DUID)
+			} else {
+				seen("DUID", duid, duids)
+			}
+		}
+
+		if h.HostName == "" {
+			add("no hostname")
+		} else if !hostNameRe.MatchString(h.HostName) {
+			add("hostname %q can only have letters, digits, '-', '_' and '.'", h.HostName)
+		} else {
+			seen("hostname", strings.ToLower(h.HostName), names)
+		}
+
+		if len(found) == 0 {
+			continue
+		}
+		// Show the host as the DHCP server would have got it, where there's enough of it to render
+		lines := c.hostLines(h)
+		for _, msg := range found {
+			problems = append(problems, rt.Problem{Host: k, Message: msg, Lines: lines})
+		}
+	}
+
+	if len(problems) > 0 {
+		return &ProblemError{Problems: problems}
+	}
+	return nil
+}
+
+// reservedIn returns why an IPv4 address can't be handed out as a fixed address in s, or "" if it can
+func reservedIn(addr net.IP, s ScopeCfg) string {
+	n, err := s.Network()
+	if err != nil {
+		return ""
+	}
+
+	broadcast := make(net.IP, len(n.IP))
+	for i := range n.IP {
+		broadcast[i] = n.IP[i] | ^n.Mask[i]
+	}
+
+	switch {
+	case addr.Equal(n.IP):
+		return fmt.Sprintf("is the network address of scope %q", s.Name)
+	case addr.Equal(broadcast):
+		return fmt.Sprintf("is the broadcast address of scope %q", s.Name)
+	case addr.Equal(net.ParseIP(s.SubnetRouter)):
+		return fmt.Sprintf("is the router of scope %q", s.Name)
+	}
+
+	low, high := net.ParseIP(s.NonCfgRangeLow).To4(), net.ParseIP(s.NonCfgRangeHigh).To4()
+	if low != nil && high != nil && bytes.Compare(addr, low) >= 0 && bytes.Compare(addr, high) <= 0 {
+		return fmt.Sprintf("is inside the dynamic range %s - %s of scope %q", low, high, s.Name)
+	}
+	return ""
+}
+
+// normalDUID returns a DUID in lower case, with each octet two digits long
+func normalDUID(duid string) (string, bool) {
+	octets := strings.Split(duid, ":")
+	for i, o := range octets {
+		b, err := strconv.ParseUint(o, 16, 8)
+		if err != nil {
+			return "", false
+		}
+		octets[i] = fmt.Sprintf("%02x", b)
+	}
+	return strings.Join(octets, ":"), true
+}
+
+// hostLines returns a host's entry as the DHCP backend renders it, or nil if it can't be rendered
+func (c Cfg) hostLines(h rt.Hosts) []string {
+	backend, err := c.Backend()
+	if err != nil {
+		return nil
+	}
+	s, err := backend.RenderHost(c, h)
+	if err != nil {
+		return nil
+	}
+
+	lines := []string{}
+	for _, l := range strings.Split(s, "\n") {
+		if strings.TrimSpace(l) != "" {
+			lines = append(lines, l)
+		}
+	}
+	return lines
+}
+
+// checkFile runs the check command of an artifact against its staged copy at tmp.
+// The command isn't run through a shell, {file} in it is replaced with the file to check and it's killed after timeout.
+func checkFile(a Artifact, tmp string, timeout time.Duration) error {
+	args := strings.Fields(a.Check)
+	if len(args) == 0 {
+		return nil
+	}
+	for i := range args {
+		args[i] = strings.Replace(args[i], "{file}", tmp, -1)
+	}
+
+	out, _, err := runCommand(args, timeout)
+	if err == nil {
+		return nil
+	}
+
+	// Nobody wants to see the name of the staged file
+	output := strings.Replace(out, tmp, a.Path, -1)
+	return &ProblemError{Problems: fileProblems(a, output, err)}
+}
+
+// fileProblems turns the output of a failed check command into problems, quoting the lines it complains about.
+// The line before is quoted too, as a missing semicolon is reported on the line after it.
+func fileProblems(a Artifact, output string, err error) []rt.Problem {
+	content := strings.Split(a.Content, "\n")
+	problems := []rt.Problem{}
+	reported := map[int]bool{}
+
+	for _, l := range strings.Split(output, "\n") {
+		for _, re := range lineRes {
+			m := re.FindStringSubmatch(l)
+			if m == nil {
+				continue
+			}
+			n, _ := strconv.Atoi(m[1])
+			if n < 1 || n > len(content) || reported[n] {
+				break
+			}
+			reported[n] = true
+
+			p := rt.Problem{File: a.Path, Line: n, Message: strings.TrimSpace(l)}
+			for i := n - 1; i <= n; i++ {
+				if i >= 1 {
+					p.Lines = append(p.Lines, fmt.Sprintf("%d: %s", i, content[i-1]))
+				}
+			}
+			problems = append(problems, p)
+			break
+		}
+	}
+
+	if len(problems) == 0 {
+		msg := strings.TrimSpace(output)
+		if msg == "" {
+			msg = err.Error()
+		}
+		problems = append(problems, rt.Problem{File: a.Path, Message: msg})
+	}
+	return problems
+}
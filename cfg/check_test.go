@@ -0,0 +1,263 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+func TestCheckHosts(t *testing.T) {
+	sw1 := rt.Hosts{FixedIP: "10.9.0.10", HostName: "sw1", Ethernet: "02:00:00:00:00:0a"}
+	tests := []struct {
+		name    string
+		backend string     // embedded if not set
+		hosts   []rt.Hosts // Added to sw1
+		want    []string   // "host: message" of each problem, in order
+	}{
+		{name: "fine"},
+		{
+			name:  "IPv6 only",
+			hosts: []rt.Hosts{{FixedIPv6: "2001:db8:9::10", HostName: "sw6", DUID: "00:01:00:01:aa:bb"}},
+		},
+		{
+			name:  "hostname with a space",
+			hosts: []rt.Hosts{{FixedIP: "10.9.0.11", HostName: "sw 2", Ethernet: "02:00:00:00:00:0b"}},
+			want:  []string{`10.9.0.11: hostname "sw 2" can only have letters, digits, '-', '_' and '.'`},
+		},
+		{
+			name:  "hostname ending in a dot",
+			hosts: []rt.Hosts{{FixedIP: "10.9.0.11", HostName: "sw2.", Ethernet: "02:00:00:00:00:0b"}},
+			want:  []string{`10.9.0.11: hostname "sw2." can only have letters, digits, '-', '_' and '.'`},
+		},
+		{
+			name:  "no hostname",
+			hosts: []rt.Hosts{{FixedIP: "10.9.0.11", Ethernet: "02:00:00:00:00:0b"}},
+			want:  []string{"10.9.0.11: no hostname"},
+		},
+		{
+			name:  "same hostname",
+			hosts: []rt.Hosts{{FixedIP: "10.9.0.11", HostName: "SW1", Ethernet: "02:00:00:00:00:0b"}},
+			want:  []string{"10.9.0.11: hostname sw1 is also used by host 10.9.0.10"},
+		},
+		{
+			name:  "outside every scope",
+			hosts: []rt.Hosts{{FixedIP: "10.8.0.11", HostName: "sw2", Ethernet: "02:00:00:00:00:0b"}},
+			want:  []string{"10.8.0.11: address 10.8.0.11 is not inside any configured scope"},
+		},
+		{
+			name:  "not IPv4",
+			hosts: []rt.Hosts{{FixedIP: "10.9.0.300", HostName: "sw2", Ethernet: "02:00:00:00:00:0b"}},
+			want:  []string{`10.9.0.300: "10.9.0.300" is not an IPv4 address`},
+		},
+		{
+			name:  "network address",
+			hosts: []rt.Hosts{{FixedIP: "10.9.0.0", HostName: "sw2", Ethernet: "02:00:00:00:00:0b"}},
+			want:  []string{`10.9.0.0: 10.9.0.0 is the network address of scope "lab"`},
+		},
+		{
+			name:  "broadcast address",
+			hosts: []rt.Hosts{{FixedIP: "10.9.0.255", HostName: "sw2", Ethernet: "02:00:00:00:00:0b"}},
+			want:  []string{`10.9.0.255: 10.9.0.255 is the broadcast address of scope "lab"`},
+		},
+		{
+			name:  "router",
+			hosts: []rt.Hosts{{FixedIP: "10.9.0.1", HostName: "sw2", Ethernet: "02:00:00:00:00:0b"}},
+			want:  []string{`10.9.0.1: 10.9.0.1 is the router of scope "lab"`},
+		},
+		{
+			name: "dynamic range",
+			hosts: []rt.Hosts{
+				{FixedIP: "10.9.0.100", HostName: "sw2", Ethernet: "02:00:00:00:00:0b"},
+				{FixedIP: "10.9.0.199", HostName: "sw3", Ethernet: "02:00:00:00:00:0c"},
+				{FixedIP: "10.9.0.200", HostName: "sw4", Ethernet: "02:00:00:00:00:0d"},
+			},
+			want: []string{
+				`10.9.0.100: 10.9.0.100 is inside the dynamic range 10.9.0.100 - 10.9.0.199 of scope "lab"`,
+				`10.9.0.199: 10.9.0.199 is inside the dynamic range 10.9.0.100 - 10.9.0.199 of scope "lab"`,
+			},
+		},
+		{
+			name:  "no ethernet address",
+			hosts: []rt.Hosts{{FixedIP: "10.9.0.11", HostName: "sw2"}},
+			want:  []string{"10.9.0.11: an IPv4 host needs an ethernet address"},
+		},
+		{
+			name:  "bad ethernet address",
+			hosts: []rt.Hosts{{FixedIP: "10.9.0.11", HostName: "sw2", Ethernet: "02:00:00"}},
+			want:  []string{`10.9.0.11: ethernet address "02:00:00" is invalid`},
+		},
+		{
+			name:  "same ethernet address written differently",
+			hosts: []rt.Hosts{{FixedIP: "10.9.0.11", HostName: "sw2", Ethernet: "02-00-00-00-00-0A"}},
+			want:  []string{"10.9.0.11: ethernet address 02:00:00:00:00:0a is also used by host 10.9.0.10"},
+		},
+		{
+			name: "same DUID written differently",
+			hosts: []rt.Hosts{
+				{FixedIPv6: "2001:db8:9::10", HostName: "sw6", DUID: "00:01:00:01:aa:bb"},
+				{FixedIPv6: "2001:db8:9::11", HostName: "sw7", DUID: "0:1:0:1:AA:BB"},
+			},
+			want: []string{"2001:db8:9::11: DUID 00:01:00:01:aa:bb is also used by host 2001:db8:9::10"},
+		},
+		{
+			name:  "bad DUID",
+			hosts: []rt.Hosts{{FixedIPv6: "2001:db8:9::10", HostName: "sw6", DUID: "00:01:zz"}},
+			want:  []string{`2001:db8:9::10: DUID "00:01:zz" is invalid, it should be hex octets separated by colons`},
+		},
+		{
+			name: "same IPv6 address written differently",
+			hosts: []rt.Hosts{
+				{FixedIP: "10.9.0.11", FixedIPv6: "2001:db8:9::10", HostName: "sw2", Ethernet: "02:00:00:00:00:0b"},
+				{FixedIPv6: "2001:db8:9:0:0::10", HostName: "sw6", DUID: "00:01:00:01:aa:bb"},
+			},
+			want: []string{"2001:db8:9:0:0::10: IPv6 address 2001:db8:9::10 is also used by host 10.9.0.11"},
+		},
+		{
+			name:  "IPv6 outside every scope",
+			hosts: []rt.Hosts{{FixedIPv6: "2001:db8:a::10", HostName: "sw6", DUID: "00:01:00:01:aa:bb"}},
+			want:  []string{"2001:db8:a::10: address 2001:db8:a::10 is not inside any configured scope"},
+		},
+		{
+			name:  "IPv6 without a DUID or ethernet address",
+			hosts: []rt.Hosts{{FixedIPv6: "2001:db8:9::10", HostName: "sw6"}},
+			want:  []string{"2001:db8:9::10: an IPv6 host needs a DUID or an ethernet address"},
+		},
+		{
+			name:    "IPv6 with dnsmasq",
+			backend: "dnsmasq",
+			hosts: []rt.Hosts{
+				{FixedIPv6: "2001:db8:9::10", HostName: "sw6", DUID: "00:01:00:01:aa:bb"},
+				{FixedIP: "10.9.0.11", FixedIPv6: "2001:db8:9::11", HostName: "sw2", Ethernet: "02:00:00:00:00:0b"},
+			},
+			want: []string{
+				"10.9.0.11: 2001:db8:9::11 is an IPv6 address, the dnsmasq backend only serves IPv4",
+				"2001:db8:9::10: 2001:db8:9::10 is an IPv6 address, the dnsmasq backend only serves IPv4",
+			},
+		},
+		{
+			name:  "everything at once",
+			hosts: []rt.Hosts{{FixedIP: "10.9.0.255", HostName: "sw1", Ethernet: "02:00:00:00:00:0a"}},
+			want: []string{
+				`10.9.0.255: 10.9.0.255 is the broadcast address of scope "lab"`,
+				"10.9.0.255: ethernet address 02:00:00:00:00:0a is also used by host 10.9.0.10",
+				"10.9.0.255: hostname sw1 is also used by host 10.9.0.10",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := labCfg()
+			c.Scopes[0].Subnet6 = "2001:db8:9::/64"
+			if tt.backend != "" {
+				c.Core.DHCPBackend = tt.backend
+			}
+			for _, h := range append([]rt.Hosts{sw1}, tt.hosts...) {
+				c.Hosts[h.Key()] = h
+			}
+
+			got := []string{}
+			for _, p := range problemsOf(c.CheckHosts()) {
+				got = append(got, p.Host+": "+p.Message)
+			}
+			if tt.want == nil {
+				tt.want = []string{}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("problems are\n%q\nexpected\n%q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFileProblems(t *testing.T) {
+	a := Artifact{Path: "/etc/dhcp/dhcpd.conf", Content: "subnet 10.9.0.0 netmask 255.255.255.0 {\n  option routers 10.9.0.1\n}"}
+	tests := []struct {
+		name   string
+		output string
+		want   []rt.Problem
+	}{
+		{
+			name:   "dhcpd",
+			output: "/etc/dhcp/dhcpd.conf line 3: semicolon expected.\n}\n^\nConfiguration file errors encountered -- exiting\n",
+			want: []rt.Problem{{
+				File: a.Path, Line: 3, Message: "/etc/dhcp/dhcpd.conf line 3: semicolon expected.",
+				Lines: []string{"2:   option routers 10.9.0.1", "3: }"},
+			}},
+		},
+		{
+			name:   "dnsmasq",
+			output: "dnsmasq: error at line 1 of /etc/dnsmasq.conf\n",
+			want: []rt.Problem{{
+				File: a.Path, Line: 1, Message: "dnsmasq: error at line 1 of /etc/dnsmasq.conf",
+				Lines: []string{"1: subnet 10.9.0.0 netmask 255.255.255.0 {"},
+			}},
+		},
+		{
+			name:   "kea",
+			output: "Syntax error: got unexpected keyword (kea-dhcp4.conf:2:3)\n",
+			want: []rt.Problem{{
+				File: a.Path, Line: 2, Message: "Syntax error: got unexpected keyword (kea-dhcp4.conf:2:3)",
+				Lines: []string{"1: subnet 10.9.0.0 netmask 255.255.255.0 {", "2:   option routers 10.9.0.1"},
+			}},
+		},
+		{
+			name:   "same line twice",
+			output: "line 2: one\nline 2: two\nline 9: past the end\n",
+			want: []rt.Problem{{
+				File: a.Path, Line: 2, Message: "line 2: one",
+				Lines: []string{"1: subnet 10.9.0.0 netmask 255.255.255.0 {", "2:   option routers 10.9.0.1"},
+			}},
+		},
+		{
+			name:   "no line",
+			output: "  something is wrong\n",
+			want:   []rt.Problem{{File: a.Path, Message: "something is wrong"}},
+		},
+		{
+			name: "no output",
+			want: []rt.Problem{{File: a.Path, Message: "exit status 1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := fileProblems(a, tt.output, errors.New("exit status 1"))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("problems are\n%+v\nexpected\n%+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	script := filepath.Join(dir, "check")
+	if err = ioutil.WriteFile(script, []byte("#!/bin/sh\necho \"$1 line 2: semicolon expected.\" >&2\nexit 1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	a := Artifact{Path: "/etc/dhcp/dhcpd.conf", Content: "a\nb\n", Check: script + " {file}"}
+	want := []rt.Problem{{
+		File: a.Path, Line: 2, Message: "/etc/dhcp/dhcpd.conf line 2: semicolon expected.",
+		Lines: []string{"1: a", "2: b"},
+	}}
+	if got := problemsOf(checkFile(a, filepath.Join(dir, "dhcpd.conf.new"), 5*time.Second)); !reflect.DeepEqual(got, want) {
+		t.Errorf("problems are %+v, expected %+v", got, want)
+	}
+
+	a.Check = "true {file}"
+	if err = checkFile(a, filepath.Join(dir, "dhcpd.conf.new"), 5*time.Second); err != nil {
+		t.Errorf("a check that passes returned %s", err)
+	}
+}
@@ -0,0 +1,184 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// Juniper's IANA enterprise number, used for the DHCPv6 vendor-specific information option (17)
+const junosEnterprise = 2636
+
+const dhcpd6tmpl = `# /etc/dhcp/dhcpd6.conf
+# dhcpd6.conf
+#
+# Generated: by "EZJunosZTP" Tool
+
+# The ddns-updates-style parameter controls
+ddns-update-style none;
+
+# If this DHCP server is the official DHCP server for the local
+# network, the authoritative directive should be uncommented.
+authoritative;
+
+# Use this to send dhcp log messages to a different log file (you also
+# have to hack syslog.conf to complete the redirection).
+log-facility local7;
+
+# Junos ZTP options, carried as vendor-specific information (option 17)
+option space ezjunosztp6 code width 2 length width 2;
+option ezjunosztp6.image-file-name code 0 = text;
+option ezjunosztp6.config-file-name code 1 = text;
+option ezjunosztp6.image-file-type code 2 = text;
+option ezjunosztp6.transfer-mode code 3 = text;
+option vsio.ezjunosztp6 code %v = encapsulate ezjunosztp6;
+`
+
+const subnet6tmpl = `# Subnet definition: %s
+subnet6 %s {
+`
+
+const host6tmpl = `		# Host definition
+		host %s.%s {
+			%s;
+			fixed-address6 %s;
+`
+
+// HasV6 returns true if any scope has an IPv6 subnet
+func (c Cfg) HasV6() bool {
+	for _, s := range c.AllScopes() {
+		if s.IsV6() {
+			return true
+		}
+	}
+	return false
+}
+
+// HostURLs returns the full URLs of a host's config file and image on the file server
+func (c Cfg) HostURLs(h rt.Hosts, server string) (cfgurl string, imageurl string) {
+	if ip := net.ParseIP(server); ip != nil && ip.To4() == nil {
+		server = "[" + server + "]"
+	}
+	cfgfile, image := c.HostFiles(h)
+	cfgurl = fmt.Sprintf("http://%s/%s", server, cfgfile)
+	if image != "" {
+		imageurl = fmt.Sprintf("http://%s/%s", server, image)
+	}
+	return cfgurl, imageurl
+}
+
+// fileServer6 returns the address IPv6 clients in the scope fetch files from
+func (c Cfg) fileServer6(s ScopeCfg) string {
+	if s.FileServer6 != "" {
+		return s.FileServer6
+	}
+	return c.Core.ServerURL
+}
+
+// onlyV4 filters a list of addresses down to the IPv4 ones
+func onlyV4(addrs []string) []string {
+	rtn := []string{}
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip == nil || ip.To4() != nil {
+			rtn = append(rtn, a)
+		}
+	}
+	return rtn
+}
+
+// onlyV6 filters a list of addresses down to the IPv6 ones
+func onlyV6(addrs []string) []string {
+	rtn := []string{}
+	for _, a := range addrs {
+		if ip := net.ParseIP(a); ip != nil && ip.To4() == nil {
+			rtn = append(rtn, a)
+		}
+	}
+	return rtn
+}
+
+// CreateDHCPd6 returns the dhcpd6.conf for the IPv6 scopes and hosts
+func (c Cfg) CreateDHCPd6() (string, error) {
+	buf := new(bytes.Buffer)
+	buf.Write([]byte(fmt.Sprintf(dhcpd6tmpl, junosEnterprise)))
+	buf.Write([]byte("\n"))
+
+	tcore := reflect.TypeOf(c.Core)
+
+	buf.Write([]byte(fmt.Sprintf("option dhcp6.domain-search \"%s\";\n", c.Core.DomainName)))
+	if dns := onlyV6(c.Core.DNSServers); len(dns) > 0 {
+		buf.Write([]byte(fmt.Sprintf("option dhcp6.name-servers %s;\n", strings.Join(dns, ", "))))
+	}
+
+	field, _ := tcore.FieldByName("DefaultLease")
+	buf.Write([]byte(field.Tag.Get("dhcpd")))
+	buf.Write([]byte(fmt.Sprintf("%v;\n", c.Core.DefaultLease)))
+
+	field, _ = tcore.FieldByName("MaxLease")
+	buf.Write([]byte(field.Tag.Get("dhcpd")))
+	buf.Write([]byte(fmt.Sprintf("%v;\n", c.Core.MaxLease)))
+
+	for _, s := range c.AllScopes() {
+		if !s.IsV6() {
+			continue
+		}
+		n, err := s.Network6()
+		if err != nil {
+			return "", err
+		}
+
+		buf.Write([]byte("\n"))
+		buf.Write([]byte(fmt.Sprintf(subnet6tmpl, s.Name, n.String())))
+		if s.NonCfgRange6Low != "" && s.NonCfgRange6High != "" {
+			buf.Write([]byte(fmt.Sprintf("\trange6 %s %s;\n", s.NonCfgRange6Low, s.NonCfgRange6High)))
+		}
+		if dns := onlyV6(s.DNSServers); len(dns) > 0 && !reflect.DeepEqual(dns, onlyV6(c.Core.DNSServers)) {
+			buf.Write([]byte(fmt.Sprintf("\toption dhcp6.name-servers %s;\n", strings.Join(dns, ", "))))
+		}
+
+		buf.Write([]byte("\n\tgroup {\n"))
+		buf.Write([]byte(fmt.Sprintf("\t\toption ezjunosztp6.transfer-mode \"%s\";\n", c.Core.TransferMode)))
+
+		for _, h := range c.Hosts6In(s) {
+			buf.Write(c.MakeHost6(h, c.fileServer6(s)).Bytes())
+		}
+
+		buf.Write([]byte("\t}\n"))
+		buf.Write([]byte("}\n"))
+	}
+
+	return buf.String(), nil
+}
+
+// MakeHost6 returns a DHCPv6 host string. Hosts are matched on DUID if they have one, otherwise on ethernet address.
+func (c Cfg) MakeHost6(h rt.Hosts, server string) *bytes.Buffer {
+	buf := new(bytes.Buffer)
+	buf.Write([]byte("\n"))
+
+	thost := reflect.TypeOf(h)
+
+	ident := ""
+	if h.DUID != "" {
+		field, _ := thost.FieldByName("DUID")
+		ident = field.Tag.Get("dhcpd") + h.DUID
+	} else {
+		field, _ := thost.FieldByName("Ethernet")
+		ident = field.Tag.Get("dhcpd") + h.Ethernet
+	}
+
+	buf.Write([]byte(fmt.Sprintf(host6tmpl, h.HostName, c.Core.DomainName, ident, h.FixedIPv6)))
+
+	cfgurl, imageurl := c.HostURLs(h, server)
+	buf.Write([]byte(fmt.Sprintf("\t\t\toption ezjunosztp6.config-file-name \"%s\";\n", cfgurl)))
+	if imageurl != "" {
+		buf.Write([]byte(fmt.Sprintf("\t\t\toption ezjunosztp6.image-file-name \"%s\";\n", imageurl)))
+	}
+	buf.Write([]byte("\t\t}\n"))
+	return buf
+}
@@ -0,0 +1,139 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+	"github.com/networkbootstrap/ztpmanagercode/templategen"
+)
+
+const dnsmasqtmpl = `# %s
+# dnsmasq configuration
+#
+# Generated: by "EZJunosZTP" Tool
+
+interface=%s
+domain=%s
+dhcp-authoritative
+
+# Hosts and options live in their own files, so a reload (SIGHUP) picks up changes
+dhcp-hostsfile=%s
+dhcp-optsfile=%s
+`
+
+// DnsmasqBackend drives dnsmasq, which suits small labs better than a full ISC or Kea install.
+// The scopes go in the main configuration file. Reservations go in a dhcp-hostsfile and options
+// in a dhcp-optsfile, both of which dnsmasq re-reads on a reload.
+type DnsmasqBackend struct{}
+
+// Name returns the name of the backend
+func (b DnsmasqBackend) Name() string {
+	return "dnsmasq"
+}
+
+// Render returns the dnsmasq configuration, hosts and options files
+func (b DnsmasqBackend) Render(c Cfg) ([]Artifact, error) {
+	if c.Core.DnsmasqPath == "" || c.Core.DnsmasqHostsPath == "" || c.Core.DnsmasqOptsPath == "" {
+		return nil, fmt.Errorf("dnsmasq backend requires DnsmasqPath, DnsmasqHostsPath and DnsmasqOptsPath in [Core]")
+	}
+
+	conf, hosts, opts, err := c.CreateDnsmasq()
+	if err != nil {
+		return nil, err
+	}
+
+	return []Artifact{
+		{Path: c.Core.DnsmasqPath, Content: conf, Check: c.Core.DHCPCheckCommand},
+		{Path: c.Core.DnsmasqHostsPath, Content: hosts},
+		{Path: c.Core.DnsmasqOptsPath, Content: opts},
+	}, nil
+}
+
+// ReloadCommands asks dnsmasq to re-read the hosts and options files
+func (b DnsmasqBackend) ReloadCommands() []string {
+	return []string{"systemctl reload dnsmasq"}
+}
+
+// CreateDnsmasq returns the main configuration, dhcp-hostsfile and dhcp-optsfile contents for dnsmasq
+func (c Cfg) CreateDnsmasq() (conf string, hosts string, opts string, err error) {
+	confBuf := new(bytes.Buffer)
+	hostsBuf := new(bytes.Buffer)
+	optsBuf := new(bytes.Buffer)
+
+	confBuf.Write([]byte(fmt.Sprintf(dnsmasqtmpl, c.Core.DnsmasqPath, c.Core.DHCPIface, c.Core.DomainName, c.Core.DnsmasqHostsPath, c.Core.DnsmasqOptsPath)))
+	hostsBuf.Write([]byte(fmt.Sprintf("# %s\n# Generated: by \"EZJunosZTP\" Tool\n", c.Core.DnsmasqHostsPath)))
+	optsBuf.Write([]byte(fmt.Sprintf("# %s\n# Generated: by \"EZJunosZTP\" Tool\n", c.Core.DnsmasqOptsPath)))
+
+	for _, s := range c.AllScopes() {
+		if !s.IsV4() {
+			continue
+		}
+		tag := "scope-" + s.Name
+
+		confBuf.Write([]byte(fmt.Sprintf("\n# Subnet definition: %s\n", s.Name)))
+		if s.NonCfgRangeLow != "" && s.NonCfgRangeHigh != "" {
+			confBuf.Write([]byte(fmt.Sprintf("dhcp-range=set:%s,%s,%s,%s,%v\n", tag, s.NonCfgRangeLow, s.NonCfgRangeHigh, s.SubnetMask, c.Core.DefaultLease)))
+		} else {
+			// Reservations only, no dynamic pool
+			confBuf.Write([]byte(fmt.Sprintf("dhcp-range=set:%s,%s,static,%s,%v\n", tag, s.Subnet, s.SubnetMask, c.Core.DefaultLease)))
+		}
+
+		optsBuf.Write([]byte(fmt.Sprintf("\n# Scope: %s\n", s.Name)))
+		if s.SubnetRouter != "" {
+			optsBuf.Write([]byte(fmt.Sprintf("tag:%s,option:router,%s\n", tag, s.SubnetRouter)))
+		}
+		optsBuf.Write([]byte(fmt.Sprintf("tag:%s,option:dns-server,%s\n", tag, strings.Join(onlyV4(s.DNSServers), ","))))
+		optsBuf.Write([]byte(fmt.Sprintf("tag:%s,option:ntp-server,%s\n", tag, strings.Join(onlyV4(s.NTPServers), ","))))
+		// Junos ZTP options: 150 file server and option 43 sub-option 3 transfer mode
+		optsBuf.Write([]byte(fmt.Sprintf("tag:%s,150,%s\n", tag, s.FileServer)))
+		optsBuf.Write([]byte(fmt.Sprintf("tag:%s,encap:43,3,\"%s\"\n", tag, c.Core.TransferMode)))
+
+		for _, h := range c.HostsIn(s) {
+			host, opts := c.dnsmasqHost(h, s)
+			hostsBuf.Write([]byte(host))
+			optsBuf.Write([]byte(opts))
+		}
+	}
+
+	return confBuf.String(), hostsBuf.String(), optsBuf.String(), nil
+}
+
+// RenderHost returns the host's lines from the dhcp-hostsfile and dhcp-optsfile
+func (b DnsmasqBackend) RenderHost(c Cfg, h rt.Hosts) (string, error) {
+	if h.FixedIP == "" {
+		return "", fmt.Errorf("dnsmasq backend only serves IPv4, host %s has no IPv4 address", h.Key())
+	}
+	scope, err := c.ScopeFor(h.FixedIP)
+	if err != nil {
+		return "", err
+	}
+
+	host, opts := c.dnsmasqHost(h, scope)
+	return fmt.Sprintf("# %s\n%s# %s\n%s", c.Core.DnsmasqHostsPath, host, c.Core.DnsmasqOptsPath, opts), nil
+}
+
+// dnsmasqHost returns the dhcp-hostsfile line and dhcp-optsfile lines for a host in scope s
+func (c Cfg) dnsmasqHost(h rt.Hosts, s ScopeCfg) (host string, opts string) {
+	hostTag := "host-" + h.HostName
+	host = fmt.Sprintf("%s,set:%s,%s,%s\n", h.Ethernet, hostTag, h.FixedIP, h.HostName)
+	for _, o := range c.HostOptions(h, s) {
+		opts += fmt.Sprintf("tag:%s,%s\n", hostTag, dnsmasqOption(o))
+	}
+	return host, opts
+}
+
+// dnsmasqOption returns a vendor option in dhcp-optsfile form, without the tag
+func dnsmasqOption(o templategen.DHCPOption) string {
+	value := o.Value
+	if o.Type != "ip-address" {
+		value = fmt.Sprintf("\"%s\"", o.Value)
+	}
+	if o.Encap {
+		return fmt.Sprintf("encap:43,%v,%s", o.Code, value)
+	}
+	return fmt.Sprintf("%v,%s", o.Code, value)
+}
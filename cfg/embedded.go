@@ -0,0 +1,57 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// EmbeddedBackend is used when the built-in DHCPv4 server (package dhcpserver) answers requests.
+// It reads hosts straight from the cache, so there are no files to write and nothing to reload.
+type EmbeddedBackend struct{}
+
+// Name returns the name of the backend
+func (b EmbeddedBackend) Name() string {
+	return "embedded"
+}
+
+// Render returns no files, the embedded server has nothing to read
+func (b EmbeddedBackend) Render(c Cfg) ([]Artifact, error) {
+	return []Artifact{}, nil
+}
+
+// RenderHost describes what the embedded server hands the host, since there is no file to show
+func (b EmbeddedBackend) RenderHost(c Cfg, h rt.Hosts) (string, error) {
+	if h.FixedIP == "" {
+		return "", errors.New("embedded DHCP server only serves IPv4, host has no IPv4 address")
+	}
+	scope, err := c.ScopeFor(h.FixedIP)
+	if err != nil {
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+	buf.Write([]byte(fmt.Sprintf("# Embedded DHCP server, scope %s\n", scope.Name)))
+	buf.Write([]byte(fmt.Sprintf("ethernet %s\n", h.Ethernet)))
+	buf.Write([]byte(fmt.Sprintf("address %s\n", h.FixedIP)))
+	buf.Write([]byte(fmt.Sprintf("option 12 (host-name) %q\n", h.HostName)))
+	buf.Write([]byte(fmt.Sprintf("option 150 (file server) %s\n", scope.FileServer)))
+	buf.Write([]byte(fmt.Sprintf("option 43 sub-option 3 (transfer mode) %q\n", c.Core.TransferMode)))
+	for _, o := range c.HostOptions(h, scope) {
+		if o.Encap {
+			buf.Write([]byte(fmt.Sprintf("option 43 sub-option %v %q\n", o.Code, o.Value)))
+		} else {
+			buf.Write([]byte(fmt.Sprintf("option %v %q\n", o.Code, o.Value)))
+		}
+	}
+	return buf.String(), nil
+}
+
+// ReloadCommands returns nothing, host changes are picked up on the next DHCP exchange
+func (b EmbeddedBackend) ReloadCommands() []string {
+	return nil
+}
@@ -0,0 +1,189 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// Commits made by a save are signed off as this. The author is whoever asked for the save.
+const (
+	gitCommitterName  = "ZTPManager"
+	gitCommitterEmail = "ztpmanager@localhost"
+)
+
+// Field and record separators for parsing git log
+const (
+	gitFieldSep  = "\x1f"
+	gitRecordSep = "\x1e"
+)
+
+// GitEnabled returns true if saves are committed to a git repository
+func (c Cfg) GitEnabled() bool {
+	return c.Core.GitRepository != ""
+}
+
+// git runs a git command in the repository and returns what it printed
+func (c Cfg) git(args ...string) (string, error) {
+	cmd := append([]string{"git", "-C", c.Core.GitRepository,
+		"-c", "user.name=" + gitCommitterName, "-c", "user.email=" + gitCommitterEmail}, args...)
+	out, _, err := runCommand(cmd, c.HookTimeout())
+	if err != nil {
+		return out, fmt.Errorf("git %s: %s: %s", args[0], err, strings.TrimSpace(out))
+	}
+	return out, nil
+}
+
+// CommitSave commits the config file and the configs directory with message, and returns the commit.
+// The repository is created the first time round. If nothing changed, nothing is committed and "" is returned.
+func (c Cfg) CommitSave(cfgfile string, author string, message string) (string, error) {
+	if _, err := c.git("rev-parse", "--git-dir"); err != nil {
+		if _, err = c.git("init", "-q"); err != nil {
+			return "", err
+		}
+	}
+
+	// Only what lives inside the repository can go in it. The DHCP server files usually don't.
+	paths := []string{}
+	for _, p := range []string{cfgfile, c.Core.FileConfigsLocation} {
+		if rel, ok := c.inRepository(p); ok {
+			paths = append(paths, rel)
+		}
+	}
+	if len(paths) == 0 {
+		return "", fmt.Errorf("neither %s nor %s is inside the git repository %s", cfgfile, c.Core.FileConfigsLocation, c.Core.GitRepository)
+	}
+
+	if _, err := c.git(append([]string{"add", "-A", "--"}, paths...)...); err != nil {
+		return "", err
+	}
+	// Exits 0 if there's nothing staged
+	if _, err := c.git("diff", "--cached", "--quiet"); err == nil {
+		return "", nil
+	}
+
+	if author == "" {
+		author = "unknown"
+	}
+	if _, err := c.git("commit", "-q", "--author", fmt.Sprintf("%s <%s@ztpmanager>", author, author), "-m", message); err != nil {
+		return "", err
+	}
+	out, err := c.git("rev-parse", "HEAD")
+	return strings.TrimSpace(out), err
+}
+
+// inRepository returns p relative to the repository, if it's inside it
+func (c Cfg) inRepository(p string) (string, bool) {
+	repo, err := filepath.Abs(c.Core.GitRepository)
+	if err != nil {
+		return "", false
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(repo, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return rel, true
+}
+
+// GitLog returns the latest n commits, newest first
+func (c Cfg) GitLog(n int) ([]rt.Commit, error) {
+	out, err := c.git("log", fmt.Sprintf("-n%d", n), "--format="+strings.Join([]string{"%H", "%an", "%aI", "%B"}, gitFieldSep)+gitRecordSep)
+	if err != nil {
+		// A repository with no commits yet has no log
+		if _, head := c.git("rev-parse", "--verify", "-q", "HEAD"); head != nil {
+			return []rt.Commit{}, nil
+		}
+		return nil, err
+	}
+
+	commits := []rt.Commit{}
+	for _, rec := range strings.Split(out, gitRecordSep) {
+		fields := strings.SplitN(strings.TrimLeft(rec, "\n"), gitFieldSep, 4)
+		if len(fields) != 4 {
+			continue
+		}
+		t, _ := time.Parse(time.RFC3339, fields[2])
+		commits = append(commits, rt.Commit{
+			Commit:  fields[0],
+			Author:  fields[1],
+			Time:    t,
+			Message: strings.TrimSpace(fields[3]),
+		})
+	}
+	return commits, nil
+}
+
+// commitMessage names the user and the hosts a save touched. what says what kind of save it was.
+func commitMessage(what string, author string, generation int, before map[string]rt.Hosts, after map[string]rt.Hosts) string {
+	touched := touchedHosts(before, after)
+
+	summary := "no hosts touched"
+	if len(touched) > 3 {
+		summary = fmt.Sprintf("%d hosts touched", len(touched))
+	} else if len(touched) > 0 {
+		names := []string{}
+		for _, t := range touched {
+			names = append(names, t[0]+" "+t[1])
+		}
+		summary = strings.Join(names, ", ")
+	}
+	if author == "" {
+		author = "unknown"
+	}
+
+	msg := fmt.Sprintf("%s by %s: %s\n", what, author, summary)
+	if generation != 0 {
+		msg += fmt.Sprintf("\nGeneration %d\n", generation)
+	}
+	if len(touched) > 0 {
+		msg += "\n"
+		for _, t := range touched {
+			msg += fmt.Sprintf("%s %s %s\n", t[0], t[1], t[2])
+		}
+	}
+	return msg
+}
+
+// touchedHosts returns what happened to each host that differs between before and after, as
+// "added", "changed" or "removed" followed by the hostname and address. It's in address order.
+func touchedHosts(before map[string]rt.Hosts, after map[string]rt.Hosts) [][3]string {
+	all := map[string]rt.Hosts{}
+	for k, h := range before {
+		all[k] = h
+	}
+	for k, h := range after {
+		all[k] = h
+	}
+
+	touched := [][3]string{}
+	for _, k := range (Cfg{Hosts: all}).sortedHostKeys() {
+		b, inBefore := before[k]
+		a, inAfter := after[k]
+		switch {
+		case !inBefore:
+			touched = append(touched, [3]string{"added", a.HostName, k})
+		case !inAfter:
+			touched = append(touched, [3]string{"removed", b.HostName, k})
+		case !sameHost(a, b):
+			touched = append(touched, [3]string{"changed", a.HostName, k})
+		}
+	}
+	return touched
+}
+
+// sameHost compares two hosts, leaving out the fields a save fills in
+func sameHost(a rt.Hosts, b rt.Hosts) bool {
+	a.CfgFile, b.CfgFile = "", ""
+	a.Revision, b.Revision = 0, 0
+	return reflect.DeepEqual(a, b)
+}
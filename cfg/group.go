@@ -0,0 +1,121 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+
+	"github.com/networkbootstrap/ztpmanagercode/cache"
+	"github.com/networkbootstrap/ztpmanagercode/events"
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// GroupCfg holds the template variables shared by the hosts in a named group
+type GroupCfg struct {
+	Vars rt.Vars `json:"vars"`
+}
+
+// HostVars returns the template variables for a host. The [Core] variables come first, then those of
+// each group in the order the host lists them, then the host's own. Later values win.
+func (c Cfg) HostVars(h rt.Hosts) rt.Vars {
+	vars := rt.Vars{}
+	for k, v := range c.Core.Vars {
+		vars[k] = v
+	}
+	for _, g := range h.Groups {
+		for k, v := range c.Groups[g].Vars {
+			vars[k] = v
+		}
+	}
+	for k, v := range h.Vars {
+		vars[k] = v
+	}
+	return vars
+}
+
+// CheckGroups makes sure every group a host is in exists
+func (c Cfg) CheckGroups() error {
+	for _, k := range c.sortedHostKeys() {
+		for _, g := range c.Hosts[k].Groups {
+			if _, ok := c.Groups[g]; !ok {
+				return fmt.Errorf("host %s is in unknown group %q", k, g)
+			}
+		}
+	}
+	return nil
+}
+
+// LoadGroups takes the groups kept in the host database over the ones in the config file, as is done with the hosts.
+// The first time round, the config file's groups are written to it. seeded is true if they were.
+func (c *Cfg) LoadGroups(store *cache.Store) (seeded bool, err error) {
+	kept, ok, err := store.LoadGroups()
+	if err != nil {
+		return false, err
+	}
+	if !ok {
+		return true, store.ReplaceGroups(groupVars(c.Groups))
+	}
+	c.Groups = make(map[string]GroupCfg, len(kept))
+	for k, vars := range kept {
+		c.Groups[k] = GroupCfg{Vars: vars}
+	}
+	return false, nil
+}
+
+// replaceGroups swaps every group for groups, in the host database too. An event is published for each group
+// that isn't the same as it was.
+func (c *Cfg) replaceGroups(store *cache.Store, bus *events.Broker, groups map[string]GroupCfg) error {
+	if err := store.ReplaceGroups(groupVars(groups)); err != nil {
+		return err
+	}
+	old := Cfg{Groups: c.Groups}
+	c.Groups = groups
+
+	for _, name := range old.GroupNames() {
+		if _, ok := groups[name]; !ok {
+			bus.Publish(events.GroupEvent(name, nil))
+		}
+	}
+	for _, name := range c.GroupNames() {
+		if g, ok := old.Groups[name]; !ok || !reflect.DeepEqual(g, groups[name]) {
+			vars := groups[name].Vars
+			bus.Publish(events.GroupEvent(name, &vars))
+		}
+	}
+	return nil
+}
+
+// groupVars returns the vars of each of groups, as the host database keeps them
+func groupVars(groups map[string]GroupCfg) map[string]rt.Vars {
+	vars := make(map[string]rt.Vars, len(groups))
+	for k, g := range groups {
+		vars[k] = g.Vars
+	}
+	return vars
+}
+
+// GroupNames returns the names of the groups in alphabetical order
+func (c Cfg) GroupNames() []string {
+	names := []string{}
+	for k := range c.Groups {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// groupMembers returns the keys of the hosts in group g
+func (c Cfg) groupMembers(g string) []string {
+	members := []string{}
+	for _, k := range c.sortedHostKeys() {
+		for _, hg := range c.Hosts[k].Groups {
+			if hg == g {
+				members = append(members, k)
+				break
+			}
+		}
+	}
+	return members
+}
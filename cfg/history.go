@@ -0,0 +1,186 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/networkbootstrap/ztpmanagercode/diff"
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// Generation is a successful save, with a copy of every file it wrote
+type Generation struct {
+	rt.Generation
+	ConfigFile string            `json:"configfile"` // Which of the files is config.toml
+	Files      map[string]string `json:"files"`
+}
+
+// HistoryDir returns the directory generations are kept in
+func (c Cfg) HistoryDir() string {
+	if c.Core.HistoryLocation == "" {
+		return "./history"
+	}
+	return c.Core.HistoryLocation
+}
+
+// generationFile returns where generation n is kept
+func (c Cfg) generationFile(n int) string {
+	return filepath.Join(c.HistoryDir(), fmt.Sprintf("%d.json", n))
+}
+
+// generationNumbers returns the numbers of the kept generations, oldest first
+func (c Cfg) generationNumbers() ([]int, error) {
+	files, err := ioutil.ReadDir(c.HistoryDir())
+	if os.IsNotExist(err) {
+		return []int{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	numbers := []int{}
+	for _, f := range files {
+		n, err := strconv.Atoi(strings.TrimSuffix(f.Name(), ".json"))
+		if err != nil || !strings.HasSuffix(f.Name(), ".json") {
+			continue
+		}
+		numbers = append(numbers, n)
+	}
+	sort.Ints(numbers)
+	return numbers, nil
+}
+
+// KeepGeneration stores what a save wrote as the next generation and returns its number.
+// If HistoryKeep is set, the oldest generations beyond it are dropped.
+func (c Cfg) KeepGeneration(p Plan, cfgfile string, author string, note string) (int, error) {
+	numbers, err := c.generationNumbers()
+	if err != nil {
+		return 0, err
+	}
+	if err = os.MkdirAll(c.HistoryDir(), 0755); err != nil {
+		return 0, err
+	}
+
+	g := Generation{ConfigFile: cfgfile, Files: map[string]string{}}
+	g.Number = 1
+	if len(numbers) > 0 {
+		g.Number = numbers[len(numbers)-1] + 1
+	}
+	g.Time = time.Now()
+	g.Author = author
+	g.Note = note
+	for _, a := range p.Writes {
+		g.Files[a.Path] = a.Content
+	}
+
+	b, err := json.MarshalIndent(g, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	if err = WriteArtifact(Artifact{Path: c.generationFile(g.Number), Content: string(b)}); err != nil {
+		return 0, err
+	}
+
+	numbers = append(numbers, g.Number)
+	if keep := c.Core.HistoryKeep; keep > 0 && len(numbers) > keep {
+		for _, n := range numbers[:len(numbers)-keep] {
+			os.Remove(c.generationFile(n))
+		}
+	}
+	return g.Number, nil
+}
+
+// LoadGeneration reads generation n
+func (c Cfg) LoadGeneration(n int) (Generation, error) {
+	g := Generation{}
+	b, err := ioutil.ReadFile(c.generationFile(n))
+	if os.IsNotExist(err) {
+		return g, fmt.Errorf("no generation %d", n)
+	}
+	if err != nil {
+		return g, err
+	}
+	if err = json.Unmarshal(b, &g); err != nil {
+		return g, fmt.Errorf("generation %d: %s", n, err)
+	}
+	return g, nil
+}
+
+// Generations returns the kept generations, oldest first, without their files
+func (c Cfg) Generations() ([]rt.Generation, error) {
+	numbers, err := c.generationNumbers()
+	if err != nil {
+		return nil, err
+	}
+
+	gens := []rt.Generation{}
+	for _, n := range numbers {
+		g, err := c.LoadGeneration(n)
+		if err != nil {
+			return nil, err
+		}
+		gens = append(gens, g.Generation)
+	}
+	return gens, nil
+}
+
+// DiffGenerations diffs every file of generation from against generation to.
+// Files only in from are deletes, files only in to are creates.
+func (c Cfg) DiffGenerations(from int, to int) ([]rt.FileChange, error) {
+	a, err := c.LoadGeneration(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := c.LoadGeneration(to)
+	if err != nil {
+		return nil, err
+	}
+
+	paths := []string{}
+	for k := range a.Files {
+		paths = append(paths, k)
+	}
+	for k := range b.Files {
+		if _, ok := a.Files[k]; !ok {
+			paths = append(paths, k)
+		}
+	}
+	sort.Strings(paths)
+
+	changes := []rt.FileChange{}
+	for _, p := range paths {
+		old, inA := a.Files[p]
+		cur, inB := b.Files[p]
+		switch {
+		case !inA:
+			changes = append(changes, rt.FileChange{Path: p, Action: "create", Diff: diff.Unified("/dev/null", p, "", cur, 3)})
+		case !inB:
+			changes = append(changes, rt.FileChange{Path: p, Action: "delete", Diff: diff.Unified(p, "/dev/null", old, "", 3)})
+		case old != cur:
+			changes = append(changes, rt.FileChange{Path: p, Action: "modify", Diff: diff.Unified(p, p, old, cur, 3)})
+		}
+	}
+	return changes, nil
+}
+
+// Config returns the hosts and groups as they were in the generation's config.toml
+func (g Generation) Config() (Cfg, error) {
+	content, ok := g.Files[g.ConfigFile]
+	if !ok {
+		return NewCfg(), fmt.Errorf("generation %d has no copy of %s", g.Number, g.ConfigFile)
+	}
+	snap, err := ParseString(content)
+	if err != nil {
+		return snap, fmt.Errorf("generation %d: %s", g.Number, err)
+	}
+	return snap, nil
+}
@@ -0,0 +1,102 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// defaultHookTimeout is how long a hook gets if HookTimeout isn't set in [Core]
+const defaultHookTimeout = 30 * time.Second
+
+// HookTimeout returns how long a hook command may run before it's killed
+func (c Cfg) HookTimeout() time.Duration {
+	if c.Core.HookTimeout <= 0 {
+		return defaultHookTimeout
+	}
+	return time.Duration(c.Core.HookTimeout) * time.Second
+}
+
+// ReloadCommands returns the commands that reload the DHCP server. ReloadCommand in [Core] wins over the backend's own.
+func (c Cfg) ReloadCommands(b DHCPBackend) []string {
+	if c.Core.ReloadCommand != "" {
+		return []string{c.Core.ReloadCommand}
+	}
+	return b.ReloadCommands()
+}
+
+// Hooks runs hook commands for a save, and keeps what each one did
+type Hooks struct {
+	Timeout time.Duration
+	Results []rt.HookResult
+}
+
+// Run runs the commands of a hook in order, stopping at the first one that fails.
+// Nothing is run for an empty command.
+func (h *Hooks) Run(hook string, commands ...string) error {
+	for _, command := range commands {
+		if strings.TrimSpace(command) == "" {
+			continue
+		}
+
+		start := time.Now()
+		output, code, err := runCommand(strings.Fields(command), h.Timeout)
+		r := rt.HookResult{
+			Hook:     hook,
+			Command:  command,
+			ExitCode: code,
+			Output:   output,
+			Duration: time.Since(start).Round(time.Millisecond).String(),
+		}
+		if err != nil {
+			r.Error = err.Error()
+		}
+		h.Results = append(h.Results, r)
+
+		if err != nil {
+			fmt.Printf("Hook %s: %q failed after %s: %s\n", hook, command, r.Duration, err)
+		} else {
+			fmt.Printf("Hook %s: %q exited 0 after %s\n", hook, command, r.Duration)
+		}
+		if output != "" {
+			fmt.Print(output)
+			if !strings.HasSuffix(output, "\n") {
+				fmt.Print("\n")
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("%q: %s", command, err)
+		}
+	}
+	return nil
+}
+
+// runCommand runs args directly, without a shell, and returns its combined output and exit code.
+// It's killed if it runs for longer than timeout.
+func runCommand(args []string, timeout time.Duration) (string, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	// Don't wait on anything the command left running with our output pipe
+	cmd.WaitDelay = time.Second
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		return string(out), 0, nil
+	}
+
+	code := -1
+	if ee, ok := err.(*exec.ExitError); ok {
+		code = ee.ExitCode()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	return string(out), code, err
+}
@@ -0,0 +1,153 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+	"github.com/networkbootstrap/ztpmanagercode/templategen"
+)
+
+// Options dhcpd knows by name, either built in or defined in the dhcpd.conf header
+var iscOptionNames = map[int]string{
+	66:  "tftp-server-name",
+	67:  "bootfile-name",
+	114: "default-url",
+	150: "ezjunosztp-file-server",
+}
+
+// Option 43 sub-options defined in the ezjunosztp space of the dhcpd.conf header
+var iscSubOptionNames = map[int]string{
+	0: "ezjunosztp.image-file-name",
+	1: "ezjunosztp.config-file-name",
+	2: "ezjunosztp.image-file-type",
+	3: "ezjunosztp.transfer-mode",
+}
+
+// ISCBackend drives the ISC dhcpd server through dhcpd.conf and /etc/default/isc-dhcp-server.
+// If any scope is IPv6, dhcpd6.conf is written too.
+type ISCBackend struct {
+	V6 bool
+}
+
+// Name returns the name of the backend
+func (b ISCBackend) Name() string {
+	return "isc"
+}
+
+// Render returns dhcpd.conf and the interface defaults file
+func (b ISCBackend) Render(c Cfg) ([]Artifact, error) {
+	dhcpdStr, err := c.CreateDHCPd()
+	if err != nil {
+		return nil, err
+	}
+
+	dhcpStr, err := c.CreateIfaceSetting()
+	if err != nil {
+		return nil, err
+	}
+
+	artifacts := []Artifact{
+		{Path: c.Core.DHCPDPath, Content: dhcpdStr, Check: c.Core.DHCPCheckCommand},
+		{Path: c.Core.DHCPPath, Content: dhcpStr},
+	}
+
+	if b.V6 {
+		if c.Core.DHCPD6Path == "" {
+			return nil, errors.New("IPv6 scopes need DHCPD6Path in [Core]")
+		}
+		dhcpd6Str, err := c.CreateDHCPd6()
+		if err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, Artifact{Path: c.Core.DHCPD6Path, Content: dhcpd6Str, Check: c.Core.DHCP6CheckCommand})
+	}
+
+	return artifacts, nil
+}
+
+// ReloadCommands restarts isc-dhcp-server, and isc-dhcp-server6 if there are IPv6 scopes
+func (b ISCBackend) ReloadCommands() []string {
+	cmds := []string{"systemctl restart isc-dhcp-server"}
+	if b.V6 {
+		cmds = append(cmds, "systemctl restart isc-dhcp-server6")
+	}
+	return cmds
+}
+
+// RenderHost returns the host declarations from dhcpd.conf, and dhcpd6.conf if the host has an IPv6 address
+func (b ISCBackend) RenderHost(c Cfg, h rt.Hosts) (string, error) {
+	scope, scope6, err := c.hostScopes(h)
+	if err != nil {
+		return "", err
+	}
+
+	buf := new(bytes.Buffer)
+	if h.FixedIP != "" {
+		buf.Write([]byte(fmt.Sprintf("# %s, subnet %s\n", c.Core.DHCPDPath, scope.Name)))
+		buf.Write(MakeHost(h, c.Core.DomainName, c.HostOptions(h, scope)).Bytes())
+	}
+	if h.FixedIPv6 != "" {
+		buf.Write([]byte(fmt.Sprintf("# %s, subnet6 %s\n", c.Core.DHCPD6Path, scope6.Name)))
+		buf.Write(c.MakeHost6(h, c.fileServer6(scope6)).Bytes())
+	}
+	return buf.String(), nil
+}
+
+// iscOptionName returns the name dhcpd knows a vendor option by
+func iscOptionName(o templategen.DHCPOption) string {
+	if o.Encap {
+		if name, ok := iscSubOptionNames[o.Code]; ok {
+			return name
+		}
+		return fmt.Sprintf("ezjunosztp.sub-option-%v", o.Code)
+	}
+	if name, ok := iscOptionNames[o.Code]; ok {
+		return name
+	}
+	return fmt.Sprintf("ztp-option-%v", o.Code)
+}
+
+// iscOptionValue returns the value of a vendor option, quoted if it's text
+func iscOptionValue(o templategen.DHCPOption) string {
+	if o.Type == "ip-address" {
+		return o.Value
+	}
+	return fmt.Sprintf("\"%s\"", o.Value)
+}
+
+// iscOptionDefs returns definitions for the vendor options used by any host that dhcpd doesn't already know
+func (c Cfg) iscOptionDefs() string {
+	buf := new(bytes.Buffer)
+	seen := map[string]bool{}
+
+	for _, s := range c.AllScopes() {
+		if !s.IsV4() {
+			continue
+		}
+		for _, h := range c.HostsIn(s) {
+			for _, o := range c.HostOptions(h, s) {
+				name := iscOptionName(o)
+				if seen[name] {
+					continue
+				}
+				seen[name] = true
+				if _, ok := iscSubOptionNames[o.Code]; ok && o.Encap {
+					continue
+				}
+				if _, ok := iscOptionNames[o.Code]; ok && !o.Encap {
+					continue
+				}
+				typ := "text"
+				if o.Type == "ip-address" {
+					typ = "ip-address"
+				}
+				buf.Write([]byte(fmt.Sprintf("option %s code %v = %s;\n", name, o.Code, typ)))
+			}
+		}
+	}
+	return buf.String()
+}
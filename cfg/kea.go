@@ -0,0 +1,396 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+	"github.com/networkbootstrap/ztpmanagercode/templategen"
+)
+
+// Kea puts the option 43 sub-options in its own option space
+const keaZTPSpace = "vendor-encapsulated-options-space"
+
+// Options Kea knows by name, either standard or in the option-def list
+var keaOptionNames = map[int]string{
+	66: "tftp-server-name",
+	67: "boot-file-name",
+	// ONIE's default-url, since reused for captive portals (RFC 8910). Kea won't let us define it again.
+	114: "v4-captive-portal",
+	150: "ezjunosztp-file-server",
+}
+
+// Option 43 sub-options in the option-def list
+var keaSubOptionNames = map[int]string{
+	0: "image-file-name",
+	1: "config-file-name",
+	2: "image-file-type",
+	3: "transfer-mode",
+}
+
+// Kea puts the DHCPv6 vendor-specific information sub-options in a space per enterprise number
+var keaZTPSpace6 = fmt.Sprintf("vendor-%v", junosEnterprise)
+
+// KeaBackend drives the ISC Kea DHCPv4 server through kea-dhcp4.conf.
+// If any scope is IPv6, the Kea DHCPv6 server is driven through kea-dhcp6.conf too.
+type KeaBackend struct {
+	V6 bool
+}
+
+type keaConfig struct {
+	Dhcp4 keaDhcp4 `json:"Dhcp4"`
+}
+
+type kea6Config struct {
+	Dhcp6 keaDhcp6 `json:"Dhcp6"`
+}
+
+type keaDhcp4 struct {
+	InterfacesConfig keaInterfaces   `json:"interfaces-config"`
+	LeaseDatabase    keaLeaseDB      `json:"lease-database"`
+	Authoritative    bool            `json:"authoritative"`
+	ValidLifetime    int             `json:"valid-lifetime"`
+	MaxValidLifetime int             `json:"max-valid-lifetime"`
+	OptionDef        []keaOptionDef  `json:"option-def"`
+	OptionData       []keaOptionData `json:"option-data"`
+	Subnet4          []keaSubnet     `json:"subnet4"`
+}
+
+type keaDhcp6 struct {
+	InterfacesConfig keaInterfaces   `json:"interfaces-config"`
+	LeaseDatabase    keaLeaseDB      `json:"lease-database"`
+	ValidLifetime    int             `json:"valid-lifetime"`
+	MaxValidLifetime int             `json:"max-valid-lifetime"`
+	OptionDef        []keaOptionDef  `json:"option-def"`
+	OptionData       []keaOptionData `json:"option-data"`
+	Subnet6          []keaSubnet6    `json:"subnet6"`
+}
+
+type keaInterfaces struct {
+	Interfaces []string `json:"interfaces"`
+}
+
+type keaLeaseDB struct {
+	Type    string `json:"type"`
+	Persist bool   `json:"persist"`
+}
+
+type keaOptionDef struct {
+	Name  string `json:"name"`
+	Code  int    `json:"code"`
+	Space string `json:"space"`
+	Type  string `json:"type"`
+}
+
+type keaOptionData struct {
+	Name  string `json:"name"`
+	Space string `json:"space,omitempty"`
+	Data  string `json:"data,omitempty"`
+}
+
+type keaPool struct {
+	Pool string `json:"pool"`
+}
+
+type keaSubnet struct {
+	ID           int              `json:"id"`
+	Subnet       string           `json:"subnet"`
+	Pools        []keaPool        `json:"pools"`
+	OptionData   []keaOptionData  `json:"option-data"`
+	Reservations []keaReservation `json:"reservations"`
+}
+
+type keaReservation struct {
+	HWAddress  string          `json:"hw-address"`
+	IPAddress  string          `json:"ip-address"`
+	Hostname   string          `json:"hostname"`
+	OptionData []keaOptionData `json:"option-data,omitempty"`
+}
+
+type keaSubnet6 struct {
+	ID           int               `json:"id"`
+	Subnet       string            `json:"subnet"`
+	Interface    string            `json:"interface,omitempty"`
+	Pools        []keaPool         `json:"pools"`
+	OptionData   []keaOptionData   `json:"option-data"`
+	Reservations []keaReservation6 `json:"reservations"`
+}
+
+type keaReservation6 struct {
+	DUID        string          `json:"duid,omitempty"`
+	HWAddress   string          `json:"hw-address,omitempty"`
+	IPAddresses []string        `json:"ip-addresses"`
+	Hostname    string          `json:"hostname"`
+	OptionData  []keaOptionData `json:"option-data,omitempty"`
+}
+
+// Name returns the name of the backend
+func (b KeaBackend) Name() string {
+	return "kea"
+}
+
+// Render returns kea-dhcp4.conf, and kea-dhcp6.conf if there are IPv6 scopes
+func (b KeaBackend) Render(c Cfg) ([]Artifact, error) {
+	str, err := c.CreateKeaDHCP4()
+	if err != nil {
+		return nil, err
+	}
+	artifacts := []Artifact{{Path: c.Core.KeaPath, Content: str, Check: c.Core.DHCPCheckCommand}}
+
+	if b.V6 {
+		if c.Core.Kea6Path == "" {
+			return nil, errors.New("IPv6 scopes need Kea6Path in [Core]")
+		}
+		str, err = c.CreateKeaDHCP6()
+		if err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, Artifact{Path: c.Core.Kea6Path, Content: str, Check: c.Core.DHCP6CheckCommand})
+	}
+
+	return artifacts, nil
+}
+
+// ReloadCommands restarts the Kea DHCPv4 service, and the DHCPv6 one if there are IPv6 scopes
+func (b KeaBackend) ReloadCommands() []string {
+	cmds := []string{"systemctl restart kea-dhcp4-server"}
+	if b.V6 {
+		cmds = append(cmds, "systemctl restart kea-dhcp6-server")
+	}
+	return cmds
+}
+
+// RenderHost returns the host's reservations from kea-dhcp4.conf, and kea-dhcp6.conf if it has an IPv6 address
+func (b KeaBackend) RenderHost(c Cfg, h rt.Hosts) (string, error) {
+	scope, scope6, err := c.hostScopes(h)
+	if err != nil {
+		return "", err
+	}
+
+	out := ""
+	if h.FixedIP != "" {
+		res, _ := c.keaReservation4(h, scope)
+		js, err := json.MarshalIndent(res, "", "  ")
+		if err != nil {
+			return "", err
+		}
+		out += fmt.Sprintf("// %s, subnet %s\n%s\n", c.Core.KeaPath, scope.Name, js)
+	}
+	if h.FixedIPv6 != "" {
+		js, err := json.MarshalIndent(c.keaReservation6(h, scope6), "", "  ")
+		if err != nil {
+			return "", err
+		}
+		out += fmt.Sprintf("// %s, subnet %s\n%s\n", c.Core.Kea6Path, scope6.Name, js)
+	}
+	return out, nil
+}
+
+// CreateKeaDHCP4 returns the kea-dhcp4.conf JSON for the cache
+func (c Cfg) CreateKeaDHCP4() (string, error) {
+	dhcp4 := keaDhcp4{
+		InterfacesConfig: keaInterfaces{Interfaces: strings.Fields(c.Core.DHCPIface)},
+		LeaseDatabase:    keaLeaseDB{Type: "memfile", Persist: true},
+		Authoritative:    true,
+		ValidLifetime:    c.Core.DefaultLease,
+		MaxValidLifetime: c.Core.MaxLease,
+		// Same Junos ZTP options as the ISC generator
+		OptionDef: []keaOptionDef{
+			{Name: "image-file-name", Code: 0, Space: keaZTPSpace, Type: "string"},
+			{Name: "config-file-name", Code: 1, Space: keaZTPSpace, Type: "string"},
+			{Name: "image-file-type", Code: 2, Space: keaZTPSpace, Type: "string"},
+			{Name: "transfer-mode", Code: 3, Space: keaZTPSpace, Type: "string"},
+			{Name: "ezjunosztp-file-server", Code: 150, Space: "dhcp4", Type: "ipv4-address"},
+		},
+		OptionData: []keaOptionData{
+			{Name: "domain-name", Data: c.Core.DomainName},
+			{Name: "domain-name-servers", Data: strings.Join(onlyV4(c.Core.DNSServers), ", ")},
+		},
+	}
+
+	// Vendors can ask for options Kea doesn't know about, those need defining once
+	defined := map[string]bool{}
+
+	for i, s := range c.AllScopes() {
+		if !s.IsV4() {
+			continue
+		}
+		n, err := s.Network()
+		if err != nil {
+			return "", err
+		}
+
+		subnet := keaSubnet{
+			ID:     i + 1,
+			Subnet: n.String(),
+			Pools:  []keaPool{},
+			OptionData: []keaOptionData{
+				{Name: "domain-name-servers", Data: strings.Join(onlyV4(s.DNSServers), ", ")},
+				{Name: "ntp-servers", Data: strings.Join(onlyV4(s.NTPServers), ", ")},
+				{Name: "ezjunosztp-file-server", Data: s.FileServer},
+				{Name: "vendor-encapsulated-options"},
+				{Name: "transfer-mode", Space: keaZTPSpace, Data: c.Core.TransferMode},
+			},
+			Reservations: []keaReservation{},
+		}
+
+		// Kea won't take an empty routers option
+		if s.SubnetRouter != "" {
+			subnet.OptionData = append([]keaOptionData{{Name: "routers", Data: s.SubnetRouter}}, subnet.OptionData...)
+		}
+		if s.NonCfgRangeLow != "" && s.NonCfgRangeHigh != "" {
+			subnet.Pools = append(subnet.Pools, keaPool{Pool: fmt.Sprintf("%s - %s", s.NonCfgRangeLow, s.NonCfgRangeHigh)})
+		}
+
+		for _, h := range c.HostsIn(s) {
+			res, defs := c.keaReservation4(h, s)
+			for _, def := range defs {
+				if !defined[def.Space+def.Name] {
+					defined[def.Space+def.Name] = true
+					dhcp4.OptionDef = append(dhcp4.OptionDef, def)
+				}
+			}
+			subnet.Reservations = append(subnet.Reservations, res)
+		}
+
+		dhcp4.Subnet4 = append(dhcp4.Subnet4, subnet)
+	}
+
+	b, err := json.MarshalIndent(keaConfig{Dhcp4: dhcp4}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
+
+// keaReservation4 returns the DHCPv4 reservation for a host in scope s, along with the
+// option-defs its vendor options need
+func (c Cfg) keaReservation4(h rt.Hosts, s ScopeCfg) (keaReservation, []keaOptionDef) {
+	res := keaReservation{
+		HWAddress: h.Ethernet,
+		IPAddress: h.FixedIP,
+		Hostname:  h.HostName,
+	}
+	defs := []keaOptionDef{}
+	for _, o := range c.HostOptions(h, s) {
+		data, def := keaOption(o)
+		res.OptionData = append(res.OptionData, data)
+		if def != nil {
+			defs = append(defs, *def)
+		}
+	}
+	return res, defs
+}
+
+// keaReservation6 returns the DHCPv6 reservation for a host in scope s
+func (c Cfg) keaReservation6(h rt.Hosts, s ScopeCfg) keaReservation6 {
+	res := keaReservation6{
+		IPAddresses: []string{h.FixedIPv6},
+		Hostname:    h.HostName,
+	}
+	if h.DUID != "" {
+		res.DUID = h.DUID
+	} else {
+		res.HWAddress = h.Ethernet
+	}
+	cfgurl, imageurl := c.HostURLs(h, c.fileServer6(s))
+	res.OptionData = append(res.OptionData, keaOptionData{Name: "config-file-name", Space: keaZTPSpace6, Data: cfgurl})
+	if imageurl != "" {
+		res.OptionData = append(res.OptionData, keaOptionData{Name: "image-file-name", Space: keaZTPSpace6, Data: imageurl})
+	}
+	return res
+}
+
+// keaOption returns the option-data for a vendor option, and an option-def if Kea doesn't already know it
+func keaOption(o templategen.DHCPOption) (keaOptionData, *keaOptionDef) {
+	typ := "string"
+	if o.Type == "ip-address" {
+		typ = "ipv4-address"
+	}
+
+	if o.Encap {
+		if name, ok := keaSubOptionNames[o.Code]; ok {
+			return keaOptionData{Name: name, Space: keaZTPSpace, Data: o.Value}, nil
+		}
+		name := fmt.Sprintf("sub-option-%v", o.Code)
+		return keaOptionData{Name: name, Space: keaZTPSpace, Data: o.Value}, &keaOptionDef{Name: name, Code: o.Code, Space: keaZTPSpace, Type: typ}
+	}
+
+	if name, ok := keaOptionNames[o.Code]; ok {
+		return keaOptionData{Name: name, Data: o.Value}, nil
+	}
+	name := fmt.Sprintf("ztp-option-%v", o.Code)
+	return keaOptionData{Name: name, Data: o.Value}, &keaOptionDef{Name: name, Code: o.Code, Space: "dhcp4", Type: typ}
+}
+
+// CreateKeaDHCP6 returns the kea-dhcp6.conf JSON for the IPv6 scopes and hosts.
+// The ZTP config and image URLs go in the vendor-specific information option (17).
+func (c Cfg) CreateKeaDHCP6() (string, error) {
+	dhcp6 := keaDhcp6{
+		InterfacesConfig: keaInterfaces{Interfaces: strings.Fields(c.Core.DHCPIface)},
+		LeaseDatabase:    keaLeaseDB{Type: "memfile", Persist: true},
+		ValidLifetime:    c.Core.DefaultLease,
+		MaxValidLifetime: c.Core.MaxLease,
+		OptionDef: []keaOptionDef{
+			{Name: "image-file-name", Code: 0, Space: keaZTPSpace6, Type: "string"},
+			{Name: "config-file-name", Code: 1, Space: keaZTPSpace6, Type: "string"},
+			{Name: "image-file-type", Code: 2, Space: keaZTPSpace6, Type: "string"},
+			{Name: "transfer-mode", Code: 3, Space: keaZTPSpace6, Type: "string"},
+		},
+		OptionData: []keaOptionData{
+			{Name: "domain-search", Data: c.Core.DomainName},
+		},
+	}
+	if dns := onlyV6(c.Core.DNSServers); len(dns) > 0 {
+		dhcp6.OptionData = append(dhcp6.OptionData, keaOptionData{Name: "dns-servers", Data: strings.Join(dns, ", ")})
+	}
+
+	// Clients on the local segment talk to us over link-local, so Kea needs to know which interface their subnet is on
+	ifaces := strings.Fields(c.Core.DHCPIface)
+
+	for i, s := range c.AllScopes() {
+		if !s.IsV6() {
+			continue
+		}
+		n, err := s.Network6()
+		if err != nil {
+			return "", err
+		}
+
+		subnet := keaSubnet6{
+			ID:     i + 1,
+			Subnet: n.String(),
+			Pools:  []keaPool{},
+			OptionData: []keaOptionData{
+				{Name: "vendor-opts", Data: fmt.Sprintf("%v", junosEnterprise)},
+				{Name: "transfer-mode", Space: keaZTPSpace6, Data: c.Core.TransferMode},
+			},
+			Reservations: []keaReservation6{},
+		}
+		if len(ifaces) == 1 && s.Contains(c.Core.FileServer6) {
+			subnet.Interface = ifaces[0]
+		}
+		if dns := onlyV6(s.DNSServers); len(dns) > 0 {
+			subnet.OptionData = append(subnet.OptionData, keaOptionData{Name: "dns-servers", Data: strings.Join(dns, ", ")})
+		}
+		if s.NonCfgRange6Low != "" && s.NonCfgRange6High != "" {
+			subnet.Pools = append(subnet.Pools, keaPool{Pool: fmt.Sprintf("%s - %s", s.NonCfgRange6Low, s.NonCfgRange6High)})
+		}
+
+		for _, h := range c.Hosts6In(s) {
+			subnet.Reservations = append(subnet.Reservations, c.keaReservation6(h, s))
+		}
+
+		dhcp6.Subnet6 = append(dhcp6.Subnet6, subnet)
+	}
+
+	b, err := json.MarshalIndent(kea6Config{Dhcp6: dhcp6}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return string(b) + "\n", nil
+}
@@ -0,0 +1,143 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/networkbootstrap/ztpmanagercode/diff"
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// Plan is everything a save does to the disk
+type Plan struct {
+	Writes       []Artifact    // The config file, the DHCP server files and the device files, in that order
+	Deletes      []string      // Device files of deleted hosts
+	CheckTimeout time.Duration // How long each check command gets, the hook timeout if not set
+}
+
+// Plan checks c and renders every file a save writes, without touching the disk.
+// deletelist holds the names of files in the configs directory that belong to deleted hosts.
+// Like Save, it fills in the derived host fields of c. Errors are SaveErrors from the "check" or "render" step.
+func (c *Cfg) Plan(cfgfile string, deletelist []string) (Plan, error) {
+	if err := c.prepare(); err != nil {
+		return Plan{}, &SaveError{Step: "check", Err: err}
+	}
+
+	p, err := c.render(cfgfile, deletelist)
+	if err != nil {
+		return Plan{}, &SaveError{Step: "render", Err: err}
+	}
+	return p, nil
+}
+
+// render does the rendering for Plan
+func (c Cfg) render(cfgfile string, deletelist []string) (Plan, error) {
+	p := Plan{CheckTimeout: c.HookTimeout()}
+
+	s, err := c.Encode()
+	if err != nil {
+		return p, err
+	}
+	p.Writes = append(p.Writes, Artifact{Path: cfgfile, Content: s})
+
+	// Render the DHCP server files through the configured backend
+	backend, err := c.Backend()
+	if err != nil {
+		return p, err
+	}
+	artifacts, err := backend.Render(c)
+	if err != nil {
+		return p, err
+	}
+	p.Writes = append(p.Writes, artifacts...)
+
+	// Each vendor knows its own template, payload and file name
+	for _, k := range c.sortedHostKeys() {
+		v := c.Hosts[k]
+		// No vendor, no config
+		if v.Vendor == "" {
+			continue
+		}
+		artifacts, err := c.GenerateDevice(v)
+		if err != nil {
+			return p, err
+		}
+		p.Writes = append(p.Writes, artifacts...)
+	}
+
+	for _, v := range deletelist {
+		p.Deletes = append(p.Deletes, filepath.Join(c.Core.FileConfigsLocation, v))
+	}
+	return p, nil
+}
+
+// DryRun returns the plan a save would carry out, leaving c as it is
+func (c Cfg) DryRun(cfgfile string, deletelist []string) (Plan, error) {
+	dry := c.clone()
+	return dry.Plan(cfgfile, deletelist)
+}
+
+// Changes diffs the plan against the disk. Files that would be left as they are aren't included.
+// A deleted host's file that gets written again, say for a host re-added under the same name, counts as modified.
+func (p Plan) Changes() ([]rt.FileChange, error) {
+	changes := []rt.FileChange{}
+	written := map[string]bool{}
+
+	for _, a := range p.Writes {
+		written[a.Path] = true
+
+		old, exists, err := readExisting(a.Path)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			changes = append(changes, rt.FileChange{Path: a.Path, Action: "create", Diff: diff.Unified("/dev/null", a.Path, "", a.Content, 3)})
+		} else if old != a.Content {
+			changes = append(changes, rt.FileChange{Path: a.Path, Action: "modify", Diff: diff.Unified(a.Path, a.Path, old, a.Content, 3)})
+		}
+	}
+
+	for _, v := range p.Deletes {
+		if written[v] {
+			continue
+		}
+		old, exists, err := readExisting(v)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			changes = append(changes, rt.FileChange{Path: v, Action: "delete", Diff: diff.Unified(v, "/dev/null", old, "", 3)})
+		}
+	}
+	return changes, nil
+}
+
+// readExisting returns the content of file, if there is one
+func readExisting(file string) (string, bool, error) {
+	b, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return string(b), true, nil
+}
+
+// clone returns a copy of c whose hosts and groups can be changed without touching c
+func (c Cfg) clone() Cfg {
+	n := c
+	n.Hosts = make(map[string]rt.Hosts, len(c.Hosts))
+	for k, v := range c.Hosts {
+		n.Hosts[k] = v
+	}
+	n.Groups = make(map[string]GroupCfg, len(c.Groups))
+	for k, v := range c.Groups {
+		n.Groups[k] = v
+	}
+	return n
+}
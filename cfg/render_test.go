@@ -0,0 +1,122 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata with what the backends render")
+
+// renderCfg returns a config with a dual-stack scope, an IPv4 scope and a host of each kind in them
+func renderCfg(backend string, v6 bool) Cfg {
+	c := labCfg()
+	c.Core.DHCPBackend = backend
+	c.Core.DHCPDPath = "/etc/dhcp/dhcpd.conf"
+	c.Core.DHCPPath = "/etc/default/isc-dhcp-server"
+	c.Core.DHCPD6Path = "/etc/dhcp/dhcpd6.conf"
+	c.Core.KeaPath = "/etc/kea/kea-dhcp4.conf"
+	c.Core.Kea6Path = "/etc/kea/kea-dhcp6.conf"
+	c.Core.DnsmasqPath = "/etc/dnsmasq.d/ztpmanager.conf"
+	c.Core.DnsmasqHostsPath = "/var/lib/ztpmanager/dnsmasq.hosts"
+	c.Core.DnsmasqOptsPath = "/var/lib/ztpmanager/dnsmasq.opts"
+	c.Core.DHCPCheckCommand = "check {file}"
+	c.Core.DHCP6CheckCommand = "check6 {file}"
+	c.Core.ServerURL = "ztp.lab.example.net"
+	c.Core.DHCPIface = "eth1"
+	c.Core.DomainName = "lab.example.net"
+	c.Core.DNSServers = []string{"10.9.0.53", "2001:db8:9::53"}
+	c.Core.NTPServers = []string{"10.9.0.123"}
+	c.Core.DefaultLease = 600
+	c.Core.MaxLease = 7200
+	c.Scopes = append(c.Scopes, ScopeCfg{
+		Name:         "dc",
+		Subnet:       "10.10.0.0",
+		SubnetMask:   "255.255.255.0",
+		SubnetRouter: "10.10.0.1",
+		FileServer:   "10.10.0.254",
+	})
+
+	hosts := []rt.Hosts{
+		{FixedIP: "10.9.0.10", HostName: "sw1", Ethernet: "02:00:00:00:00:0a", Vendor: "junos", CfgImage: "jinstall.tgz"},
+		{FixedIP: "10.9.0.11", HostName: "sw2", Ethernet: "02:00:00:00:00:0b"},
+		{FixedIP: "10.10.0.10", HostName: "dc1", Ethernet: "02:00:00:00:01:0a", Vendor: "junos"},
+	}
+	if v6 {
+		c.Scopes[0].Subnet6 = "2001:db8:9::/64"
+		c.Scopes[0].NonCfgRange6Low = "2001:db8:9::1000"
+		c.Scopes[0].NonCfgRange6High = "2001:db8:9::1fff"
+		hosts = append(hosts,
+			rt.Hosts{FixedIP: "10.9.0.12", FixedIPv6: "2001:db8:9::12", HostName: "sw3", Ethernet: "02:00:00:00:00:0c", Vendor: "junos"},
+			rt.Hosts{FixedIPv6: "2001:db8:9::20", HostName: "sw6", DUID: "00:01:00:01:aa:bb:cc:dd", Vendor: "junos"},
+		)
+	}
+	for _, h := range hosts {
+		c.Hosts[h.Key()] = h
+	}
+	return c
+}
+
+// TestRender compares what each backend renders with the files in testdata/render. Run the tests with
+// -update to write them out again after changing a backend, and check the diff.
+func TestRender(t *testing.T) {
+	tests := []struct {
+		backend string
+		v6      bool
+		want    []string // File names of the artifacts, in order
+	}{
+		{backend: "isc", v6: true, want: []string{"dhcpd.conf", "isc-dhcp-server", "dhcpd6.conf"}},
+		{backend: "kea", v6: true, want: []string{"kea-dhcp4.conf", "kea-dhcp6.conf"}},
+		{backend: "dnsmasq", want: []string{"ztpmanager.conf", "dnsmasq.hosts", "dnsmasq.opts"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.backend, func(t *testing.T) {
+			c := renderCfg(tt.backend, tt.v6)
+			if err := c.prepare(); err != nil {
+				t.Fatal(err)
+			}
+			backend, err := c.Backend()
+			if err != nil {
+				t.Fatal(err)
+			}
+			artifacts, err := backend.Render(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(artifacts) != len(tt.want) {
+				t.Fatalf("rendered %d files, expected %d", len(artifacts), len(tt.want))
+			}
+			for i, a := range artifacts {
+				name := filepath.Base(a.Path)
+				if name != tt.want[i] {
+					t.Errorf("file %d is %s, expected %s", i, name, tt.want[i])
+					continue
+				}
+				golden := filepath.Join("testdata", "render", tt.backend, name)
+				if *update {
+					if err := os.MkdirAll(filepath.Dir(golden), 0755); err != nil {
+						t.Fatal(err)
+					}
+					if err := ioutil.WriteFile(golden, []byte(a.Content), 0644); err != nil {
+						t.Fatal(err)
+					}
+					continue
+				}
+				want, err := ioutil.ReadFile(golden)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if a.Content != string(want) {
+					t.Errorf("%s differs from %s:\n%s", a.Path, golden, a.Content)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,208 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// ScopeCfg holds a single named DHCP scope. Scopes that are not on the segment
+// the server sits on are reached through DHCP relays (ip helper-address etc).
+// Empty DNSServers, NTPServers and FileServer fields inherit the [Core] values.
+// A scope can be IPv4, IPv6 (Subnet6 in CIDR notation) or both.
+type ScopeCfg struct {
+	Name             string   `json:"name"`
+	Subnet           string   `json:"subnet" dhcpd:"subnet"`
+	SubnetMask       string   `json:"subnetmask" dhcpd:"netmask"`
+	SubnetRouter     string   `json:"subnetrouter" dhcpd:"option routers"`
+	NonCfgRangeLow   string   `json:"noncfgrangelow"`
+	NonCfgRangeHigh  string   `json:"noncfgrangehigh"`
+	Subnet6          string   `json:"subnet6" dhcpd:"subnet6"`
+	SubnetRouter6    string   `json:"subnetrouter6"`
+	NonCfgRange6Low  string   `json:"noncfgrange6low"`
+	NonCfgRange6High string   `json:"noncfgrange6high"`
+	DNSServers       []string `json:"dnservers" dhcpd:"option domain-name-servers"`
+	NTPServers       []string `json:"ntpservers" dhcpd:"option ntp-servers"`
+	FileServer       string   `json:"fileserver" dhcpd:"option ezjunosztp-file-server"`
+	FileServer6      string   `json:"fileserver6"`
+}
+
+// Network returns the scope as a net.IPNet
+func (s ScopeCfg) Network() (*net.IPNet, error) {
+	ip := net.ParseIP(s.Subnet).To4()
+	mask := net.ParseIP(s.SubnetMask).To4()
+	if ip == nil || mask == nil {
+		return nil, fmt.Errorf("scope %q has an invalid subnet %s/%s", s.Name, s.Subnet, s.SubnetMask)
+	}
+	return &net.IPNet{IP: ip.Mask(net.IPMask(mask)), Mask: net.IPMask(mask)}, nil
+}
+
+// Network6 returns the IPv6 side of the scope as a net.IPNet
+func (s ScopeCfg) Network6() (*net.IPNet, error) {
+	ip, n, err := net.ParseCIDR(s.Subnet6)
+	if err != nil || ip.To4() != nil {
+		return nil, fmt.Errorf("scope %q has an invalid IPv6 subnet %s", s.Name, s.Subnet6)
+	}
+	return n, nil
+}
+
+// IsV4 returns true if the scope has an IPv4 subnet
+func (s ScopeCfg) IsV4() bool {
+	return s.Subnet != ""
+}
+
+// IsV6 returns true if the scope has an IPv6 subnet
+func (s ScopeCfg) IsV6() bool {
+	return s.Subnet6 != ""
+}
+
+// Contains returns true if ip, either IPv4 or IPv6, falls inside the scope
+func (s ScopeCfg) Contains(ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	var n *net.IPNet
+	var err error
+	if addr.To4() != nil {
+		n, err = s.Network()
+	} else {
+		n, err = s.Network6()
+	}
+	if err != nil {
+		return false
+	}
+	return n.Contains(addr)
+}
+
+// PrefixLength returns the mask of the scope in CIDR notation length
+func (s ScopeCfg) PrefixLength() int {
+	n, err := s.Network()
+	if err != nil {
+		return 0
+	}
+	ones, _ := n.Mask.Size()
+	return ones
+}
+
+// PrefixLength6 returns the prefix length of the IPv6 subnet
+func (s ScopeCfg) PrefixLength6() int {
+	n, err := s.Network6()
+	if err != nil {
+		return 0
+	}
+	ones, _ := n.Mask.Size()
+	return ones
+}
+
+// AllScopes returns the configured scopes with the [Core] values filled in where a scope doesn't override them.
+// If no scopes are configured, the single subnet from [Core] is returned as the "default" scope.
+func (c Cfg) AllScopes() []ScopeCfg {
+	scopes := c.Scopes
+	if len(scopes) == 0 {
+		scopes = []ScopeCfg{{
+			Name:             "default",
+			Subnet:           c.Core.Subnet,
+			SubnetMask:       c.Core.SubnetMask,
+			SubnetRouter:     c.Core.SubnetRouter,
+			NonCfgRangeLow:   c.Core.NonCfgRangeLow,
+			NonCfgRangeHigh:  c.Core.NonCfgRangeHigh,
+			Subnet6:          c.Core.Subnet6,
+			SubnetRouter6:    c.Core.SubnetRouter6,
+			NonCfgRange6Low:  c.Core.NonCfgRange6Low,
+			NonCfgRange6High: c.Core.NonCfgRange6High,
+		}}
+	}
+
+	rtn := make([]ScopeCfg, 0, len(scopes))
+	for _, s := range scopes {
+		if len(s.DNSServers) == 0 {
+			s.DNSServers = c.Core.DNSServers
+		}
+		if len(s.NTPServers) == 0 {
+			s.NTPServers = c.Core.NTPServers
+		}
+		if s.FileServer == "" {
+			s.FileServer = c.Core.FileServer
+		}
+		if s.FileServer6 == "" {
+			s.FileServer6 = c.Core.FileServer6
+		}
+		rtn = append(rtn, s)
+	}
+	return rtn
+}
+
+// CheckScopes returns an error if any two scopes overlap. A host in both would be handed out by each of them.
+func (c Cfg) CheckScopes() error {
+	scopes := c.AllScopes()
+	for i, a := range scopes {
+		for _, b := range scopes[i+1:] {
+			if a.IsV4() && b.IsV4() && overlap(a.Network, b.Network) {
+				return fmt.Errorf("scopes %q and %q overlap: %s/%s and %s/%s", a.Name, b.Name, a.Subnet, a.SubnetMask, b.Subnet, b.SubnetMask)
+			}
+			if a.IsV6() && b.IsV6() && overlap(a.Network6, b.Network6) {
+				return fmt.Errorf("scopes %q and %q overlap: %s and %s", a.Name, b.Name, a.Subnet6, b.Subnet6)
+			}
+		}
+	}
+	return nil
+}
+
+// overlap returns true if either network holds the start of the other. Networks that don't parse are left
+// for the host checks to report.
+func overlap(a func() (*net.IPNet, error), b func() (*net.IPNet, error)) bool {
+	na, errA := a()
+	nb, errB := b()
+	if errA != nil || errB != nil {
+		return false
+	}
+	return na.Contains(nb.IP) || nb.Contains(na.IP)
+}
+
+// ScopeFor returns the scope the address ip belongs to
+func (c Cfg) ScopeFor(ip string) (ScopeCfg, error) {
+	for _, s := range c.AllScopes() {
+		if s.Contains(ip) {
+			return s, nil
+		}
+	}
+	return ScopeCfg{}, fmt.Errorf("address %s is not inside any configured scope", ip)
+}
+
+// HostsIn returns the hosts with an IPv4 address inside the scope, in address order
+func (c Cfg) HostsIn(s ScopeCfg) []rt.Hosts {
+	hosts := []rt.Hosts{}
+	for _, k := range c.sortedHostKeys() {
+		if h := c.Hosts[k]; h.FixedIP != "" && s.IsV4() && s.Contains(h.FixedIP) {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// Hosts6In returns the hosts with an IPv6 address inside the scope, in address order
+func (c Cfg) Hosts6In(s ScopeCfg) []rt.Hosts {
+	hosts := []rt.Hosts{}
+	for _, k := range c.sortedHostKeys() {
+		if h := c.Hosts[k]; h.FixedIPv6 != "" && s.IsV6() && s.Contains(h.FixedIPv6) {
+			hosts = append(hosts, h)
+		}
+	}
+	return hosts
+}
+
+// sortedHostKeys returns the keys of the Hosts map in address order so generated files are stable
+func (c Cfg) sortedHostKeys() []string {
+	keys := make([]string, 0, len(c.Hosts))
+	for k := range c.Hosts {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return rt.AddrLess(keys[i], keys[j]) })
+	return keys
+}
@@ -0,0 +1,122 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"strings"
+	"testing"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+func TestCheckScopes(t *testing.T) {
+	tests := []struct {
+		name    string
+		scopes  []ScopeCfg
+		overlap bool
+	}{
+		{
+			name: "apart",
+			scopes: []ScopeCfg{
+				{Name: "a", Subnet: "10.9.0.0", SubnetMask: "255.255.255.0", Subnet6: "2001:db8:9::/64"},
+				{Name: "b", Subnet: "10.9.1.0", SubnetMask: "255.255.255.0", Subnet6: "2001:db8:a::/64"},
+			},
+		},
+		{
+			name: "same subnet",
+			scopes: []ScopeCfg{
+				{Name: "a", Subnet: "10.9.0.0", SubnetMask: "255.255.255.0"},
+				{Name: "b", Subnet: "10.9.0.0", SubnetMask: "255.255.255.0"},
+			},
+			overlap: true,
+		},
+		{
+			name: "inside another",
+			scopes: []ScopeCfg{
+				{Name: "a", Subnet: "10.9.0.128", SubnetMask: "255.255.255.128"},
+				{Name: "b", Subnet: "10.9.0.0", SubnetMask: "255.255.0.0"},
+			},
+			overlap: true,
+		},
+		{
+			name: "IPv6 inside another",
+			scopes: []ScopeCfg{
+				{Name: "a", Subnet6: "2001:db8::/32"},
+				{Name: "b", Subnet6: "2001:db8:9::/64"},
+			},
+			overlap: true,
+		},
+		{
+			name: "IPv4 and IPv6",
+			scopes: []ScopeCfg{
+				{Name: "a", Subnet: "10.9.0.0", SubnetMask: "255.255.255.0"},
+				{Name: "b", Subnet6: "2001:db8:9::/64"},
+			},
+		},
+		{
+			name: "third overlaps the first",
+			scopes: []ScopeCfg{
+				{Name: "a", Subnet: "10.9.0.0", SubnetMask: "255.255.255.0"},
+				{Name: "b", Subnet: "10.9.1.0", SubnetMask: "255.255.255.0"},
+				{Name: "c", Subnet: "10.9.0.64", SubnetMask: "255.255.255.192"},
+			},
+			overlap: true,
+		},
+		{
+			name: "invalid subnet",
+			scopes: []ScopeCfg{
+				{Name: "a", Subnet: "10.9.0.0", SubnetMask: "255.255.255.0"},
+				{Name: "b", Subnet: "10.9.0", SubnetMask: "255.255.255.0"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCfg()
+			c.Scopes = tt.scopes
+			if err := c.CheckScopes(); (err != nil) != tt.overlap {
+				t.Errorf("CheckScopes returned %v, expected an overlap to be %v", err, tt.overlap)
+			}
+		})
+	}
+}
+
+func TestHostsIn(t *testing.T) {
+	c := NewCfg()
+	lab := ScopeCfg{Name: "lab", Subnet: "10.9.0.0", SubnetMask: "255.255.255.0", Subnet6: "2001:db8:9::/64"}
+	dc := ScopeCfg{Name: "dc", Subnet: "10.10.0.0", SubnetMask: "255.255.0.0"}
+	c.Scopes = []ScopeCfg{lab, dc}
+	for _, h := range []rt.Hosts{
+		{FixedIP: "10.9.0.20", HostName: "lab20"},
+		{FixedIP: "10.9.0.3", HostName: "lab3", FixedIPv6: "2001:db8:9::30"},
+		{FixedIP: "10.10.200.1", HostName: "dc1"},
+		{FixedIPv6: "2001:db8:9::4", HostName: "lab6"},
+		{FixedIPv6: "2001:db8:a::1", HostName: "elsewhere6"},
+		{FixedIP: "10.9.0.100", HostName: "lab100", FixedIPv6: "2001:db8:9::1"},
+	} {
+		c.Hosts[h.Key()] = h
+	}
+
+	names := func(hosts []rt.Hosts) []string {
+		n := []string{}
+		for _, h := range hosts {
+			n = append(n, h.HostName)
+		}
+		return n
+	}
+	tests := []struct {
+		name string
+		got  []rt.Hosts
+		want []string
+	}{
+		{name: "IPv4 in lab", got: c.HostsIn(lab), want: []string{"lab3", "lab20", "lab100"}},
+		{name: "IPv4 in dc", got: c.HostsIn(dc), want: []string{"dc1"}},
+		{name: "IPv6 in lab", got: c.Hosts6In(lab), want: []string{"lab3", "lab100", "lab6"}},
+		{name: "IPv6 in an IPv4 scope", got: c.Hosts6In(dc), want: []string{}},
+	}
+	for _, tt := range tests {
+		if got := names(tt.got); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%s: got %v, expected %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SaveError is returned when a save fails. Step names what the save was doing at the time:
+// "check", "render", "pre-save", "stage", "validate", "swap", "delete" or "reload".
+type SaveError struct {
+	Step     string
+	Err      error
+	Rollback error // Set if putting the previous files back failed too
+}
+
+func (e *SaveError) Error() string {
+	if e.Rollback != nil {
+		return fmt.Sprintf("%s: %s (rollback failed: %s)", e.Step, e.Err, e.Rollback)
+	}
+	return fmt.Sprintf("%s: %s", e.Step, e.Err)
+}
+
+// stepOf returns the step a failed save was at, or "" if err isn't a SaveError
+func stepOf(err error) string {
+	if se, ok := err.(*SaveError); ok {
+		return se.Step
+	}
+	return ""
+}
+
+// Apply carries out the plan as one transaction. Every file is staged next to where it belongs and
+// checked, then swapped in with a rename, so readers never see a half written file. If anything
+// fails, reload included, the files from before the save are put back. reload may be nil.
+func (p Plan) Apply(reload func() error) error {
+	t := &txn{backups: map[string]string{}, timeout: p.CheckTimeout}
+	if t.timeout <= 0 {
+		t.timeout = defaultHookTimeout
+	}
+	defer t.cleanup()
+
+	for _, a := range p.Writes {
+		if err := t.stage(a); err != nil {
+			return &SaveError{Step: "stage", Err: err}
+		}
+	}
+	if err := t.validate(); err != nil {
+		return &SaveError{Step: "validate", Err: err}
+	}
+
+	written := map[string]bool{}
+	for _, s := range t.staged {
+		if err := t.swap(s); err != nil {
+			return t.rollback(&SaveError{Step: "swap", Err: err}, nil)
+		}
+		written[s.Path] = true
+	}
+	for _, v := range p.Deletes {
+		// Rewritten files, for a host re-added under the same name, stay
+		if written[v] {
+			continue
+		}
+		if err := t.remove(v); err != nil {
+			return t.rollback(&SaveError{Step: "delete", Err: err}, nil)
+		}
+	}
+
+	if reload != nil {
+		if err := reload(); err != nil {
+			// The DHCP server has to be told about the old files too
+			return t.rollback(&SaveError{Step: "reload", Err: err}, reload)
+		}
+	}
+
+	t.commit()
+	return nil
+}
+
+// staged is an artifact written to a temporary file beside its destination
+type staged struct {
+	Artifact
+	tmp string
+}
+
+// txn keeps track of what a save has done, so it can be undone
+type txn struct {
+	staged  []staged
+	backups map[string]string // Destination to its backup, "" if the destination didn't exist
+	touched []string          // Destinations in the order they were changed
+	timeout time.Duration     // How long each check command gets
+}
+
+// stage writes a to a temporary file in the same directory, so the swap is a rename on one filesystem
+func (t *txn) stage(a Artifact) error {
+	dir, base := filepath.Split(a.Path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := ioutil.TempFile(dir, "."+base+".")
+	if err != nil {
+		return err
+	}
+	t.staged = append(t.staged, staged{Artifact: a, tmp: f.Name()})
+
+	if _, err = f.WriteString(a.Content); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	// Keep the mode of the file being replaced
+	mode := os.FileMode(0755)
+	if fi, err := os.Stat(a.Path); err == nil {
+		mode = fi.Mode().Perm()
+	}
+	return os.Chmod(f.Name(), mode)
+}
+
+// validate reads every staged file back and makes sure it holds what was rendered,
+// then runs the check commands over them
+func (t *txn) validate() error {
+	for _, s := range t.staged {
+		b, err := ioutil.ReadFile(s.tmp)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(b, []byte(s.Content)) {
+			return fmt.Errorf("%s: staged file doesn't match what was rendered", s.Path)
+		}
+		if err = checkFile(s.Artifact, s.tmp, t.timeout); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// swap moves a staged file over its destination, keeping the previous generation aside
+func (t *txn) swap(s staged) error {
+	if err := t.backup(s.Path, false); err != nil {
+		return err
+	}
+	return os.Rename(s.tmp, s.Path)
+}
+
+// remove deletes file, keeping it aside until the save is committed
+func (t *txn) remove(file string) error {
+	return t.backup(file, true)
+}
+
+// backup keeps the current generation of file as a hidden file next to it. The file stays where it
+// is unless move is set. A file that's already been backed up in this transaction is left alone.
+func (t *txn) backup(file string, move bool) error {
+	if _, ok := t.backups[file]; ok {
+		if move {
+			if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if _, err := os.Lstat(file); os.IsNotExist(err) {
+		t.backups[file] = ""
+		t.touched = append(t.touched, file)
+		return nil
+	}
+
+	dir, base := filepath.Split(file)
+	bak := filepath.Join(dir, "."+base+".bak")
+	// Left over from a save that never finished
+	os.Remove(bak)
+
+	var err error
+	if move {
+		err = os.Rename(file, bak)
+	} else if err = os.Link(file, bak); err != nil {
+		// Not every filesystem does hard links
+		err = copyFile(file, bak)
+	}
+	if err != nil {
+		return err
+	}
+	t.backups[file] = bak
+	t.touched = append(t.touched, file)
+	return nil
+}
+
+// rollback puts back every file touched so far, newest first, and reloads the DHCP server if asked to
+func (t *txn) rollback(e *SaveError, reload func() error) error {
+	for i := len(t.touched) - 1; i >= 0; i-- {
+		file := t.touched[i]
+		bak := t.backups[file]
+
+		var err error
+		if bak == "" {
+			// It didn't exist before the save
+			err = os.Remove(file)
+			if os.IsNotExist(err) {
+				err = nil
+			}
+		} else {
+			err = os.Rename(bak, file)
+		}
+		if err != nil && e.Rollback == nil {
+			e.Rollback = err
+		}
+	}
+	t.touched = nil
+	t.backups = map[string]string{}
+
+	if reload != nil && e.Rollback == nil {
+		if err := reload(); err != nil {
+			e.Rollback = fmt.Errorf("reloading the previous files: %s", err)
+		}
+	}
+	return e
+}
+
+// commit drops the previous generation, the save is done
+func (t *txn) commit() {
+	for _, bak := range t.backups {
+		if bak != "" {
+			os.Remove(bak)
+		}
+	}
+	t.touched = nil
+	t.backups = map[string]string{}
+}
+
+// cleanup removes staged files that were never swapped in
+func (t *txn) cleanup() {
+	for _, s := range t.staged {
+		os.Remove(s.tmp)
+	}
+}
+
+// copyFile copies src to dst, mode included
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	fi, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, fi.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,68 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyRollsBackFailedReload(t *testing.T) {
+	dir := t.TempDir()
+	changed := filepath.Join(dir, "dhcpd.conf")
+	added := filepath.Join(dir, "sw2.conf")
+	deleted := filepath.Join(dir, "sw1.conf")
+	for file, content := range map[string]string{changed: "old dhcpd\n", deleted: "old sw1\n"} {
+		if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reloads := 0
+	reload := func() error {
+		reloads++
+		if reloads == 1 {
+			return errors.New("dhcpd didn't come back")
+		}
+		return nil
+	}
+
+	p := Plan{
+		Writes:  []Artifact{{Path: changed, Content: "new dhcpd\n"}, {Path: added, Content: "new sw2\n"}},
+		Deletes: []string{deleted},
+	}
+	err := p.Apply(reload)
+
+	se, ok := err.(*SaveError)
+	if !ok || se.Step != "reload" || se.Rollback != nil {
+		t.Fatalf("Apply returned %#v, expected a reload SaveError without a rollback error", err)
+	}
+	if reloads != 2 {
+		t.Errorf("reload ran %d times, expected once for the new files and once for the old ones", reloads)
+	}
+
+	for file, want := range map[string]string{changed: "old dhcpd\n", deleted: "old sw1\n"} {
+		if b, err := ioutil.ReadFile(file); err != nil || string(b) != want {
+			t.Errorf("%s holds %q (%v), expected it put back as %q", filepath.Base(file), b, err, want)
+		}
+	}
+	if _, err := os.Stat(added); !os.IsNotExist(err) {
+		t.Errorf("%s is left behind, it didn't exist before the save", filepath.Base(added))
+	}
+
+	// No staged files or backups are left over
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		names := []string{}
+		for _, f := range files {
+			names = append(names, f.Name())
+		}
+		t.Errorf("directory holds %v, expected only dhcpd.conf and sw1.conf", names)
+	}
+}
@@ -0,0 +1,214 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"time"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+	"github.com/networkbootstrap/ztpmanagercode/templategen"
+)
+
+// TemplatesDir returns the directory the vendor templates live in
+func (c Cfg) TemplatesDir() string {
+	if c.Core.TemplatesLocation == "" {
+		return "./templates"
+	}
+	return c.Core.TemplatesLocation
+}
+
+// ConfigFileName returns the name a host's rendered config is saved under, as chosen by its vendor
+func ConfigFileName(h rt.Hosts) string {
+	if v, err := templategen.Lookup(h.Vendor); err == nil {
+		return v.ConfigFile(h.HostName)
+	}
+	return h.HostName + ".conf"
+}
+
+// DeviceFiles returns the names of everything generated for a host in the configs directory
+func DeviceFiles(h rt.Hosts) []string {
+	files := []string{ConfigFileName(h)}
+	if v, err := templategen.Lookup(h.Vendor); err == nil {
+		if sv, ok := v.(templategen.Scripter); ok {
+			for _, s := range sv.Scripts(h.HostName) {
+				files = append(files, s.File)
+			}
+		}
+	}
+	return files
+}
+
+// CheckVendors makes sure every host with a vendor set has one that is registered
+func (c Cfg) CheckVendors() error {
+	for _, k := range c.sortedHostKeys() {
+		h := c.Hosts[k]
+		if h.Vendor == "" {
+			continue
+		}
+		if _, err := templategen.Lookup(h.Vendor); err != nil {
+			return fmt.Errorf("host %s: %s", k, err)
+		}
+		// Role and model end up in template paths
+		if err := templategen.CheckPathPart(h.Role); err != nil {
+			return fmt.Errorf("host %s has an invalid role: %s", k, err)
+		}
+		if err := templategen.CheckPathPart(h.Model); err != nil {
+			return fmt.Errorf("host %s has an invalid model: %s", k, err)
+		}
+	}
+	return nil
+}
+
+// HostPayload returns the template payload for a host, filled in from the scopes it lives in
+func (c Cfg) HostPayload(h rt.Hosts) templategen.TemplatePayload {
+	scope, _ := c.ScopeFor(h.Key())
+	scope6, _ := c.ScopeFor(h.FixedIPv6)
+
+	p := templategen.TemplatePayload{}
+	p.DNSServers = scope.DNSServers
+	p.DomainName = c.Core.DomainName
+	p.Gateway = scope.SubnetRouter
+	p.NTPServers = scope.NTPServers
+	p.FixedIP = h.FixedIP
+	p.PrefixLength = scope.PrefixLength()
+	p.SubnetMask = scope.SubnetMask
+	p.FixedIPv6 = h.FixedIPv6
+	p.PrefixLength6 = scope6.PrefixLength6()
+	p.Gateway6 = scope6.SubnetRouter6
+	p.HostName = h.HostName
+	p.Model = h.Model
+	p.Role = h.Role
+	p.Vars = c.HostVars(h)
+
+	// IPv6-only hosts fetch their files over IPv6
+	p.FileServer = scope.FileServer
+	if h.FixedIP == "" {
+		p.FileServer = c.fileServer6(scope6)
+	}
+	p.ConfigURL, p.ImageURL = c.HostURLs(h, p.FileServer)
+	if h.CfgImage != "" {
+		p.ImageFile = path.Base(h.CfgImage)
+		p.ImageMD5 = imageMD5(filepath.Join(c.Core.FileImagesLocation, p.ImageFile))
+	}
+	return p
+}
+
+// Images are big and rarely change, so their checksums are kept until the file does
+type md5Entry struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+var (
+	md5Mu    sync.Mutex
+	md5Cache = map[string]md5Entry{}
+)
+
+// imageMD5 returns the MD5 of the image file as hex, or an empty string if it can't be read
+func imageMD5(file string) string {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return ""
+	}
+
+	md5Mu.Lock()
+	defer md5Mu.Unlock()
+
+	if e, ok := md5Cache[file]; ok && e.size == fi.Size() && e.modTime.Equal(fi.ModTime()) {
+		return e.sum
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return ""
+	}
+	sum := hex.EncodeToString(h.Sum(nil))
+	md5Cache[file] = md5Entry{size: fi.Size(), modTime: fi.ModTime(), sum: sum}
+	return sum
+}
+
+// HostOptions returns the vendor DHCP options for a host in scope s. Hosts without a vendor get none.
+func (c Cfg) HostOptions(h rt.Hosts, s ScopeCfg) []templategen.DHCPOption {
+	v, err := templategen.Lookup(h.Vendor)
+	if err != nil {
+		return nil
+	}
+	h.CfgFile, h.CfgImage = c.HostFiles(h)
+	return v.DHCPOptions(h, s.FileServer)
+}
+
+// HostTemplate returns the device config template for a host. The most specific one that exists wins:
+// <vendor dir>/<model>/<role>.template, then <vendor dir>/<role>.template, then the vendor default.
+func (c Cfg) HostTemplate(v templategen.Vendor, h rt.Hosts) string {
+	def := filepath.Join(c.TemplatesDir(), v.Template())
+	dir := filepath.Dir(def)
+
+	candidates := []string{}
+	if h.Role != "" {
+		if h.Model != "" {
+			candidates = append(candidates, filepath.Join(dir, h.Model, h.Role+".template"))
+		}
+		candidates = append(candidates, filepath.Join(dir, h.Role+".template"))
+	}
+
+	for _, t := range candidates {
+		if _, err := os.Stat(t); err == nil {
+			return t
+		}
+	}
+	return def
+}
+
+// GenerateDevice returns the device configuration for a host rendered from its vendor template,
+// followed by any scripts the vendor needs. Nothing is written to disk.
+func (c Cfg) GenerateDevice(h rt.Hosts) ([]Artifact, error) {
+	v, err := templategen.Lookup(h.Vendor)
+	if err != nil {
+		return nil, err
+	}
+	// Hosts from the config file or the database haven't been through the API's checks
+	if err = templategen.CheckPathPart(h.Role); err != nil {
+		return nil, fmt.Errorf("invalid role: %s", err)
+	}
+	if err = templategen.CheckPathPart(h.Model); err != nil {
+		return nil, fmt.Errorf("invalid model: %s", err)
+	}
+	payload := v.Payload(c.HostPayload(h))
+
+	b, err := templategen.Execute(c.HostTemplate(v, h), payload)
+	if err != nil {
+		return nil, err
+	}
+	artifacts := []Artifact{{Path: filepath.Join(c.Core.FileConfigsLocation, v.ConfigFile(h.HostName)), Content: string(b)}}
+
+	sv, ok := v.(templategen.Scripter)
+	if !ok {
+		return artifacts, nil
+	}
+	for _, s := range sv.Scripts(h.HostName) {
+		b, err := templategen.Execute(filepath.Join(c.TemplatesDir(), s.Template), payload)
+		if err != nil {
+			return nil, err
+		}
+		if s.Fixup != nil {
+			b = s.Fixup(b)
+		}
+		artifacts = append(artifacts, Artifact{Path: filepath.Join(c.Core.FileConfigsLocation, s.File), Content: string(b)})
+	}
+	return artifacts, nil
+}
@@ -0,0 +1,26 @@
+// Protected by BSD 3 clause license
+
+package cfg
+
+import (
+	"testing"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+func TestGenerateDeviceChecksPathParts(t *testing.T) {
+	c := labCfg()
+	for _, h := range []rt.Hosts{
+		{FixedIP: "10.9.0.10", HostName: "sw1", Vendor: "junos", Role: "../../etc/passwd"},
+		{FixedIP: "10.9.0.10", HostName: "sw1", Vendor: "junos", Role: "leaf", Model: `qfx\5100`},
+	} {
+		if _, err := c.GenerateDevice(h); err == nil {
+			t.Errorf("role %q and model %q were used in a template path", h.Role, h.Model)
+		}
+	}
+
+	h := rt.Hosts{FixedIP: "10.9.0.10", HostName: "sw1", Vendor: "junos", Role: "leaf", Model: "qfx5100"}
+	if _, err := c.GenerateDevice(h); err != nil {
+		t.Errorf("role %q and model %q were refused: %s", h.Role, h.Model, err)
+	}
+}
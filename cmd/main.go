@@ -12,7 +12,15 @@ import (
 
 	"github.com/networkbootstrap/ztpmanagercode/cache"
 	"github.com/networkbootstrap/ztpmanagercode/cfg"
+	"github.com/networkbootstrap/ztpmanagercode/dhcpserver"
+	"github.com/networkbootstrap/ztpmanagercode/events"
 	"github.com/networkbootstrap/ztpmanagercode/rest"
+
+	// Device vendors register themselves with templategen
+	_ "github.com/networkbootstrap/ztpmanagercode/templategen/arista"
+	_ "github.com/networkbootstrap/ztpmanagercode/templategen/cisco"
+	_ "github.com/networkbootstrap/ztpmanagercode/templategen/junos"
+	_ "github.com/networkbootstrap/ztpmanagercode/templategen/onie"
 )
 
 const version = "0.0.1"
@@ -41,17 +49,43 @@ func main() {
 
 	wg := sync.WaitGroup{}
 
-	wg.Add(1)
-	// Create cache (launches a GR) and returns communications channels
-	cachesend, cachefinish := cache.Create(config.Hosts, &wg)
+	// Create the host store, the config can't have two hosts with the same ethernet address or hostname.
+	// With a host database, the hosts and groups in it win over the ones in the config file.
+	var store *cache.Store
+	if config.Core.HostDB == "" {
+		store, err = cache.New(config.Hosts)
+	} else {
+		store, err = openHostDB(&config)
+	}
+	if err != nil {
+		panic(err)
+	}
+	// Host changes and saves are published to the event stream
+	bus := events.NewBroker()
+	store.SetBroker(bus)
+
+	// The embedded DHCP server answers from the store, so it has to come up after it
+	backend, err := config.Backend()
+	if err != nil {
+		panic(err)
+	}
+	dhcpsrv := dhcpserver.New(config, store)
+	if backend.Name() == "embedded" {
+		err = dhcpsrv.Start()
+		if err != nil {
+			panic(err)
+		}
+		fmt.Printf("Embedded DHCP server started at: %s\n", dhcpsrv.Addr)
+	}
+
 	wg.Add(1)
 	// Create APIResponder (config service) (launches a GR) and returns communications channels
-	configsend, configfinish := config.APIResponder(cachesend, *configfile, &wg)
+	configsend, configfinish := config.APIResponder(store, bus, *configfile, &wg)
 	// Create configuration REST JSON service (launches a GR) and returns an Echo instance and error
-	cfgapi, err := rest.StartCfgAPI(cachesend, configsend, config.Core.ServerPort, config.Core.HTTPUser, config.Core.HTTPPasswd)
+	cfgapi, err := rest.StartCfgAPI(store, bus, configsend, config.Core.ServerPort, config.Core.HTTPUser, config.Core.HTTPPasswd)
 	if err != nil {
 		// Close everything else down
-		close(cachefinish)
+		dhcpsrv.Close()
 		close(configfinish)
 		wg.Wait()
 		os.Exit(1)
@@ -59,11 +93,11 @@ func main() {
 	fmt.Printf("JSON API started at: %s:%v\n", config.Core.ServerURL, config.Core.ServerPort)
 
 	// Create configuration REST static file service on port 80 (launches a GR) and returns an Echo instance and error
-	fileapi, err := rest.StartStaticAPI(config.Core.FileConfigsLocation, config.Core.FileImagesLocation, config.Core.HTTPConfigsLocation, config.Core.HTTPImagesLocation)
+	fileapi, err := rest.StartStaticAPI(store, config.Core.FileConfigsLocation, config.Core.FileImagesLocation, config.Core.HTTPConfigsLocation, config.Core.HTTPImagesLocation)
 	if err != nil {
 		// Close everything else down
 		cfgapi.Close()
-		close(cachefinish)
+		dhcpsrv.Close()
 		close(configfinish)
 		wg.Wait()
 		os.Exit(1)
@@ -80,7 +114,38 @@ func main() {
 	// Close everything else down
 	fileapi.Close()
 	cfgapi.Close()
-	close(cachefinish)
+	dhcpsrv.Close()
 	close(configfinish)
 	wg.Wait()
+	store.Close()
+}
+
+// openHostDB opens the host store on the host database and takes the groups from it.
+// The first time round, it's filled from the config file.
+func openHostDB(config *cfg.Cfg) (*cache.Store, error) {
+	db, err := cache.OpenBolt(config.Core.HostDB)
+	if err != nil {
+		return nil, err
+	}
+	store, seeded, err := cache.Open(db, config.Hosts)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if seeded {
+		fmt.Printf("Host database %s created from the config file\n", config.Core.HostDB)
+	} else {
+		fmt.Printf("Hosts loaded from %s, the hosts in the config file aren't used\n", config.Core.HostDB)
+	}
+
+	// Databases from before groups were kept get the config file's groups
+	seeded, err = config.LoadGroups(store)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+	if !seeded {
+		fmt.Printf("Groups loaded from %s, the groups in the config file aren't used\n", config.Core.HostDB)
+	}
+	return store, nil
 }
@@ -0,0 +1,147 @@
+// Protected by BSD 3 clause license
+
+package dhcpserver
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// How long an offered address is held for a client before it has to REQUEST it
+const offerHold = 60 * time.Second
+
+type lease struct {
+	mac    string
+	ip     uint32
+	expiry time.Time
+}
+
+// pool hands out addresses from the dynamic (non-ZTP) range of a single scope
+type pool struct {
+	sync.Mutex
+	low, high uint32
+	byMAC     map[string]*lease
+	byIP      map[uint32]*lease
+}
+
+func newPool(low, high string) *pool {
+	l := net.ParseIP(low).To4()
+	h := net.ParseIP(high).To4()
+	if l == nil || h == nil {
+		return nil
+	}
+	return &pool{
+		low:   binary.BigEndian.Uint32(l),
+		high:  binary.BigEndian.Uint32(h),
+		byMAC: map[string]*lease{},
+		byIP:  map[uint32]*lease{},
+	}
+}
+
+func ipToUint(ip net.IP) uint32 {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(ip4)
+}
+
+func uintToIP(u uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, u)
+	return ip
+}
+
+// inRange returns true if ip is inside the dynamic range
+func (p *pool) inRange(ip uint32) bool {
+	return ip >= p.low && ip <= p.high
+}
+
+// free returns true if nobody but mac holds ip
+func (p *pool) free(ip uint32, mac string, now time.Time) bool {
+	l, ok := p.byIP[ip]
+	return !ok || l.mac == mac || now.After(l.expiry)
+}
+
+// offer picks an address for mac, preferring its current lease, then the requested address, then the first free one.
+// The address is held for offerHold so another client can't grab it before the REQUEST.
+func (p *pool) offer(mac string, requested net.IP) net.IP {
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+
+	if l, ok := p.byMAC[mac]; ok {
+		if l.expiry.Before(now.Add(offerHold)) {
+			l.expiry = now.Add(offerHold)
+		}
+		return uintToIP(l.ip)
+	}
+
+	candidate := uint32(0)
+	if r := ipToUint(requested); r != 0 && p.inRange(r) && p.free(r, mac, now) {
+		candidate = r
+	}
+	for ip := p.low; candidate == 0 && ip <= p.high && ip != 0; ip++ {
+		if p.free(ip, mac, now) {
+			candidate = ip
+		}
+	}
+	if candidate == 0 {
+		return nil
+	}
+
+	p.bind(mac, candidate, now.Add(offerHold))
+	return uintToIP(candidate)
+}
+
+// confirm turns a held or existing address into a lease of duration d. Returns false if ip can't be given to mac.
+func (p *pool) confirm(mac string, ip net.IP, d time.Duration) bool {
+	p.Lock()
+	defer p.Unlock()
+	now := time.Now()
+
+	u := ipToUint(ip)
+	if u == 0 || !p.inRange(u) || !p.free(u, mac, now) {
+		return false
+	}
+	p.bind(mac, u, now.Add(d))
+	return true
+}
+
+// release drops whatever mac holds
+func (p *pool) release(mac string) {
+	p.Lock()
+	defer p.Unlock()
+	if l, ok := p.byMAC[mac]; ok {
+		delete(p.byIP, l.ip)
+		delete(p.byMAC, mac)
+	}
+}
+
+// decline marks ip as in use by something we don't know about, so it isn't offered again for a while
+func (p *pool) decline(mac string, ip net.IP, d time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+	if l, ok := p.byMAC[mac]; ok {
+		delete(p.byIP, l.ip)
+		delete(p.byMAC, mac)
+	}
+	u := ipToUint(ip)
+	if p.inRange(u) {
+		p.byIP[u] = &lease{mac: "", ip: u, expiry: time.Now().Add(d)}
+	}
+}
+
+func (p *pool) bind(mac string, ip uint32, expiry time.Time) {
+	if l, ok := p.byMAC[mac]; ok {
+		delete(p.byIP, l.ip)
+	}
+	if l, ok := p.byIP[ip]; ok {
+		delete(p.byMAC, l.mac)
+	}
+	l := &lease{mac: mac, ip: ip, expiry: expiry}
+	p.byMAC[mac] = l
+	p.byIP[ip] = l
+}
@@ -0,0 +1,50 @@
+// Protected by BSD 3 clause license
+
+//go:build linux
+// +build linux
+
+package dhcpserver
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listen opens a UDP socket that can send broadcasts and is optionally bound to a single interface,
+// so replies to clients without an address go out of the right port.
+func listen(addr string, iface string) (net.PacketConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp4", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM, syscall.IPPROTO_UDP)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err == nil {
+		err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+	}
+	if err == nil && iface != "" {
+		err = syscall.BindToDevice(fd, iface)
+	}
+	if err == nil {
+		sa := &syscall.SockaddrInet4{Port: udpAddr.Port}
+		if ip := udpAddr.IP.To4(); ip != nil {
+			copy(sa.Addr[:], ip)
+		}
+		err = syscall.Bind(fd, sa)
+	}
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	f := os.NewFile(uintptr(fd), "dhcp4")
+	conn, err := net.FilePacketConn(f)
+	// FilePacketConn dups the descriptor, so ours can go
+	f.Close()
+	return conn, err
+}
@@ -0,0 +1,16 @@
+// Protected by BSD 3 clause license
+
+//go:build !linux
+// +build !linux
+
+package dhcpserver
+
+import (
+	"net"
+)
+
+// listen opens a plain UDP socket. Binding to an interface and sending broadcasts
+// need socket options only wired up on Linux, so iface is ignored here.
+func listen(addr string, iface string) (net.PacketConn, error) {
+	return net.ListenPacket("udp4", addr)
+}
@@ -0,0 +1,241 @@
+// Protected by BSD 3 clause license
+
+package dhcpserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sort"
+)
+
+// BOOTP op codes
+const (
+	BootRequest = 1
+	BootReply   = 2
+)
+
+// DHCP message types (option 53)
+const (
+	Discover = 1
+	Offer    = 2
+	Request  = 3
+	Decline  = 4
+	Ack      = 5
+	Nak      = 6
+	Release  = 7
+	Inform   = 8
+)
+
+// DHCP option codes used by the server
+const (
+	OptPad            = 0
+	OptSubnetMask     = 1
+	OptRouter         = 3
+	OptDNSServers     = 6
+	OptHostName       = 12
+	OptDomainName     = 15
+	OptNTPServers     = 42
+	OptVendorSpecific = 43
+	OptRequestedIP    = 50
+	OptLeaseTime      = 51
+	OptMessageType    = 53
+	OptServerID       = 54
+	OptParameterList  = 55
+	OptRelayAgentInfo = 82
+	OptZTPFileServer  = 150
+	OptEnd            = 255
+)
+
+const (
+	minPacketLength     = 300
+	fixedHeaderLength   = 236
+	magicCookieLength   = 4
+	maxHardwareAddrSize = 16
+)
+
+var magicCookie = []byte{99, 130, 83, 99}
+
+// Packet holds a decoded DHCPv4 message
+type Packet struct {
+	Op      byte
+	HType   byte
+	HLen    byte
+	Hops    byte
+	XID     uint32
+	Secs    uint16
+	Flags   uint16
+	CIAddr  net.IP
+	YIAddr  net.IP
+	SIAddr  net.IP
+	GIAddr  net.IP
+	CHAddr  net.HardwareAddr
+	SName   string
+	File    string
+	Options map[byte][]byte
+}
+
+// ErrMalformed is returned when a packet is too short or has no magic cookie
+var ErrMalformed = errors.New("malformed DHCP packet")
+
+// ParsePacket decodes a DHCPv4 message from b
+func ParsePacket(b []byte) (*Packet, error) {
+	if len(b) < fixedHeaderLength+magicCookieLength {
+		return nil, ErrMalformed
+	}
+	if !bytes.Equal(b[fixedHeaderLength:fixedHeaderLength+magicCookieLength], magicCookie) {
+		return nil, ErrMalformed
+	}
+
+	p := &Packet{
+		Op:      b[0],
+		HType:   b[1],
+		HLen:    b[2],
+		Hops:    b[3],
+		XID:     binary.BigEndian.Uint32(b[4:8]),
+		Secs:    binary.BigEndian.Uint16(b[8:10]),
+		Flags:   binary.BigEndian.Uint16(b[10:12]),
+		CIAddr:  net.IP(append([]byte{}, b[12:16]...)),
+		YIAddr:  net.IP(append([]byte{}, b[16:20]...)),
+		SIAddr:  net.IP(append([]byte{}, b[20:24]...)),
+		GIAddr:  net.IP(append([]byte{}, b[24:28]...)),
+		SName:   string(bytes.TrimRight(b[44:108], "\x00")),
+		File:    string(bytes.TrimRight(b[108:236], "\x00")),
+		Options: map[byte][]byte{},
+	}
+
+	hlen := int(p.HLen)
+	if hlen > maxHardwareAddrSize {
+		return nil, ErrMalformed
+	}
+	p.CHAddr = net.HardwareAddr(append([]byte{}, b[28:28+hlen]...))
+
+	opts := b[fixedHeaderLength+magicCookieLength:]
+	for i := 0; i < len(opts); {
+		code := opts[i]
+		if code == OptEnd {
+			break
+		}
+		if code == OptPad {
+			i++
+			continue
+		}
+		if i+1 >= len(opts) {
+			return nil, ErrMalformed
+		}
+		l := int(opts[i+1])
+		if i+2+l > len(opts) {
+			return nil, ErrMalformed
+		}
+		// Options longer than 255 bytes are split, RFC 3396 says to concatenate them
+		p.Options[code] = append(p.Options[code], opts[i+2:i+2+l]...)
+		i += 2 + l
+	}
+
+	return p, nil
+}
+
+// MessageType returns the value of option 53, or 0 if it is missing
+func (p *Packet) MessageType() byte {
+	if v, ok := p.Options[OptMessageType]; ok && len(v) == 1 {
+		return v[0]
+	}
+	return 0
+}
+
+// Broadcast returns true if the client asked for replies to be broadcast
+func (p *Packet) Broadcast() bool {
+	return p.Flags&0x8000 != 0
+}
+
+// Marshal encodes the packet, padding it to the minimum BOOTP length
+func (p *Packet) Marshal() []byte {
+	b := make([]byte, fixedHeaderLength, minPacketLength)
+	b[0] = p.Op
+	b[1] = p.HType
+	b[2] = p.HLen
+	b[3] = p.Hops
+	binary.BigEndian.PutUint32(b[4:8], p.XID)
+	binary.BigEndian.PutUint16(b[8:10], p.Secs)
+	binary.BigEndian.PutUint16(b[10:12], p.Flags)
+	copy(b[12:16], p.CIAddr.To4())
+	copy(b[16:20], p.YIAddr.To4())
+	copy(b[20:24], p.SIAddr.To4())
+	copy(b[24:28], p.GIAddr.To4())
+	copy(b[28:44], p.CHAddr)
+	copy(b[44:108], p.SName)
+	copy(b[108:236], p.File)
+	b = append(b, magicCookie...)
+
+	// Message type goes first, the rest in code order so replies are stable
+	codes := []int{}
+	for code := range p.Options {
+		if code != OptMessageType {
+			codes = append(codes, int(code))
+		}
+	}
+	sort.Ints(codes)
+	if v, ok := p.Options[OptMessageType]; ok {
+		b = appendOption(b, OptMessageType, v)
+	}
+	for _, code := range codes {
+		b = appendOption(b, byte(code), p.Options[byte(code)])
+	}
+	b = append(b, OptEnd)
+
+	for len(b) < minPacketLength {
+		b = append(b, OptPad)
+	}
+	return b
+}
+
+// appendOption writes a single option, splitting values longer than 255 bytes
+func appendOption(b []byte, code byte, v []byte) []byte {
+	for {
+		l := len(v)
+		if l > 255 {
+			l = 255
+		}
+		b = append(b, code, byte(l))
+		b = append(b, v[:l]...)
+		v = v[l:]
+		if len(v) == 0 {
+			return b
+		}
+	}
+}
+
+// EncodeIPs returns the option value for a list of addresses, skipping anything that isn't IPv4
+func EncodeIPs(ips ...string) []byte {
+	b := []byte{}
+	for _, s := range ips {
+		if ip := net.ParseIP(s).To4(); ip != nil {
+			b = append(b, ip...)
+		}
+	}
+	return b
+}
+
+// EncodeSubOptions returns an encapsulated option value (option 43 style) from code and value pairs
+func EncodeSubOptions(sub map[byte]string) []byte {
+	codes := []int{}
+	for code := range sub {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+
+	b := []byte{}
+	for _, code := range codes {
+		v := sub[byte(code)]
+		if v == "" {
+			continue
+		}
+		if len(v) > 255 {
+			v = v[:255]
+		}
+		b = append(b, byte(code), byte(len(v)))
+		b = append(b, v...)
+	}
+	return b
+}
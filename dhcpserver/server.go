@@ -0,0 +1,318 @@
+// Protected by BSD 3 clause license
+
+// Package dhcpserver implements a small DHCPv4 server that answers straight from the host store.
+// ZTP hosts get their fixed reservation with the ezjunosztp option 43 sub-options and the option 150
+// file server. Everybody else gets an address from the dynamic range of the scope they're in.
+// Host changes take effect on the next DHCP exchange, there's nothing to render or restart.
+package dhcpserver
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/networkbootstrap/ztpmanagercode/cache"
+	"github.com/networkbootstrap/ztpmanagercode/cfg"
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+const (
+	serverPort = 67
+	clientPort = 68
+	// How long a declined address is kept out of the pool
+	declineHold = 10 * time.Minute
+)
+
+// Server is the embedded DHCPv4 server
+type Server struct {
+	Addr       string // Address to listen on, ":67" unless set
+	Iface      string // Interface to bind to, all interfaces if empty
+	ClientPort int    // Port replies are sent to, 68 unless set
+
+	cfg      cfg.Cfg
+	store    *cache.Store
+	conn     net.PacketConn
+	serverID net.IP
+	local    cfg.ScopeCfg
+	pools    map[string]*pool
+}
+
+// New returns a Server for the scopes in c which looks hosts up in store
+func New(c cfg.Cfg, store *cache.Store) *Server {
+	s := &Server{
+		Addr:       c.Core.DHCPListen,
+		ClientPort: clientPort,
+		cfg:        c,
+		store:      store,
+		pools:      map[string]*pool{},
+	}
+	if s.Addr == "" {
+		s.Addr = fmt.Sprintf(":%v", serverPort)
+	}
+	// SO_BINDTODEVICE only takes a single interface
+	if ifaces := strings.Fields(c.Core.DHCPIface); len(ifaces) == 1 {
+		s.Iface = ifaces[0]
+	}
+	return s
+}
+
+// Start opens the socket and serves requests in a GR until Close is called
+func (s *Server) Start() error {
+	s.serverID = net.ParseIP(s.cfg.Core.FileServer).To4()
+	if s.serverID == nil {
+		return fmt.Errorf("embedded DHCP server needs FileServer in [Core] to be the IPv4 address of this server, got %q", s.cfg.Core.FileServer)
+	}
+
+	scopes := s.cfg.AllScopes()
+	if len(scopes) == 0 {
+		return errors.New("embedded DHCP server has no scopes to serve")
+	}
+	// Clients that aren't relayed are on the segment the server sits on
+	s.local = scopes[0]
+	for i := len(scopes) - 1; i >= 0; i-- {
+		if scopes[i].IsV4() {
+			s.local = scopes[i]
+		}
+	}
+	for _, scope := range scopes {
+		if scope.Contains(s.serverID.String()) {
+			s.local = scope
+		}
+		if p := newPool(scope.NonCfgRangeLow, scope.NonCfgRangeHigh); p != nil {
+			s.pools[scope.Name] = p
+		}
+	}
+
+	conn, err := listen(s.Addr, s.Iface)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+
+	go s.serve()
+	return nil
+}
+
+// Close stops the server
+func (s *Server) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
+func (s *Server) serve() {
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := s.conn.ReadFrom(buf)
+		if err != nil {
+			// Closed underneath us, we're done here
+			return
+		}
+
+		req, err := ParsePacket(buf[:n])
+		if err != nil || req.Op != BootRequest {
+			continue
+		}
+
+		reply := s.handle(req)
+		if reply == nil {
+			continue
+		}
+
+		if _, err := s.conn.WriteTo(reply.Marshal(), s.destination(req, reply)); err != nil {
+			fmt.Printf("Issue sending DHCP reply to %s: %s \n", req.CHAddr, err)
+		}
+	}
+}
+
+// handle returns the reply for req, or nil if there's nothing to say
+func (s *Server) handle(req *Packet) *Packet {
+	mac := req.CHAddr.String()
+	host, reserved := s.lookup(mac)
+
+	requested := net.IP(req.Options[OptRequestedIP])
+	if len(requested) != net.IPv4len {
+		requested = req.CIAddr
+	}
+
+	switch req.MessageType() {
+	case Discover:
+		if reserved {
+			scope, err := s.cfg.ScopeFor(host.FixedIP)
+			if err != nil {
+				return nil
+			}
+			return s.reply(req, Offer, net.ParseIP(host.FixedIP), scope, &host)
+		}
+		scope := s.scopeOf(req)
+		p, ok := s.pools[scope.Name]
+		if !ok {
+			return nil
+		}
+		ip := p.offer(mac, requested)
+		if ip == nil {
+			fmt.Printf("No free addresses left in DHCP scope %s for %s \n", scope.Name, mac)
+			return nil
+		}
+		return s.reply(req, Offer, ip, scope, nil)
+
+	case Request:
+		// The client picked another server's offer
+		if id, ok := req.Options[OptServerID]; ok && !net.IP(id).Equal(s.serverID) {
+			return nil
+		}
+		if reserved {
+			scope, err := s.cfg.ScopeFor(host.FixedIP)
+			if err != nil || !requested.Equal(net.ParseIP(host.FixedIP)) {
+				return s.nak(req)
+			}
+			return s.reply(req, Ack, requested, scope, &host)
+		}
+		scope := s.scopeOf(req)
+		p, ok := s.pools[scope.Name]
+		if !ok || !p.confirm(mac, requested, s.leaseTime()) {
+			return s.nak(req)
+		}
+		return s.reply(req, Ack, requested, scope, nil)
+
+	case Release:
+		if p, ok := s.pools[s.scopeOf(req).Name]; ok && !reserved {
+			p.release(mac)
+		}
+
+	case Decline:
+		if p, ok := s.pools[s.scopeOf(req).Name]; ok && !reserved {
+			p.decline(mac, requested, declineHold)
+		}
+
+	case Inform:
+		scope := s.scopeOf(req)
+		var h *rt.Hosts
+		if reserved {
+			h = &host
+		}
+		reply := s.reply(req, Ack, nil, scope, h)
+		delete(reply.Options, OptLeaseTime)
+		return reply
+	}
+
+	return nil
+}
+
+// lookup asks the store for the host with ethernet address mac
+func (s *Server) lookup(mac string) (rt.Hosts, bool) {
+	h, err := s.store.GetByMAC(mac)
+	return h, err == nil
+}
+
+// scopeOf returns the scope a client that isn't reserved belongs to: the relay's scope, or the local one
+func (s *Server) scopeOf(req *Packet) cfg.ScopeCfg {
+	if !req.GIAddr.IsUnspecified() {
+		if scope, err := s.cfg.ScopeFor(req.GIAddr.String()); err == nil {
+			return scope
+		}
+	}
+	return s.local
+}
+
+func (s *Server) leaseTime() time.Duration {
+	if s.cfg.Core.DefaultLease <= 0 {
+		return 600 * time.Second
+	}
+	return time.Duration(s.cfg.Core.DefaultLease) * time.Second
+}
+
+// reply builds an OFFER or ACK carrying the scope options, plus the ZTP options if h is set
+func (s *Server) reply(req *Packet, msgType byte, yiaddr net.IP, scope cfg.ScopeCfg, h *rt.Hosts) *Packet {
+	p := s.newReply(req, msgType)
+	p.YIAddr = yiaddr
+
+	lease := make([]byte, 4)
+	binary.BigEndian.PutUint32(lease, uint32(s.leaseTime()/time.Second))
+	p.Options[OptLeaseTime] = lease
+
+	if n, err := scope.Network(); err == nil {
+		p.Options[OptSubnetMask] = []byte(n.Mask)
+	}
+	if v := EncodeIPs(scope.SubnetRouter); len(v) > 0 {
+		p.Options[OptRouter] = v
+	}
+	if v := EncodeIPs(scope.DNSServers...); len(v) > 0 {
+		p.Options[OptDNSServers] = v
+	}
+	if v := EncodeIPs(scope.NTPServers...); len(v) > 0 {
+		p.Options[OptNTPServers] = v
+	}
+	if s.cfg.Core.DomainName != "" {
+		p.Options[OptDomainName] = []byte(s.cfg.Core.DomainName)
+	}
+
+	if h != nil {
+		p.Options[OptHostName] = []byte(h.HostName)
+		if v := EncodeIPs(scope.FileServer); len(v) > 0 {
+			p.Options[OptZTPFileServer] = v
+		}
+
+		// Whatever the host's vendor asks for goes on top
+		sub := map[byte]string{3: s.cfg.Core.TransferMode}
+		for _, o := range s.cfg.HostOptions(*h, scope) {
+			switch {
+			case o.Encap:
+				sub[byte(o.Code)] = o.Value
+			case o.Type == "ip-address":
+				p.Options[byte(o.Code)] = EncodeIPs(o.Value)
+			default:
+				p.Options[byte(o.Code)] = []byte(o.Value)
+			}
+		}
+		p.Options[OptVendorSpecific] = EncodeSubOptions(sub)
+	}
+
+	return p
+}
+
+func (s *Server) nak(req *Packet) *Packet {
+	p := s.newReply(req, Nak)
+	// The client may not have an address yet, so relays have to broadcast it
+	if !req.GIAddr.IsUnspecified() {
+		p.Flags |= 0x8000
+	}
+	return p
+}
+
+func (s *Server) newReply(req *Packet, msgType byte) *Packet {
+	p := &Packet{
+		Op:      BootReply,
+		HType:   req.HType,
+		HLen:    req.HLen,
+		XID:     req.XID,
+		Flags:   req.Flags,
+		CIAddr:  req.CIAddr,
+		GIAddr:  req.GIAddr,
+		CHAddr:  req.CHAddr,
+		Options: map[byte][]byte{},
+	}
+	p.Options[OptMessageType] = []byte{msgType}
+	p.Options[OptServerID] = []byte(s.serverID)
+	// RFC 3046: relay agent information goes back as it came in
+	if v, ok := req.Options[OptRelayAgentInfo]; ok {
+		p.Options[OptRelayAgentInfo] = v
+	}
+	return p
+}
+
+// destination works out where a reply goes as per RFC 2131 section 4.1
+func (s *Server) destination(req *Packet, reply *Packet) net.Addr {
+	if !req.GIAddr.IsUnspecified() {
+		return &net.UDPAddr{IP: req.GIAddr, Port: serverPort}
+	}
+	if !req.CIAddr.IsUnspecified() && reply.MessageType() != Nak {
+		return &net.UDPAddr{IP: req.CIAddr, Port: s.ClientPort}
+	}
+	// The client has no address yet, and we can't unicast to it without an ARP entry
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: s.ClientPort}
+}
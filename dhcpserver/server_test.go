@@ -0,0 +1,208 @@
+// Protected by BSD 3 clause license
+
+package dhcpserver
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/networkbootstrap/ztpmanagercode/cache"
+	"github.com/networkbootstrap/ztpmanagercode/cfg"
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+	_ "github.com/networkbootstrap/ztpmanagercode/templategen/junos"
+)
+
+// client is a DHCP client on the loopback, talking to a server started by startServer
+type client struct {
+	t      *testing.T
+	conn   net.PacketConn
+	server net.Addr
+	mac    net.HardwareAddr
+	xid    uint32
+}
+
+// startServer runs the embedded server on the loopback for a scope of 10.9.0.0/24 with two dynamic addresses
+// and a reserved junos host, and returns a client of it. Replies to clients without an address are broadcast,
+// so the server is bound to lo for them to come back here. That takes root, so the test is skipped without it.
+func startServer(t *testing.T) (*Server, *client) {
+	c := cfg.NewCfg()
+	c.Core.FileServer = "127.0.0.1"
+	c.Core.TransferMode = "http"
+	c.Core.HTTPConfigsLocation = "configs"
+	c.Core.DomainName = "lab.example.net"
+	c.Scopes = []cfg.ScopeCfg{{
+		Name:            "lab",
+		Subnet:          "10.9.0.0",
+		SubnetMask:      "255.255.255.0",
+		SubnetRouter:    "10.9.0.1",
+		NonCfgRangeLow:  "10.9.0.100",
+		NonCfgRangeHigh: "10.9.0.101",
+		FileServer:      "10.9.0.254",
+	}}
+
+	store, err := cache.New(map[string]rt.Hosts{
+		"10.9.0.10": {FixedIP: "10.9.0.10", Ethernet: "02:00:00:00:00:0a", HostName: "sw1", Vendor: "junos"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := listen("0.0.0.0:0", "lo")
+	if err != nil {
+		t.Skipf("can't bind to lo: %s", err)
+	}
+
+	srv := New(c, store)
+	srv.Addr = "127.0.0.1:0"
+	srv.Iface = "lo"
+	srv.ClientPort = conn.LocalAddr().(*net.UDPAddr).Port
+	if err := srv.Start(); err != nil {
+		conn.Close()
+		t.Skipf("can't start the server on lo: %s", err)
+	}
+	t.Cleanup(func() {
+		srv.Close()
+		conn.Close()
+	})
+
+	return srv, &client{t: t, conn: conn, server: srv.conn.LocalAddr()}
+}
+
+// as returns the client with ethernet address mac
+func (c *client) as(mac string) *client {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	n := *c
+	n.mac = hw
+	return &n
+}
+
+// send sends a message of msgType with the options given
+func (c *client) send(msgType byte, opts map[byte][]byte) {
+	c.xid++
+	p := &Packet{
+		Op:      BootRequest,
+		HType:   1,
+		HLen:    6,
+		XID:     c.xid,
+		CIAddr:  net.IPv4zero,
+		YIAddr:  net.IPv4zero,
+		SIAddr:  net.IPv4zero,
+		GIAddr:  net.IPv4zero,
+		CHAddr:  c.mac,
+		Options: map[byte][]byte{OptMessageType: {msgType}},
+	}
+	for code, v := range opts {
+		p.Options[code] = v
+	}
+	if _, err := c.conn.WriteTo(p.Marshal(), c.server); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// exchange sends a message and returns the reply to it, which has to be of the type want
+func (c *client) exchange(msgType byte, opts map[byte][]byte, want byte) *Packet {
+	c.t.Helper()
+	c.send(msgType, opts)
+
+	buf := make([]byte, 1500)
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		n, _, err := c.conn.ReadFrom(buf)
+		if err != nil {
+			c.t.Fatalf("no reply to message type %d from %s: %s", msgType, c.mac, err)
+		}
+		p, err := ParsePacket(buf[:n])
+		// Broadcasts for the other clients and our own requests come back too
+		if err != nil || p.Op != BootReply || p.XID != c.xid || !bytes.Equal(p.CHAddr, c.mac) {
+			continue
+		}
+		if p.MessageType() != want {
+			c.t.Fatalf("reply to message type %d from %s is type %d, expected %d", msgType, c.mac, p.MessageType(), want)
+		}
+		return p
+	}
+}
+
+// lease goes through DISCOVER, OFFER, REQUEST and ACK and returns the OFFER and the ACK
+func (c *client) lease() (offer *Packet, ack *Packet) {
+	c.t.Helper()
+	offer = c.exchange(Discover, nil, Offer)
+	ack = c.exchange(Request, map[byte][]byte{
+		OptRequestedIP: []byte(offer.YIAddr.To4()),
+		OptServerID:    offer.Options[OptServerID],
+	}, Ack)
+	if !ack.YIAddr.Equal(offer.YIAddr) {
+		c.t.Fatalf("ACK for %s is for %s, the OFFER was %s", c.mac, ack.YIAddr, offer.YIAddr)
+	}
+	return offer, ack
+}
+
+func TestReservedHost(t *testing.T) {
+	_, c := startServer(t)
+	sw1 := c.as("02:00:00:00:00:0a")
+
+	offer, ack := sw1.lease()
+	for _, p := range []*Packet{offer, ack} {
+		if !p.YIAddr.Equal(net.ParseIP("10.9.0.10")) {
+			t.Errorf("reserved host got %s, expected its fixed address 10.9.0.10", p.YIAddr)
+		}
+		if got := net.IP(p.Options[OptZTPFileServer]); !got.Equal(net.ParseIP("10.9.0.254")) {
+			t.Errorf("option 150 is %v, expected the scope's file server 10.9.0.254", got)
+		}
+		want := EncodeSubOptions(map[byte]string{1: "configs/sw1.conf", 3: "http"})
+		if got := p.Options[OptVendorSpecific]; !bytes.Equal(got, want) {
+			t.Errorf("option 43 is %q, expected %q", got, want)
+		}
+		if got := string(p.Options[OptHostName]); got != "sw1" {
+			t.Errorf("hostname option is %q, expected sw1", got)
+		}
+	}
+
+	// Anything but the reservation is refused
+	sw1.exchange(Request, map[byte][]byte{OptRequestedIP: []byte(net.ParseIP("10.9.0.100").To4())}, Nak)
+}
+
+func TestDynamicLease(t *testing.T) {
+	srv, c := startServer(t)
+	first, second, third := c.as("02:00:00:00:01:01"), c.as("02:00:00:00:01:02"), c.as("02:00:00:00:01:03")
+
+	offer, _ := first.lease()
+	if addr := offer.YIAddr.String(); addr != "10.9.0.100" && addr != "10.9.0.101" {
+		t.Fatalf("dynamic client got %s, expected an address from 10.9.0.100 to 10.9.0.101", addr)
+	}
+	if _, ok := offer.Options[OptVendorSpecific]; ok {
+		t.Error("dynamic client was handed the ZTP options")
+	}
+	if got := net.IP(offer.Options[OptRouter]); !got.Equal(net.ParseIP("10.9.0.1")) {
+		t.Errorf("router option is %v, expected 10.9.0.1", got)
+	}
+
+	other, _ := second.lease()
+	if other.YIAddr.Equal(offer.YIAddr) {
+		t.Fatalf("two clients were both given %s", offer.YIAddr)
+	}
+
+	first.send(Release, nil)
+	// A RELEASE has no reply, so wait until the server has seen it
+	held := func() bool {
+		p := srv.pools["lab"]
+		p.Lock()
+		defer p.Unlock()
+		_, ok := p.byIP[ipToUint(offer.YIAddr)]
+		return ok
+	}
+	for deadline := time.Now().Add(2 * time.Second); held(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s is still held after the RELEASE", offer.YIAddr)
+		}
+	}
+
+	if got, _ := third.lease(); !got.YIAddr.Equal(offer.YIAddr) {
+		t.Errorf("after the RELEASE the next client got %s, expected the released %s", got.YIAddr, offer.YIAddr)
+	}
+}
@@ -0,0 +1,211 @@
+// Protected by BSD 3 clause license
+
+// Package diff produces unified diffs of text files, in the format diff -u and patch understand.
+package diff
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// edit is a single line of an edit script. a and b are the line numbers (from 0) in each file
+// the edit sits at.
+type edit struct {
+	kind byte // ' ' kept, '-' removed from a, '+' added from b
+	a, b int
+	line string
+}
+
+// Unified returns a unified diff turning a into b, with n lines of context around each change.
+// fromFile and toFile name the two sides in the header. The diff is empty if a and b are the same.
+func Unified(fromFile, toFile, a, b string, n int) string {
+	if a == b {
+		return ""
+	}
+	edits := script(lines(a), lines(b))
+
+	buf := new(bytes.Buffer)
+	buf.Write([]byte(fmt.Sprintf("--- %s\n+++ %s\n", fromFile, toFile)))
+
+	for i := 0; i < len(edits); {
+		// Skip to the next change
+		if edits[i].kind == ' ' {
+			i++
+			continue
+		}
+
+		// A hunk runs until there are more than 2n unchanged lines before the next change
+		start := i - n
+		if start < 0 {
+			start = 0
+		}
+		end := i
+		for j := i; j < len(edits); j++ {
+			if edits[j].kind != ' ' {
+				end = j + 1
+			} else if j-end >= 2*n {
+				break
+			}
+		}
+		end += n
+		if end > len(edits) {
+			end = len(edits)
+		}
+
+		writeHunk(buf, edits[start:end])
+		i = end
+	}
+	return buf.String()
+}
+
+// writeHunk writes a hunk header followed by its lines
+func writeHunk(buf *bytes.Buffer, edits []edit) {
+	alen, blen := 0, 0
+	for _, e := range edits {
+		if e.kind != '+' {
+			alen++
+		}
+		if e.kind != '-' {
+			blen++
+		}
+	}
+	buf.Write([]byte(fmt.Sprintf("@@ -%s +%s @@\n", hunkRange(edits[0].a, alen), hunkRange(edits[0].b, blen))))
+
+	for _, e := range edits {
+		buf.WriteByte(e.kind)
+		buf.Write([]byte(e.line))
+		if !strings.HasSuffix(e.line, "\n") {
+			buf.Write([]byte("\n\\ No newline at end of file\n"))
+		}
+	}
+}
+
+// hunkRange formats the start and length of one side of a hunk. An empty side is
+// numbered after the line it follows, so an insertion at the top of a file is 0,0.
+func hunkRange(start, length int) string {
+	if length == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if length == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, length)
+}
+
+// lines splits s after each newline. The last line has no newline if s doesn't end with one.
+func lines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	l := strings.SplitAfter(s, "\n")
+	if l[len(l)-1] == "" {
+		l = l[:len(l)-1]
+	}
+	return l
+}
+
+// script returns the shortest edit script turning a into b, using Myers' algorithm.
+// Generated files mostly change in a few places, so the common head and tail are kept out of it.
+func script(a, b []string) []edit {
+	head := 0
+	for head < len(a) && head < len(b) && a[head] == b[head] {
+		head++
+	}
+	tail := 0
+	for tail < len(a)-head && tail < len(b)-head && a[len(a)-1-tail] == b[len(b)-1-tail] {
+		tail++
+	}
+
+	edits := []edit{}
+	for i := 0; i < head; i++ {
+		edits = append(edits, edit{kind: ' ', a: i, b: i, line: a[i]})
+	}
+	for _, e := range myers(a[head:len(a)-tail], b[head:len(b)-tail]) {
+		e.a += head
+		e.b += head
+		edits = append(edits, e)
+	}
+	for i := tail; i > 0; i-- {
+		edits = append(edits, edit{kind: ' ', a: len(a) - i, b: len(b) - i, line: a[len(a)-i]})
+	}
+	return edits
+}
+
+// myers finds the shortest path through the edit graph of a and b, then walks it back to build the script
+func myers(a, b []string) []edit {
+	n, m := len(a), len(b)
+	max := n + m
+	if max == 0 {
+		return nil
+	}
+
+	// v holds the furthest x reached on each diagonal k = x - y, offset by off.
+	// trace[d] is the part of v the walk back needs for step d, diagonals -(d+1) to d+1.
+	off := max + 1
+	v := make([]int, 2*off+1)
+	trace := [][]int{}
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v[off-d-1:off+d+2]...))
+		done := false
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				done = true
+				break
+			}
+		}
+		if done {
+			break
+		}
+	}
+
+	// Walk back from the end, collecting the edits in reverse
+	rev := []edit{}
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		tv := trace[d]
+		at := func(k int) int { return tv[k+d+1] }
+
+		k := x - y
+		var prevk int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevk = k + 1
+		} else {
+			prevk = k - 1
+		}
+		prevx := at(prevk)
+		prevy := prevx - prevk
+
+		for x > prevx && y > prevy {
+			x--
+			y--
+			rev = append(rev, edit{kind: ' ', a: x, b: y, line: a[x]})
+		}
+		if d > 0 {
+			if x == prevx {
+				rev = append(rev, edit{kind: '+', a: x, b: prevy, line: b[prevy]})
+			} else {
+				rev = append(rev, edit{kind: '-', a: prevx, b: y, line: a[prevx]})
+			}
+		}
+		x, y = prevx, prevy
+	}
+
+	edits := make([]edit, len(rev))
+	for i, e := range rev {
+		edits[len(rev)-1-i] = e
+	}
+	return edits
+}
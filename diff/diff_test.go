@@ -0,0 +1,93 @@
+// Protected by BSD 3 clause license
+
+package diff
+
+import "testing"
+
+func TestUnified(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		n    int
+		want string
+	}{
+		{
+			name: "same",
+			a:    "a\nb\n",
+			b:    "a\nb\n",
+			n:    3,
+			want: "",
+		},
+		{
+			name: "insert at top",
+			a:    "b\nc\n",
+			b:    "a\nb\nc\n",
+			n:    3,
+			want: "--- old\n+++ new\n@@ -1,2 +1,3 @@\n+a\n b\n c\n",
+		},
+		{
+			name: "insert into empty",
+			a:    "",
+			b:    "a\n",
+			n:    3,
+			want: "--- old\n+++ new\n@@ -0,0 +1 @@\n+a\n",
+		},
+		{
+			name: "delete at end",
+			a:    "a\nb\nc\nd\ne\n",
+			b:    "a\nb\nc\nd\n",
+			n:    2,
+			want: "--- old\n+++ new\n@@ -3,3 +3,2 @@\n c\n d\n-e\n",
+		},
+		{
+			name: "delete everything",
+			a:    "a\nb\n",
+			b:    "",
+			n:    3,
+			want: "--- old\n+++ new\n@@ -1,2 +0,0 @@\n-a\n-b\n",
+		},
+		{
+			name: "no trailing newline",
+			a:    "a\nb",
+			b:    "a\nc",
+			n:    3,
+			want: "--- old\n+++ new\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+c\n\\ No newline at end of file\n",
+		},
+		{
+			name: "trailing newline added",
+			a:    "a\nb",
+			b:    "a\nb\n",
+			n:    3,
+			want: "--- old\n+++ new\n@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+		},
+		{
+			name: "hunks 2n apart merge",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n",
+			b:    "1\nX\n3\n4\n5\n6\nY\n8\n",
+			n:    2,
+			want: "--- old\n+++ new\n@@ -1,8 +1,8 @@\n 1\n-2\n+X\n 3\n 4\n 5\n 6\n-7\n+Y\n 8\n",
+		},
+		{
+			name: "hunks more than 2n apart don't",
+			a:    "1\n2\n3\n4\n5\n6\n7\n8\n9\n",
+			b:    "1\nX\n3\n4\n5\n6\n7\nY\n9\n",
+			n:    2,
+			want: "--- old\n+++ new\n@@ -1,4 +1,4 @@\n 1\n-2\n+X\n 3\n 4\n@@ -6,4 +6,4 @@\n 6\n 7\n-8\n+Y\n 9\n",
+		},
+		{
+			name: "no context",
+			a:    "a\nb\nc\n",
+			b:    "a\nB\nc\n",
+			n:    0,
+			want: "--- old\n+++ new\n@@ -2 +2 @@\n-b\n+B\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Unified("old", "new", tt.a, tt.b, tt.n); got != tt.want {
+				t.Errorf("Unified(%q, %q, %d) =\n%s\nexpected\n%s", tt.a, tt.b, tt.n, got, tt.want)
+			}
+		})
+	}
+}
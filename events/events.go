@@ -0,0 +1,180 @@
+// Protected by BSD 3 clause license
+
+// Package events passes host and group changes and saves on to whoever is listening, such as the event stream of the REST API.
+package events
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// Event types
+const (
+	// Create = a host was created
+	Create = "create"
+	// Update = a host was changed, or moved to a new address
+	Update = "update"
+	// Delete = a host was deleted
+	Delete = "delete"
+	// GroupUpdate = a group was created or its vars were changed
+	GroupUpdate = "group-update"
+	// GroupDelete = a group was deleted
+	GroupDelete = "group-delete"
+	// Save = a save went through and became a generation
+	Save = "save"
+	// SaveFailed = a save failed, nothing changed on disk
+	SaveFailed = "save-failed"
+	// Rollback = a generation was put back and saved as a new one
+	Rollback = "rollback"
+	// Reset = the events since the subscriber's last one are no longer held, it has to fetch everything again
+	Reset = "reset"
+)
+
+// How many events are held for subscribers that reconnect, and how many can queue up for a subscriber
+// before it's dropped for being too slow
+const (
+	backlogSize = 256
+	queueSize   = 64
+)
+
+// Event is something that happened to the hosts or the config
+type Event struct {
+	ID         string    `json:"id"` // "<epoch>-<n>", the epoch changes each time the broker is made and n counts from 1
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Key        string    `json:"key,omitempty"`    // Address of the host, for host events
+	Before     *rt.Hosts `json:"before,omitempty"` // Not set for a create
+	After      *rt.Hosts `json:"after,omitempty"`  // Not set for a delete
+	Group      string    `json:"group,omitempty"`  // Name of the group, for group events
+	Vars       rt.Vars   `json:"vars,omitempty"`   // Vars of the group, not set for a group delete
+	Generation int       `json:"generation,omitempty"`
+	Commit     string    `json:"commit,omitempty"`
+	User       string    `json:"user,omitempty"`
+	Message    string    `json:"message,omitempty"`
+
+	n uint64
+}
+
+// Broker hands every event published to each subscriber, in order. It's safe to use from any number of goroutines.
+// A nil Broker drops everything, so publishers needn't check for one.
+type Broker struct {
+	mu      sync.Mutex
+	epoch   string // Tells the IDs of this run from those of earlier ones
+	next    uint64
+	backlog []Event
+	subs    map[chan Event]struct{}
+}
+
+// NewBroker returns a Broker with no subscribers
+func NewBroker() *Broker {
+	return &Broker{epoch: strconv.FormatInt(time.Now().UnixNano(), 36), subs: map[chan Event]struct{}{}}
+}
+
+// id returns the ID of event n
+func (b *Broker) id(n uint64) string {
+	return fmt.Sprintf("%s-%d", b.epoch, n)
+}
+
+// seen returns the number of the event with the given ID. ok is false if the ID isn't one of this broker's.
+func (b *Broker) seen(id string) (n uint64, ok bool) {
+	i := strings.LastIndex(id, "-")
+	if i < 0 || id[:i] != b.epoch {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(id[i+1:], 10, 64)
+	return n, err == nil && n <= b.next
+}
+
+// Publish numbers and timestamps e, then sends it to every subscriber. It never blocks: a subscriber that has
+// fallen too far behind is dropped, its channel is closed and it has to subscribe again.
+func (b *Broker) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.next++
+	e.n, e.ID = b.next, b.id(b.next)
+	e.Time = time.Now()
+
+	b.backlog = append(b.backlog, e)
+	if len(b.backlog) > backlogSize {
+		b.backlog = b.backlog[len(b.backlog)-backlogSize:]
+	}
+
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Subscribe returns a channel with every event published from now on. If after is the ID of an event, the events
+// held since that one come first, so a subscriber that reconnects doesn't miss any that are still held. If some
+// of them aren't held any more, or after is from before a restart, a Reset event with the latest ID comes
+// first instead. cancel has to be called once the subscriber is done.
+func (b *Broker) Subscribe(after string) (events <-chan Event, cancel func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	missed := []Event{}
+	// The oldest event held, or the next one to come if none are
+	oldest := b.next + 1 - uint64(len(b.backlog))
+	n, ok := b.seen(after)
+	switch {
+	case after == "":
+	case !ok || n+1 < oldest:
+		missed = append(missed, Event{ID: b.id(b.next), Type: Reset, Time: time.Now(), n: b.next,
+			Message: fmt.Sprintf("events after %s are no longer held, fetch the hosts and groups again", after)})
+	default:
+		for _, e := range b.backlog {
+			if e.n > n {
+				missed = append(missed, e)
+			}
+		}
+	}
+
+	ch := make(chan Event, queueSize+len(missed))
+	for _, e := range missed {
+		ch <- e
+	}
+	b.subs[ch] = struct{}{}
+
+	cancel = func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+	return ch, cancel
+}
+
+// HostEvent returns the event for a host going from before to after. Either can be nil.
+func HostEvent(key string, before *rt.Hosts, after *rt.Hosts) Event {
+	e := Event{Type: Update, Key: key, Before: before, After: after}
+	if before == nil {
+		e.Type = Create
+	} else if after == nil {
+		e.Type = Delete
+	}
+	return e
+}
+
+// GroupEvent returns the event for group name changing to vars, or being deleted if vars is nil
+func GroupEvent(name string, vars *rt.Vars) Event {
+	if vars == nil {
+		return Event{Type: GroupDelete, Group: name}
+	}
+	return Event{Type: GroupUpdate, Group: name, Vars: *vars}
+}
@@ -0,0 +1,70 @@
+// Protected by BSD 3 clause license
+
+package events
+
+import "testing"
+
+// received returns the events waiting on ch
+func received(ch <-chan Event) []Event {
+	got := []Event{}
+	for {
+		select {
+		case e := <-ch:
+			got = append(got, e)
+		default:
+			return got
+		}
+	}
+}
+
+func TestSubscribeAfter(t *testing.T) {
+	b := NewBroker()
+	for i := 0; i < backlogSize+10; i++ {
+		b.Publish(Event{Type: Create})
+	}
+	latest := uint64(backlogSize + 10)
+	oldest := latest - backlogSize + 1
+
+	// The same numbers from before a restart
+	before := NewBroker()
+	before.epoch = b.epoch + "0"
+
+	tests := []struct {
+		name  string
+		after string
+		first uint64 // Number of the first event replayed
+		count int    // How many are replayed
+		reset bool   // A single reset is expected instead
+	}{
+		{name: "from now", after: ""},
+		{name: "up to date", after: b.id(latest)},
+		{name: "one behind", after: b.id(latest - 1), first: latest, count: 1},
+		{name: "oldest held is next", after: b.id(oldest - 1), first: oldest, count: backlogSize},
+		{name: "oldest held is gone", after: b.id(oldest - 2), reset: true},
+		{name: "from before a restart", after: before.id(latest - 1), reset: true},
+		{name: "from after a restart", after: before.id(latest + 5), reset: true},
+		{name: "not an ID", after: "12", reset: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ch, cancel := b.Subscribe(tt.after)
+			defer cancel()
+			got := received(ch)
+
+			if tt.reset {
+				if len(got) != 1 || got[0].Type != Reset || got[0].ID != b.id(latest) {
+					t.Fatalf("expected one reset with ID %s, got %+v", b.id(latest), got)
+				}
+				return
+			}
+			if len(got) != tt.count {
+				t.Fatalf("expected %d events, got %d", tt.count, len(got))
+			}
+			for i, e := range got {
+				if want := b.id(tt.first + uint64(i)); e.ID != want || e.Type == Reset {
+					t.Fatalf("event %d is %s %s, expected %s %s", i, e.ID, e.Type, want, Create)
+				}
+			}
+		})
+	}
+}
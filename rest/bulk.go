@@ -0,0 +1,262 @@
+package rest
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/networkbootstrap/ztpmanagercode/cache"
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// The columns of a host CSV, named the same as the JSON fields. Groups are separated by ';', vars are a JSON object.
+var csvColumns = []string{"ethernetaddress", "fixedipaddress", "fixedipv6address", "duid", "hostname",
+	"vendor", "model", "role", "imagefile", "groups", "vars"}
+
+// bulkFailure is what an import with problems answers with
+type bulkFailure struct {
+	Message string           `json:"message"`
+	Rows    []cache.RowError `json:"rows"`
+}
+
+// bulkResult is what a successful import answers with
+type bulkResult struct {
+	Created []string `json:"created"`
+}
+
+// importHosts creates every host of a CSV or a JSON array, or none of them.
+// Every problem found is listed against the row it's in.
+func (w WebFuncs) importHosts(c echo.Context) error {
+	var hosts []rt.Hosts
+	var rows []cache.RowError
+	var err error
+	if bulkFormat(c, c.Request().Header.Get(echo.HeaderContentType)) == "csv" {
+		hosts, rows, err = readHostsCSV(c.Request().Body)
+	} else {
+		hosts, err = readHostsJSON(c.Request().Body)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	if len(hosts) == 0 && len(rows) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "no hosts to import")
+	}
+
+	groups := w.groupNames()
+	for i := range hosts {
+		for _, f := range append(checkHost(hosts[i]), checkGroups(hosts[i], groups)...) {
+			rows = append(rows, cache.RowError{Row: i + 1, Key: hosts[i].Key(), Message: f.Message})
+		}
+		hosts[i].Vendor = strings.ToLower(hosts[i].Vendor)
+	}
+
+	var created []rt.Hosts
+	if len(rows) > 0 {
+		// Still worth knowing what else is wrong
+		rows = append(rows, w.store.CheckMany(hosts)...)
+	} else if created, err = w.store.CreateMany(hosts); err != nil {
+		be, ok := err.(*cache.BatchError)
+		if !ok {
+			return storeError(err)
+		}
+		rows = be.Rows
+	}
+
+	if len(rows) > 0 {
+		sort.SliceStable(rows, func(i, j int) bool { return rows[i].Row < rows[j].Row })
+		return echo.NewHTTPError(http.StatusBadRequest, bulkFailure{
+			Message: fmt.Sprintf("%d problems in %d hosts, none were imported", len(rows), len(hosts)),
+			Rows:    rows,
+		})
+	}
+
+	result := bulkResult{Created: []string{}}
+	for _, h := range created {
+		result.Created = append(result.Created, h.Key())
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// exportHosts streams every host out as CSV or as a JSON array, in address order
+func (w WebFuncs) exportHosts(c echo.Context) error {
+	hosts := w.store.Snapshot()
+	keys := w.store.Keys()
+	r := c.Response()
+
+	if bulkFormat(c, c.Request().Header.Get(echo.HeaderAccept)) == "csv" {
+		r.Header().Set(echo.HeaderContentType, "text/csv; charset=UTF-8")
+		r.WriteHeader(http.StatusOK)
+		cw := csv.NewWriter(r)
+		cw.Write(csvColumns)
+		for _, k := range keys {
+			h, ok := hosts[k]
+			if !ok {
+				continue
+			}
+			row, err := hostCSV(h.WithKey(k))
+			if err != nil {
+				return err
+			}
+			cw.Write(row)
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	r.Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSONCharsetUTF8)
+	r.WriteHeader(http.StatusOK)
+	io.WriteString(r, "[")
+	enc := json.NewEncoder(r)
+	first := true
+	for _, k := range keys {
+		h, ok := hosts[k]
+		if !ok {
+			continue
+		}
+		if !first {
+			io.WriteString(r, ",")
+		}
+		first = false
+		if err := enc.Encode(h.WithKey(k)); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(r, "]\n")
+	return err
+}
+
+// bulkFormat returns "csv" or "json": ?format= if it's given, otherwise what the content type header says
+func bulkFormat(c echo.Context, contentType string) string {
+	if f := strings.ToLower(c.QueryParam("format")); f == "csv" || f == "json" {
+		return f
+	}
+	if strings.HasPrefix(strings.ToLower(contentType), "text/csv") {
+		return "csv"
+	}
+	return "json"
+}
+
+// readHostsJSON reads a JSON array of hosts
+func readHostsJSON(r io.Reader) ([]rt.Hosts, error) {
+	hosts := []rt.Hosts{}
+	if err := json.NewDecoder(r).Decode(&hosts); err != nil {
+		return nil, fmt.Errorf("expected a JSON array of hosts: %s", err)
+	}
+	return hosts, nil
+}
+
+// readHostsCSV reads a CSV of hosts with a header row naming its columns. Fields that can't be read are
+// returned as row problems, and columns named twice as problems with row 0, the header. Anything else wrong
+// with the CSV as a whole is an error.
+func readHostsCSV(r io.Reader) ([]rt.Hosts, []cache.RowError, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	known := map[string]bool{}
+	for _, col := range csvColumns {
+		known[col] = true
+	}
+	rows := []cache.RowError{}
+	seen := map[string]bool{}
+	for i, col := range header {
+		header[i] = strings.ToLower(strings.TrimSpace(col))
+		if !known[header[i]] {
+			return nil, nil, fmt.Errorf("unknown column %q, the columns are: %s", col, strings.Join(csvColumns, ", "))
+		}
+		// The last one would quietly win
+		if seen[header[i]] {
+			rows = append(rows, cache.RowError{Row: 0, Message: fmt.Sprintf("column %q is in the header more than once", header[i])})
+		}
+		seen[header[i]] = true
+	}
+
+	hosts := []rt.Hosts{}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		h := rt.Hosts{}
+		for i, value := range record {
+			if err := setCSVField(&h, header[i], strings.TrimSpace(value)); err != nil {
+				rows = append(rows, cache.RowError{Row: len(hosts) + 1, Message: err.Error()})
+			}
+		}
+		hosts = append(hosts, h)
+	}
+	// Keys are only known once the whole row has been read
+	for i := range rows {
+		if rows[i].Row > 0 {
+			rows[i].Key = hosts[rows[i].Row-1].Key()
+		}
+	}
+	return hosts, rows, nil
+}
+
+// setCSVField sets the field of h a CSV column is for
+func setCSVField(h *rt.Hosts, column string, value string) error {
+	switch column {
+	case "ethernetaddress":
+		h.Ethernet = value
+	case "fixedipaddress":
+		h.FixedIP = value
+	case "fixedipv6address":
+		h.FixedIPv6 = value
+	case "duid":
+		h.DUID = value
+	case "hostname":
+		h.HostName = value
+	case "vendor":
+		h.Vendor = value
+	case "model":
+		h.Model = value
+	case "role":
+		h.Role = value
+	case "imagefile":
+		h.CfgImage = value
+	case "groups":
+		for _, g := range strings.Split(value, ";") {
+			if g = strings.TrimSpace(g); g != "" {
+				h.Groups = append(h.Groups, g)
+			}
+		}
+	case "vars":
+		if value == "" {
+			return nil
+		}
+		if err := json.Unmarshal([]byte(value), &h.Vars); err != nil {
+			return fmt.Errorf("vars should be a JSON object: %s", err)
+		}
+	}
+	return nil
+}
+
+// hostCSV returns h as a CSV row, in the order of csvColumns
+func hostCSV(h rt.Hosts) ([]string, error) {
+	vars := ""
+	if len(h.Vars) > 0 {
+		b, err := json.Marshal(h.Vars)
+		if err != nil {
+			return nil, fmt.Errorf("host %s: %s", h.Key(), err)
+		}
+		vars = string(b)
+	}
+	return []string{h.Ethernet, h.FixedIP, h.FixedIPv6, h.DUID, h.HostName,
+		h.Vendor, h.Model, h.Role, h.CfgImage, strings.Join(h.Groups, ";"), vars}, nil
+}
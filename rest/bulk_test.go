@@ -0,0 +1,85 @@
+// Protected by BSD 3 clause license
+
+package rest
+
+import (
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/networkbootstrap/ztpmanagercode/cache"
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+func TestReadHostsCSVHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		csv    string
+		hosts  int
+		want   []cache.RowError
+		hasErr bool
+	}{
+		{name: "fine", csv: "fixedipaddress,hostname\n10.0.0.1,sw1\n", hosts: 1, want: []cache.RowError{}},
+		{name: "case and spaces", csv: "FixedIPAddress, HostName\n10.0.0.1,sw1\n", hosts: 1, want: []cache.RowError{}},
+		{name: "unknown column", csv: "fixedipaddress,colour\n10.0.0.1,red\n", hasErr: true},
+		{
+			name:  "column twice",
+			csv:   "fixedipaddress,hostname,HostName\n10.0.0.1,sw1,sw2\n",
+			hosts: 1,
+			want:  []cache.RowError{{Row: 0, Message: `column "hostname" is in the header more than once`}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hosts, rows, err := readHostsCSV(strings.NewReader(tt.csv))
+			if tt.hasErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(hosts) != tt.hosts {
+				t.Errorf("read %d hosts, expected %d", len(hosts), tt.hosts)
+			}
+			if !reflect.DeepEqual(rows, tt.want) {
+				t.Errorf("problems are %v, expected %v", rows, tt.want)
+			}
+		})
+	}
+}
+
+func TestImportHostsChecksGroups(t *testing.T) {
+	w, stop := newWebFuncs(t, map[string]rt.Hosts{})
+	defer stop()
+
+	body := `fixedipaddress,hostname,vendor,groups
+10.0.0.1,sw1,junos,lab
+10.0.0.2,sw2,junos,lab;dc9
+`
+	_, err := call(w.importHosts, http.MethodPost, "/v1/hosts/import", "text/csv", strings.NewReader(body))
+	he, ok := err.(*echo.HTTPError)
+	if !ok || he.Code != http.StatusBadRequest {
+		t.Fatalf("import answered %v, expected a 400", err)
+	}
+	rows := he.Message.(bulkFailure).Rows
+	if len(rows) != 1 || rows[0].Row != 2 || rows[0].Key != "10.0.0.2" {
+		t.Errorf("problems are %v, expected one for row 2", rows)
+	}
+	if keys := w.store.Keys(); len(keys) != 0 {
+		t.Errorf("hosts %v were imported, expected none", keys)
+	}
+
+	body = "fixedipaddress,hostname,hostname\n10.0.0.1,sw1,sw2\n"
+	_, err = call(w.importHosts, http.MethodPost, "/v1/hosts/import", "text/csv", strings.NewReader(body))
+	if he, ok = err.(*echo.HTTPError); !ok || he.Code != http.StatusBadRequest {
+		t.Fatalf("import answered %v, expected a 400", err)
+	}
+	if rows = he.Message.(bulkFailure).Rows; len(rows) == 0 || rows[0].Row != 0 {
+		t.Errorf("problems are %v, expected one for the header", rows)
+	}
+}
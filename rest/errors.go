@@ -0,0 +1,157 @@
+package rest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo"
+	"github.com/networkbootstrap/ztpmanagercode/cache"
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+	"github.com/networkbootstrap/ztpmanagercode/templategen"
+)
+
+// apiError is what every error under /v1 answers with
+type apiError struct {
+	Code     string           `json:"code"` // The HTTP status, in snake case, such as "not_found"
+	Message  string           `json:"message"`
+	Fields   []fieldError     `json:"fields,omitempty"`   // Fields of the request body at fault
+	Rows     []cache.RowError `json:"rows,omitempty"`     // Rows at fault, for a bulk import
+	Problems []rt.Problem     `json:"problems,omitempty"` // What stopped a save
+	Hooks    []rt.HookResult  `json:"hooks,omitempty"`    // Hooks a failed save ran
+}
+
+// fieldError is what's wrong with one field of a request body
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// errorHandler answers errors under /v1 with an apiError. The legacy routes answer the way they always have.
+func errorHandler(e *echo.Echo) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		if !strings.HasPrefix(c.Request().URL.Path, apiPrefix+"/") {
+			if he, ok := err.(*echo.HTTPError); ok {
+				switch m := he.Message.(type) {
+				case *apiError:
+					err = echo.NewHTTPError(he.Code, m.Message)
+				case saveFailure:
+					err = echo.NewHTTPError(he.Code, m.Message)
+				}
+			}
+			e.DefaultHTTPErrorHandler(err, c)
+			return
+		}
+
+		code, body := http.StatusInternalServerError, &apiError{}
+		if he, ok := err.(*echo.HTTPError); ok {
+			code = he.Code
+			switch m := he.Message.(type) {
+			case *apiError:
+				body = m
+			case saveFailure:
+				body.Message, body.Problems, body.Hooks = m.Message, m.Problems, m.Hooks
+			case bulkFailure:
+				body.Message, body.Rows = m.Message, m.Rows
+			default:
+				body.Message = fmt.Sprint(m)
+			}
+		} else {
+			// Nothing about the server's insides is given away
+			body.Message = http.StatusText(code)
+		}
+		body.Code = strings.ToLower(strings.Replace(http.StatusText(code), " ", "_", -1))
+
+		if c.Response().Committed {
+			return
+		}
+		if c.Request().Method == http.MethodHead {
+			err = c.NoContent(code)
+		} else {
+			err = c.JSON(code, body)
+		}
+		if err != nil {
+			e.Logger.Error(err)
+		}
+	}
+}
+
+// invalid returns a 400 for a request body with fields at fault. The message names each of them.
+func invalid(what string, fields ...fieldError) error {
+	msgs := []string{}
+	for _, f := range fields {
+		msgs = append(msgs, f.Field+": "+f.Message)
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, &apiError{Message: what + ": " + strings.Join(msgs, "; "), Fields: fields})
+}
+
+// bindJSON reads the JSON body of a request into v. A body that can't be read is a 400, naming the field
+// at fault if there is one.
+func bindJSON(c echo.Context, v interface{}) error {
+	err := json.NewDecoder(c.Request().Body).Decode(v)
+	switch e := err.(type) {
+	case nil:
+		return nil
+	case *json.UnmarshalTypeError:
+		return invalid("the body doesn't fit", fieldError{Field: e.Field, Message: fmt.Sprintf("should be %s, not %s", e.Type, e.Value)})
+	case *json.SyntaxError:
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("the body isn't valid JSON: %s, at offset %d", e, e.Offset))
+	}
+	switch err {
+	case io.EOF:
+		return echo.NewHTTPError(http.StatusBadRequest, "the body is empty, expected JSON")
+	case io.ErrUnexpectedEOF:
+		return echo.NewHTTPError(http.StatusBadRequest, "the body isn't valid JSON, it stops part way through")
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+}
+
+// checkHost returns what's wrong with the fields of h, as far as can be told without the rest of the config.
+// Scopes and the like are checked by the save.
+func checkHost(h rt.Hosts) []fieldError {
+	fields := []fieldError{}
+	// A host without a vendor gets no config, one with a vendor nobody knows couldn't be saved
+	if h.Vendor != "" {
+		if _, err := templategen.Lookup(h.Vendor); err != nil {
+			fields = append(fields, fieldError{Field: "vendor", Message: err.Error()})
+		}
+	}
+	if h.FixedIP == "" && h.FixedIPv6 == "" {
+		fields = append(fields, fieldError{Field: "fixedipaddress", Message: "a host needs a fixed IPv4 or IPv6 address"})
+	}
+	if ip := net.ParseIP(h.FixedIP); h.FixedIP != "" && (ip == nil || ip.To4() == nil) {
+		fields = append(fields, fieldError{Field: "fixedipaddress", Message: fmt.Sprintf("%q is not an IPv4 address", h.FixedIP)})
+	}
+	if ip := net.ParseIP(h.FixedIPv6); h.FixedIPv6 != "" && (ip == nil || ip.To4() != nil) {
+		fields = append(fields, fieldError{Field: "fixedipv6address", Message: fmt.Sprintf("%q is not an IPv6 address", h.FixedIPv6)})
+	}
+	if _, err := net.ParseMAC(h.Ethernet); h.Ethernet != "" && err != nil {
+		fields = append(fields, fieldError{Field: "ethernetaddress", Message: fmt.Sprintf("ethernet address %q is invalid", h.Ethernet)})
+	}
+	if h.HostName == "" {
+		fields = append(fields, fieldError{Field: "hostname", Message: "a host needs a hostname"})
+	}
+	// Role and model end up in template paths
+	if err := templategen.CheckPathPart(h.Role); err != nil {
+		fields = append(fields, fieldError{Field: "role", Message: err.Error()})
+	}
+	if err := templategen.CheckPathPart(h.Model); err != nil {
+		fields = append(fields, fieldError{Field: "model", Message: err.Error()})
+	}
+	return fields
+}
+
+// checkGroups returns a problem for each group h is in that isn't one of known. Saves fail on hosts in
+// unknown groups, so they're kept out from the start.
+func checkGroups(h rt.Hosts, known map[string]bool) []fieldError {
+	fields := []fieldError{}
+	for _, g := range h.Groups {
+		if !known[g] {
+			fields = append(fields, fieldError{Field: "groups", Message: fmt.Sprintf("group %q doesn't exist", g)})
+		}
+	}
+	return fields
+}
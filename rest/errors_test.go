@@ -0,0 +1,56 @@
+// Protected by BSD 3 clause license
+
+package rest
+
+import (
+	"reflect"
+	"testing"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+	_ "github.com/networkbootstrap/ztpmanagercode/templategen/junos"
+)
+
+func TestCheckHost(t *testing.T) {
+	ok := rt.Hosts{FixedIP: "10.0.0.1", HostName: "sw1", Vendor: "junos", Groups: []string{"lab"}}
+	known := map[string]bool{"lab": true, "core": true}
+
+	tests := []struct {
+		name   string
+		change func(h *rt.Hosts)
+		want   []string // Fields at fault
+	}{
+		{name: "fine", change: func(h *rt.Hosts) {}},
+		{name: "no vendor", change: func(h *rt.Hosts) { h.Vendor = "" }},
+		{name: "unknown vendor", change: func(h *rt.Hosts) { h.Vendor = "nope" }, want: []string{"vendor"}},
+		{name: "no address", change: func(h *rt.Hosts) { h.FixedIP = "" }, want: []string{"fixedipaddress"}},
+		{name: "IPv6 in the IPv4 field", change: func(h *rt.Hosts) { h.FixedIP = "2001:db8::1" }, want: []string{"fixedipaddress"}},
+		{name: "IPv6 only", change: func(h *rt.Hosts) { h.FixedIP, h.FixedIPv6 = "", "2001:db8::1" }},
+		{name: "bad ethernet", change: func(h *rt.Hosts) { h.Ethernet = "02:00" }, want: []string{"ethernetaddress"}},
+		{name: "no hostname", change: func(h *rt.Hosts) { h.HostName = "" }, want: []string{"hostname"}},
+		{name: "role with a slash", change: func(h *rt.Hosts) { h.Role = "leaf/x" }, want: []string{"role"}},
+		{name: "model climbing out", change: func(h *rt.Hosts) { h.Model = ".." }, want: []string{"model"}},
+		{name: "plain role and model", change: func(h *rt.Hosts) { h.Role, h.Model = "leaf", "qfx5100" }},
+		{name: "unknown group", change: func(h *rt.Hosts) { h.Groups = []string{"core", "dc9"} }, want: []string{"groups"}},
+		{
+			name:   "everything",
+			change: func(h *rt.Hosts) { *h = rt.Hosts{Vendor: "nope", Role: `a\b`, Groups: []string{"dc9"}} },
+			want:   []string{"vendor", "fixedipaddress", "hostname", "role", "groups"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := ok
+			tt.change(&h)
+			got := []string{}
+			for _, f := range append(checkHost(h), checkGroups(h, known)...) {
+				got = append(got, f.Field)
+			}
+			if tt.want == nil {
+				tt.want = []string{}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("fields at fault are %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package rest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo"
+	"github.com/networkbootstrap/ztpmanagercode/cache"
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// Page sizes for listing hosts
+const (
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// listedHost is a host as it's listed, with how far along it is with provisioning
+type listedHost struct {
+	rt.Hosts
+	State   string     `json:"state"`
+	Fetched *time.Time `json:"fetched,omitempty"`
+}
+
+// hostPage is a page of the host listing
+type hostPage struct {
+	Hosts []listedHost `json:"hosts"`
+	Total int          `json:"total"`          // How many hosts match, across every page
+	Next  string       `json:"next,omitempty"` // Cursor for the next page, if there is one
+}
+
+// What hosts can be sorted on, as a value that sorts the way the field should
+var sortFields = map[string]func(h listedHost) string{
+	"ethernetaddress":  func(h listedHost) string { return strings.ToLower(h.Ethernet) },
+	"fixedipaddress":   func(h listedHost) string { return rt.AddrOrder(h.FixedIP) },
+	"fixedipv6address": func(h listedHost) string { return rt.AddrOrder(h.FixedIPv6) },
+	"duid":             func(h listedHost) string { return strings.ToLower(h.DUID) },
+	"hostname":         func(h listedHost) string { return strings.ToLower(h.HostName) },
+	"imagefile":        func(h listedHost) string { return h.CfgImage },
+	"vendor":           func(h listedHost) string { return h.Vendor },
+	"model":            func(h listedHost) string { return strings.ToLower(h.Model) },
+	"role":             func(h listedHost) string { return strings.ToLower(h.Role) },
+	"revision":         func(h listedHost) string { return fmt.Sprintf("%020d", h.Revision) },
+	"state":            func(h listedHost) string { return h.State },
+}
+
+// cursor is where a page of the listing ends. The next page starts after it.
+type cursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	Key   string `json:"k"`
+}
+
+// hostFilter is what hosts have to match to be listed. Empty fields match everything.
+type hostFilter struct {
+	vendors  map[string]bool
+	hostname string // Glob, lower case
+	mac      string // Prefix, lower case hex without separators
+	subnet   *net.IPNet
+	states   map[string]bool
+}
+
+// getHosts lists hosts with their provisioning state, filtered, sorted and a page at a time.
+// The legacy route only ever listed their addresses.
+func (w WebFuncs) getHosts(c echo.Context) error {
+	if legacy(c) {
+		return c.JSON(http.StatusOK, w.store.Keys())
+	}
+
+	filter, err := parseHostFilter(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	field, desc := "fixedipaddress", false
+	if s := strings.ToLower(c.QueryParam("sort")); s != "" {
+		field, desc = strings.TrimPrefix(s, "-"), strings.HasPrefix(s, "-")
+	}
+	value, ok := sortFields[field]
+	if !ok {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("can't sort on %q, fields are: %s", field, strings.Join(sortFieldNames(), ", ")))
+	}
+	sortName := field
+	if desc {
+		sortName = "-" + field
+	}
+
+	limit := defaultPageSize
+	if l := c.QueryParam("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxPageSize {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("limit should be a number from 1 to %d", maxPageSize))
+		}
+	}
+
+	var after *cursor
+	if cur := c.QueryParam("cursor"); cur != "" {
+		if after, err = readCursor(cur); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "the cursor isn't one handed out by this listing")
+		}
+		if after.Sort != sortName {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("the cursor is for sort=%s, not sort=%s", after.Sort, sortName))
+		}
+	}
+
+	hosts := w.store.Snapshot()
+	states := w.store.Provisioning()
+	matched := []listedHost{}
+	for k := range hosts {
+		l := listedHost{Hosts: hosts[k].WithKey(k), State: cache.Pending}
+		if p, ok := states[k]; ok {
+			l.State = p.State
+			if !p.Fetched.IsZero() {
+				t := p.Fetched
+				l.Fetched = &t
+			}
+		}
+		if filter.match(k, l) {
+			matched = append(matched, l)
+		}
+	}
+
+	// Hosts that sort the same are in address order, so every host has its own place in the listing
+	at := func(h listedHost) cursor {
+		return cursor{Sort: sortName, Value: value(h), Key: h.Key()}
+	}
+	before := func(a cursor, b cursor) bool {
+		if desc {
+			a, b = b, a
+		}
+		if a.Value != b.Value {
+			return a.Value < b.Value
+		}
+		return rt.AddrLess(a.Key, b.Key)
+	}
+	sort.Slice(matched, func(i, j int) bool { return before(at(matched[i]), at(matched[j])) })
+
+	start := 0
+	if after != nil {
+		start = sort.Search(len(matched), func(i int) bool { return before(*after, at(matched[i])) })
+	}
+	end := start + limit
+	if end > len(matched) {
+		end = len(matched)
+	}
+
+	page := hostPage{Hosts: matched[start:end], Total: len(matched)}
+	if end < len(matched) {
+		page.Next = writeCursor(at(matched[end-1]))
+	}
+	return c.JSON(http.StatusOK, page)
+}
+
+// parseHostFilter reads the filters of a listing from the query
+func parseHostFilter(c echo.Context) (hostFilter, error) {
+	f := hostFilter{}
+	if v := c.QueryParam("vendor"); v != "" {
+		f.vendors = map[string]bool{}
+		for _, vendor := range strings.Split(v, ",") {
+			f.vendors[strings.ToLower(strings.TrimSpace(vendor))] = true
+		}
+	}
+	if name := c.QueryParam("hostname"); name != "" {
+		f.hostname = strings.ToLower(name)
+		if _, err := path.Match(f.hostname, ""); err != nil {
+			return f, fmt.Errorf("hostname %q isn't a valid glob", name)
+		}
+	}
+	if mac := c.QueryParam("mac"); mac != "" {
+		f.mac = macDigits(mac)
+	}
+	if subnet := c.QueryParam("subnet"); subnet != "" {
+		_, n, err := net.ParseCIDR(subnet)
+		if err != nil {
+			return f, fmt.Errorf("subnet %q should be in CIDR notation, like 192.168.50.0/24", subnet)
+		}
+		f.subnet = n
+	}
+	if s := c.QueryParam("state"); s != "" {
+		f.states = map[string]bool{}
+		for _, state := range strings.Split(s, ",") {
+			state = strings.ToLower(strings.TrimSpace(state))
+			if state != cache.Pending && state != cache.Saved && state != cache.Provisioned {
+				return f, fmt.Errorf("unknown state %q, expected one of: %s, %s, %s", state, cache.Pending, cache.Saved, cache.Provisioned)
+			}
+			f.states[state] = true
+		}
+	}
+	return f, nil
+}
+
+// match returns true if the host at key passes every filter
+func (f hostFilter) match(key string, h listedHost) bool {
+	if f.vendors != nil && !f.vendors[strings.ToLower(h.Vendor)] {
+		return false
+	}
+	if f.hostname != "" {
+		if ok, _ := path.Match(f.hostname, strings.ToLower(h.HostName)); !ok {
+			return false
+		}
+	}
+	if f.mac != "" && (h.Ethernet == "" || !strings.HasPrefix(macDigits(h.Ethernet), f.mac)) {
+		return false
+	}
+	if f.subnet != nil {
+		in := false
+		for _, addr := range []string{key, h.FixedIP, h.FixedIPv6} {
+			if ip := net.ParseIP(addr); ip != nil && f.subnet.Contains(ip) {
+				in = true
+			}
+		}
+		if !in {
+			return false
+		}
+	}
+	if f.states != nil && !f.states[h.State] {
+		return false
+	}
+	return true
+}
+
+// macDigits returns an ethernet address, or the start of one, as lower case hex without separators
+func macDigits(mac string) string {
+	return strings.NewReplacer(":", "", "-", "", ".", "").Replace(strings.ToLower(mac))
+}
+
+func sortFieldNames() []string {
+	names := []string{}
+	for name := range sortFields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func writeCursor(c cursor) string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func readCursor(s string) (*cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	c := &cursor{}
+	if err = json.Unmarshal(b, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
@@ -0,0 +1,133 @@
+// Protected by BSD 3 clause license
+
+package rest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"reflect"
+	"testing"
+
+	"github.com/labstack/echo"
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// listed is a store to list. Its vendors tie, and one host has no IPv4 address to sort on.
+var listed = map[string]rt.Hosts{
+	"10.0.0.1":    {FixedIP: "10.0.0.1", HostName: "a", Vendor: "junos"},
+	"10.0.0.2":    {FixedIP: "10.0.0.2", HostName: "b", Vendor: "junos"},
+	"10.0.0.3":    {FixedIP: "10.0.0.3", HostName: "c"},
+	"10.0.0.10":   {FixedIP: "10.0.0.10", HostName: "d", Vendor: "junos"},
+	"10.0.0.20":   {FixedIP: "10.0.0.20", HostName: "e"},
+	"2001:db8::1": {FixedIPv6: "2001:db8::1", HostName: "f", Vendor: "junos"},
+}
+
+// listPage gets a page of the listing
+func listPage(t *testing.T, e *echo.Echo, q url.Values) hostPage {
+	rec := serve(e, http.MethodGet, "/v1/hosts?"+q.Encode(), "", "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("listing %s answered %d: %s", q.Encode(), rec.Code, rec.Body)
+	}
+	p := hostPage{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestListPages(t *testing.T) {
+	tests := []struct {
+		name   string
+		sort   string
+		limit  string
+		delete []string // Deleted after the first page
+		want   []string
+	}{
+		{
+			name: "addresses", sort: "fixedipaddress", limit: "2",
+			want: []string{"2001:db8::1", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.10", "10.0.0.20"},
+		},
+		{
+			name: "one page", sort: "fixedipaddress", limit: "100",
+			want: []string{"2001:db8::1", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.10", "10.0.0.20"},
+		},
+		{
+			name: "addresses descending", sort: "-fixedipaddress", limit: "4",
+			want: []string{"10.0.0.20", "10.0.0.10", "10.0.0.3", "10.0.0.2", "10.0.0.1", "2001:db8::1"},
+		},
+		{
+			name: "ties in address order", sort: "vendor", limit: "1",
+			want: []string{"10.0.0.3", "10.0.0.20", "10.0.0.1", "10.0.0.2", "10.0.0.10", "2001:db8::1"},
+		},
+		{
+			name: "ties descending", sort: "-vendor", limit: "3",
+			want: []string{"2001:db8::1", "10.0.0.10", "10.0.0.2", "10.0.0.1", "10.0.0.20", "10.0.0.3"},
+		},
+		{
+			name: "last of the page deleted", sort: "fixedipaddress", limit: "3", delete: []string{"10.0.0.2"},
+			want: []string{"2001:db8::1", "10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.10", "10.0.0.20"},
+		},
+		{
+			name: "next deleted", sort: "hostname", limit: "2", delete: []string{"10.0.0.3"},
+			want: []string{"10.0.0.1", "10.0.0.2", "10.0.0.10", "10.0.0.20", "2001:db8::1"},
+		},
+		{
+			name: "tie deleted", sort: "-vendor", limit: "2", delete: []string{"10.0.0.10", "10.0.0.2"},
+			want: []string{"2001:db8::1", "10.0.0.10", "10.0.0.1", "10.0.0.20", "10.0.0.3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, w, stop := newAPI(t, listed)
+			defer stop()
+
+			got := []string{}
+			q := url.Values{"sort": {tt.sort}, "limit": {tt.limit}}
+			for n := 0; n <= len(listed); n++ {
+				p := listPage(t, e, q)
+				total := len(listed)
+				if n > 0 {
+					total -= len(tt.delete)
+				}
+				if p.Total != total {
+					t.Errorf("page %d has a total of %d, expected %d", n, p.Total, total)
+				}
+				for _, h := range p.Hosts {
+					got = append(got, h.Key())
+				}
+				if p.Next == "" {
+					break
+				}
+				if n == 0 {
+					for _, k := range tt.delete {
+						if _, err := w.store.Delete(k); err != nil {
+							t.Fatal(err)
+						}
+					}
+				}
+				q.Set("cursor", p.Next)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listed %v, expected %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestListCursorForAnotherSort(t *testing.T) {
+	e, _, stop := newAPI(t, listed)
+	defer stop()
+
+	next := listPage(t, e, url.Values{"sort": {"hostname"}, "limit": {"2"}}).Next
+	for _, sort := range []string{"-hostname", "vendor", ""} {
+		q := url.Values{"sort": {sort}, "cursor": {next}}
+		if rec := serve(e, http.MethodGet, "/v1/hosts?"+q.Encode(), "", ""); rec.Code != http.StatusBadRequest {
+			t.Errorf("cursor for sort=hostname answered %d with sort=%s, expected 400", rec.Code, sort)
+		}
+	}
+	q := url.Values{"cursor": {"bm90IGEgY3Vyc29y"}}
+	if rec := serve(e, http.MethodGet, "/v1/hosts?"+q.Encode(), "", ""); rec.Code != http.StatusBadRequest {
+		t.Errorf("a cursor that isn't one answered %d, expected 400", rec.Code)
+	}
+}
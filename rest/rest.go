@@ -1,140 +1,641 @@
 package rest
 
 import (
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
+	"github.com/networkbootstrap/ztpmanagercode/cache"
+	"github.com/networkbootstrap/ztpmanagercode/events"
 	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
 )
 
+// How often the event stream sends a comment when there are no events
+const eventKeepalive = 15 * time.Second
+
+// Where the current version of the API lives
+const apiPrefix = "/v1"
+
+// Set on the context of requests to routes from before /v1
+const legacyKey = "legacy"
+
 // WebFuncs is the base struct type for the web functions.
 // It was either this or wrap it. Urgh. This is easier :)
 type WebFuncs struct {
-	cachesend  chan rt.Envelope
+	store      *cache.Store
+	bus        *events.Broker
 	configsend chan rt.Envelope
 }
 
 func (w WebFuncs) getHost(c echo.Context) error {
-	ip := c.Param("ip")
+	h, err := w.store.Get(c.Param("ip"))
+	if err == cache.ErrNotFound && legacy(c) {
+		return c.NoContent(http.StatusNoContent)
+	}
+	if err != nil {
+		return storeError(err)
+	}
+
+	c.Response().Header().Set("ETag", etag(h))
+	for _, tag := range strings.Split(c.Request().Header.Get("If-None-Match"), ",") {
+		if tag = strings.TrimSpace(tag); tag == "*" || strings.TrimPrefix(tag, "W/") == etag(h) {
+			return c.NoContent(http.StatusNotModified)
+		}
+	}
+	return c.JSON(http.StatusOK, h)
+}
+
+// renderHost previews the device config of a host, or one of its scripts with ?file=
+func (w WebFuncs) renderHost(c echo.Context) error {
+	h, err := w.store.Get(c.Param("ip"))
+	if err != nil {
+		return storeError(err)
+	}
+
 	req := rt.Envelope{}
-	req.CRUD = rt.READHOST
+	req.CRUD = rt.RENDERHOST
+	req.Hosts = h
+	req.String = c.QueryParam("file")
 	req.Response = make(chan rt.Envelope, 1)
-	req.FixedIP = ip
-	w.cachesend <- req
+	w.configsend <- req
 	resp := <-req.Response
 
 	if resp.CRUD == rt.OK {
-		return c.JSON(http.StatusOK, resp)
+		return c.String(http.StatusOK, resp.String)
 	}
-	return c.NoContent(http.StatusNoContent)
+	return echo.NewHTTPError(http.StatusBadRequest, resp.String)
 }
 
-func (w WebFuncs) getHosts(c echo.Context) error {
+// renderDHCP previews the DHCP host stanza of a host for the configured backend
+func (w WebFuncs) renderDHCP(c echo.Context) error {
+	h, err := w.store.Get(c.Param("ip"))
+	if err != nil {
+		return storeError(err)
+	}
+
 	req := rt.Envelope{}
-	req.CRUD = rt.READHOSTS
+	req.CRUD = rt.RENDERDHCP
+	req.Hosts = h
 	req.Response = make(chan rt.Envelope, 1)
-	w.cachesend <- req
+	w.configsend <- req
 	resp := <-req.Response
 
-	return c.JSON(http.StatusOK, resp.HostList)
+	if resp.CRUD == rt.OK {
+		return c.String(http.StatusOK, resp.String)
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, resp.String)
 }
 
 func (w WebFuncs) deleteHost(c echo.Context) error {
-	ip := c.Param("ip")
-
-	// Has to be in this order. On the second layer down, the actual cache entry is removed, leaving us just with files.
-	req1 := rt.Envelope{}
-	req1.CRUD = rt.DELETE
-	req1.Response = make(chan rt.Envelope, 1)
-	req1.FixedIP = ip
-	w.configsend <- req1
-	resp1 := <-req1.Response
-
-	if resp1.CRUD == rt.OK {
-		req2 := rt.Envelope{}
-		req2.CRUD = rt.DELETE
-		req2.FixedIP = ip
-		req2.Response = make(chan rt.Envelope, 1)
-		w.cachesend <- req2
-		resp2 := <-req2.Response
-
-		if resp2.CRUD == rt.OK {
-			return c.NoContent(http.StatusAccepted)
-		}
+	revision, err := w.matchRevision(c, c.Param("ip"))
+	if err != nil {
+		return err
+	}
+	h, err := w.store.CompareAndDelete(c.Param("ip"), revision)
+	if err == cache.ErrNotFound && legacy(c) {
+		return c.NoContent(http.StatusBadRequest)
 	}
-	return c.NoContent(http.StatusBadRequest)
+	if err != nil {
+		return storeError(err)
+	}
+
+	// The host's files go on the next save
+	req := rt.Envelope{}
+	req.CRUD = rt.DELETE
+	req.Hosts = h
+	req.Response = make(chan rt.Envelope, 1)
+	w.configsend <- req
+	<-req.Response
+
+	return c.NoContent(http.StatusAccepted)
 }
 
 func (w WebFuncs) createHost(c echo.Context) error {
 	h := new(rt.Hosts)
-	if err := c.Bind(h); err != nil {
+	if err := bindHost(c, h); err != nil {
+		return err
+	}
+	if fields := append(checkHost(*h), checkGroups(*h, w.groupNames())...); len(fields) > 0 {
+		return invalid("the host isn't valid", fields...)
+	}
+	h.Vendor = strings.ToLower(h.Vendor)
+
+	created, err := w.store.Create(*h)
+	if err != nil {
+		return storeError(err)
+	}
+	c.Response().Header().Set("ETag", etag(created))
+	if legacy(c) {
+		return c.JSON(http.StatusOK, created)
+	}
+	c.Response().Header().Set(echo.HeaderLocation, apiPrefix+"/hosts/"+created.Key())
+	return c.JSON(http.StatusCreated, created)
+}
+
+func (w WebFuncs) updateHost(c echo.Context) error {
+	h := new(rt.Hosts)
+	if err := bindHost(c, h); err != nil {
 		return err
 	}
+	if fields := append(checkHost(*h), checkGroups(*h, w.groupNames())...); len(fields) > 0 {
+		return invalid("the host isn't valid", fields...)
+	}
+	h.Vendor = strings.ToLower(h.Vendor)
+
+	revision, err := w.matchRevision(c, c.Param("ip"))
+	if err != nil {
+		return err
+	}
+	updated, err := w.store.CompareAndSwap(c.Param("ip"), revision, *h)
+	if err == cache.ErrNotFound && legacy(c) {
+		// The old API put the host there whether or not there was one already
+		updated, err = w.store.Create(*h)
+	}
+	if err != nil {
+		return storeError(err)
+	}
+	c.Response().Header().Set("ETag", etag(updated))
+	return c.JSON(http.StatusOK, updated)
+}
+
+// bindHost reads the host in the body of a request into h. Legacy routes took form and XML bodies as well
+// as JSON, and still do.
+func bindHost(c echo.Context, h *rt.Hosts) error {
+	if legacy(c) {
+		return c.Bind(h)
+	}
+	return bindJSON(c, h)
+}
+
+// etag returns the ETag of a host, which is its revision
+func etag(h rt.Hosts) string {
+	return fmt.Sprintf("%q", strconv.FormatUint(h.Revision, 10))
+}
 
+// matchRevision checks the If-Match header of a request against the host at key, and returns the revision
+// to compare-and-swap against. That's 0, any revision, if there's no If-Match. An If-Match none of whose
+// ETags are the host's current one is a 412.
+func (w WebFuncs) matchRevision(c echo.Context, key string) (uint64, error) {
+	header := c.Request().Header.Get("If-Match")
+	if header == "" {
+		return 0, nil
+	}
+	h, err := w.store.Get(key)
+	if err != nil {
+		return 0, storeError(err)
+	}
+	for _, tag := range strings.Split(header, ",") {
+		// Weak ETags never match here
+		if tag = strings.TrimSpace(tag); tag == "*" || tag == etag(h) {
+			return h.Revision, nil
+		}
+	}
+	return 0, echo.NewHTTPError(http.StatusPreconditionFailed, fmt.Sprintf("host %s has changed, its ETag is now %s", key, etag(h)))
+}
+
+// storeError turns an error from the host store into an HTTP error
+func storeError(err error) error {
+	if err == cache.ErrNotFound {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	if _, ok := err.(*cache.ConflictError); ok {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	if _, ok := err.(*cache.RevisionError); ok {
+		return echo.NewHTTPError(http.StatusPreconditionFailed, err.Error())
+	}
+	if _, ok := err.(*cache.PersistError); ok {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+}
+
+// groupBody is what a group looks like over the API
+type groupBody struct {
+	Name string  `json:"name"`
+	Vars rt.Vars `json:"vars"`
+}
+
+// groupNames returns the names of the groups there are
+func (w WebFuncs) groupNames() map[string]bool {
+	req := rt.Envelope{}
+	req.CRUD = rt.READGROUPS
+	req.Response = make(chan rt.Envelope, 1)
+	w.configsend <- req
+	resp := <-req.Response
+
+	names := map[string]bool{}
+	for _, g := range resp.GroupList {
+		names[g] = true
+	}
+	return names
+}
+
+func (w WebFuncs) getGroups(c echo.Context) error {
 	req := rt.Envelope{}
-	req.CRUD = rt.CREATE
-	req.FixedIP = h.FixedIP
-	req.CfgFile = h.CfgFile
-	req.CfgImage = h.CfgImage
-	req.Ethernet = h.Ethernet
-	req.HostName = h.HostName
-	req.Vendor = strings.ToLower(h.Vendor)
+	req.CRUD = rt.READGROUPS
+	req.Response = make(chan rt.Envelope, 1)
+	w.configsend <- req
+	resp := <-req.Response
 
+	return c.JSON(http.StatusOK, resp.GroupList)
+}
+
+func (w WebFuncs) getGroup(c echo.Context) error {
+	req := rt.Envelope{}
+	req.CRUD = rt.READGROUP
+	req.Group = c.Param("name")
 	req.Response = make(chan rt.Envelope, 1)
-	w.cachesend <- req
+	w.configsend <- req
 	resp := <-req.Response
 
 	if resp.CRUD == rt.OK {
-		return c.JSON(http.StatusOK, h)
+		return c.JSON(http.StatusOK, groupBody{Name: resp.Group, Vars: resp.Vars})
 	}
-	return c.NoContent(http.StatusBadRequest)
+	return echo.NewHTTPError(http.StatusNotFound, fmt.Sprintf("unknown group %q", c.Param("name")))
 }
 
-func (w WebFuncs) updateHost(c echo.Context) error {
-	h := new(rt.Hosts)
-	if err := c.Bind(h); err != nil {
+func (w WebFuncs) updateGroup(c echo.Context) error {
+	g := new(groupBody)
+	if err := bindJSON(c, g); err != nil {
 		return err
 	}
+	g.Name = c.Param("name")
 
-	ip := c.Param("ip")
+	req := rt.Envelope{}
+	req.CRUD = rt.UPDATEGROUP
+	req.Group = g.Name
+	req.Vars = g.Vars
+	req.Response = make(chan rt.Envelope, 1)
+	w.configsend <- req
+	resp := <-req.Response
 
+	if resp.CRUD == rt.OK {
+		return c.JSON(http.StatusOK, g)
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, resp.String)
+}
+
+func (w WebFuncs) deleteGroup(c echo.Context) error {
 	req := rt.Envelope{}
-	req.CRUD = rt.UPDATE
-	req.UpdateIP = ip
-	req.FixedIP = h.FixedIP
-	req.CfgFile = h.CfgFile
-	req.CfgImage = h.CfgImage
-	req.Ethernet = h.Ethernet
-	req.HostName = h.HostName
+	req.CRUD = rt.DELETEGROUP
+	req.Group = c.Param("name")
 	req.Response = make(chan rt.Envelope, 1)
-	w.cachesend <- req
+	w.configsend <- req
 	resp := <-req.Response
 
 	if resp.CRUD == rt.OK {
-		return c.JSON(http.StatusOK, h)
+		return c.NoContent(http.StatusAccepted)
+	}
+	// The group either isn't there or still has hosts
+	if resp.Group == "" {
+		return echo.NewHTTPError(http.StatusNotFound, resp.String)
 	}
-	return c.NoContent(http.StatusBadRequest)
+	return echo.NewHTTPError(http.StatusConflict, resp.String)
+}
+
+// saveResult is what a save answers with
+type saveResult struct {
+	Generation int             `json:"generation,omitempty"` // Not set if the generation couldn't be kept
+	Commit     string          `json:"commit,omitempty"`     // Not set without GitRepository, or if nothing changed
+	Hooks      []rt.HookResult `json:"hooks"`
+}
+
+// saveFailure is what a failed save or dry run answers with
+type saveFailure struct {
+	Message  string          `json:"message"`
+	Problems []rt.Problem    `json:"problems,omitempty"`
+	Hooks    []rt.HookResult `json:"hooks,omitempty"`
+}
+
+// saveStatus is the status a failed save answers with, by the step it failed at. Anything not listed is a 500.
+var saveStatus = map[string]int{
+	"check":      http.StatusUnprocessableEntity,
+	"validate":   http.StatusUnprocessableEntity, // Only if the check command found problems, it may not have run
+	"conflict":   http.StatusConflict,
+	"generation": http.StatusNotFound,
+	"pre-save":   http.StatusBadGateway,
+	"reload":     http.StatusBadGateway,
+}
+
+// saveError returns the error for a failed save, dry run or rollback. The legacy /save always answered 400.
+func saveError(c echo.Context, resp rt.Envelope) error {
+	code, ok := saveStatus[resp.Step]
+	if !ok || (resp.Step == "validate" && len(resp.Problems) == 0) {
+		code = http.StatusInternalServerError
+	}
+	if legacy(c) {
+		code = http.StatusBadRequest
+	}
+	return echo.NewHTTPError(code, saveFailure{Message: resp.String, Problems: resp.Problems, Hooks: resp.Hooks})
 }
 
 func (w WebFuncs) save(c echo.Context) error {
+	if dryrun, _ := strconv.ParseBool(c.QueryParam("dryrun")); dryrun {
+		return w.saveDryRun(c)
+	}
+
 	req := rt.Envelope{}
 	req.CRUD = rt.SAVECFG
+	req.User = user(c)
 	req.Response = make(chan rt.Envelope, 1)
 	w.configsend <- req
 	resp := <-req.Response
 
 	if resp.CRUD == rt.OK {
-		return c.NoContent(http.StatusAccepted)
+		return c.JSON(http.StatusAccepted, saveResult{Generation: resp.To, Commit: resp.String, Hooks: resp.Hooks})
+	}
+	// Names the step that failed, the files on disk are as they were before the save
+	return saveError(c, resp)
+}
+
+// saveDryRun returns a diff of every file a save would write or delete, without saving
+func (w WebFuncs) saveDryRun(c echo.Context) error {
+	req := rt.Envelope{}
+	req.CRUD = rt.DRYRUN
+	req.Response = make(chan rt.Envelope, 1)
+	w.configsend <- req
+	resp := <-req.Response
+
+	if resp.CRUD == rt.OK {
+		return c.JSON(http.StatusOK, resp.Changes)
+	}
+	return saveError(c, resp)
+}
+
+func (w WebFuncs) getGenerations(c echo.Context) error {
+	req := rt.Envelope{}
+	req.CRUD = rt.READGENS
+	req.Response = make(chan rt.Envelope, 1)
+	w.configsend <- req
+	resp := <-req.Response
+
+	if resp.CRUD == rt.OK {
+		return c.JSON(http.StatusOK, resp.Gens)
+	}
+	return echo.NewHTTPError(http.StatusInternalServerError, resp.String)
+}
+
+// diffGenerations returns a diff of every file that changed between two generations
+func (w WebFuncs) diffGenerations(c echo.Context) error {
+	from, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "generation must be a number")
+	}
+	to, err := strconv.Atoi(c.Param("to"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "generation must be a number")
+	}
+
+	req := rt.Envelope{}
+	req.CRUD = rt.DIFFGENS
+	req.From = from
+	req.To = to
+	req.Response = make(chan rt.Envelope, 1)
+	w.configsend <- req
+	resp := <-req.Response
+
+	if resp.CRUD == rt.OK {
+		return c.JSON(http.StatusOK, resp.Changes)
+	}
+	return echo.NewHTTPError(http.StatusNotFound, resp.String)
+}
+
+// rollback puts the hosts and groups of a generation back and saves them, which makes a new generation
+func (w WebFuncs) rollback(c echo.Context) error {
+	n, err := strconv.Atoi(c.Param("n"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "generation must be a number")
+	}
+
+	req := rt.Envelope{}
+	req.CRUD = rt.ROLLBACK
+	req.To = n
+	req.User = user(c)
+	req.Response = make(chan rt.Envelope, 1)
+	w.configsend <- req
+	resp := <-req.Response
+
+	if resp.CRUD == rt.OK {
+		return c.JSON(http.StatusAccepted, saveResult{Generation: resp.To, Commit: resp.String, Hooks: resp.Hooks})
+	}
+	return saveError(c, resp)
+}
+
+// getGitLog returns the latest commits saves made, newest first. limit defaults to 50.
+func (w WebFuncs) getGitLog(c echo.Context) error {
+	limit := 50
+	if l := c.QueryParam("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit must be a positive number")
+		}
+		limit = n
+	}
+
+	req := rt.Envelope{}
+	req.CRUD = rt.GITLOG
+	req.Limit = limit
+	req.Response = make(chan rt.Envelope, 1)
+	w.configsend <- req
+	resp := <-req.Response
+
+	if resp.CRUD == rt.OK {
+		return c.JSON(http.StatusOK, resp.Commits)
+	}
+	return echo.NewHTTPError(http.StatusNotFound, resp.String)
+}
+
+// exportConfig returns config.toml as it would be saved now, without saving it
+func (w WebFuncs) exportConfig(c echo.Context) error {
+	req := rt.Envelope{}
+	req.CRUD = rt.EXPORTCFG
+	req.Response = make(chan rt.Envelope, 1)
+	w.configsend <- req
+	resp := <-req.Response
+
+	if resp.CRUD == rt.OK {
+		return c.String(http.StatusOK, resp.String)
 	}
-	return c.NoContent(http.StatusBadRequest)
+	return echo.NewHTTPError(http.StatusInternalServerError, resp.String)
+}
+
+// importResult is what an import answers with
+type importResult struct {
+	Hosts  []string `json:"hosts"`
+	Groups []string `json:"groups"`
+}
+
+// importConfig swaps the hosts and groups for the ones in the config.toml sent. They're deployed by the next save.
+func (w WebFuncs) importConfig(c echo.Context) error {
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	req := rt.Envelope{}
+	req.CRUD = rt.IMPORTCFG
+	req.String = string(body)
+	req.Response = make(chan rt.Envelope, 1)
+	w.configsend <- req
+	resp := <-req.Response
+
+	if resp.CRUD == rt.OK {
+		return c.JSON(http.StatusOK, importResult{Hosts: resp.HostList, Groups: resp.GroupList})
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, resp.String)
+}
+
+// streamEvents sends host changes and saves as Server-Sent Events until the client goes away.
+// ?type= picks the event types wanted, comma separated. A client that reconnects with Last-Event-ID
+// gets the events it missed first, or a reset event if they're no longer held.
+func (w WebFuncs) streamEvents(c echo.Context) error {
+	after := c.Request().Header.Get("Last-Event-ID")
+	wanted := map[string]bool{}
+	for _, t := range strings.Split(c.QueryParam("type"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			wanted[t] = true
+		}
+	}
+
+	sub, cancel := w.bus.Subscribe(after)
+	defer cancel()
+
+	r := c.Response()
+	r.Header().Set(echo.HeaderContentType, "text/event-stream")
+	r.Header().Set("Cache-Control", "no-cache")
+	r.Header().Set("Connection", "keep-alive")
+	r.WriteHeader(http.StatusOK)
+	r.Flush()
+
+	// Comments keep proxies from timing the stream out when nothing's happening
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub:
+			if !ok {
+				// Too far behind, the client can reconnect with Last-Event-ID
+				return nil
+			}
+			// Whatever the client is after, it has to know it missed some
+			if len(wanted) > 0 && !wanted[e.Type] && e.Type != events.Reset {
+				continue
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+			if _, err = fmt.Fprintf(r, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Type, data); err != nil {
+				return nil
+			}
+			r.Flush()
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(r, ": keepalive\n\n"); err != nil {
+				return nil
+			}
+			r.Flush()
+		case <-c.Request().Context().Done():
+			return nil
+		}
+	}
+}
+
+// user returns who made the request, as given to basic auth
+func user(c echo.Context) string {
+	name, _, _ := c.Request().BasicAuth()
+	return name
+}
+
+// router is what routes are added to, the server itself or a group of its routes
+type router interface {
+	GET(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+	POST(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+	PUT(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+	DELETE(path string, h echo.HandlerFunc, m ...echo.MiddlewareFunc) *echo.Route
+}
+
+// routes adds every route of the API to r, each with m
+func (w WebFuncs) routes(r router, m ...echo.MiddlewareFunc) {
+	r.POST("/save", w.save, m...)
+	r.POST("/hosts", w.createHost, m...)
+	r.GET("/hosts", w.getHosts, m...)
+	r.POST("/hosts/import", w.importHosts, m...)
+	r.GET("/hosts/export", w.exportHosts, m...)
+	r.GET("/hosts/:ip", w.getHost, m...)
+	r.DELETE("/hosts/:ip", w.deleteHost, m...)
+	r.PUT("/hosts/:ip", w.updateHost, m...)
+	r.GET("/hosts/:ip/render", w.renderHost, m...)
+	r.GET("/hosts/:ip/dhcp", w.renderDHCP, m...)
+	r.GET("/groups", w.getGroups, m...)
+	r.GET("/groups/:name", w.getGroup, m...)
+	r.PUT("/groups/:name", w.updateGroup, m...)
+	r.DELETE("/groups/:name", w.deleteGroup, m...)
+	r.GET("/generations", w.getGenerations, m...)
+	r.GET("/generations/:n/diff/:to", w.diffGenerations, m...)
+	r.POST("/generations/:n/rollback", w.rollback, m...)
+	r.GET("/git/log", w.getGitLog, m...)
+	r.GET("/config", w.exportConfig, m...)
+	r.POST("/config", w.importConfig, m...)
+	r.GET("/events", w.streamEvents, m...)
+}
+
+// legacyRoutes adds the routes there were before /v1 to r, each with m. Anything newer is only under /v1.
+func (w WebFuncs) legacyRoutes(r router, m ...echo.MiddlewareFunc) {
+	r.POST("/save", w.save, m...)
+	r.POST("/save/", w.save, m...)
+	r.POST("/hosts", w.createHost, m...)
+	r.GET("/hosts", w.getHosts, m...)
+	r.GET("/hosts/", w.getHosts, m...)
+	r.GET("/hosts/:ip", w.getHost, m...)
+	r.DELETE("/hosts/:ip", w.deleteHost, m...)
+	r.PUT("/hosts/:ip", w.updateHost, m...)
+}
+
+// deprecated marks a route from before /v1, pointing at the /v1 route that replaces it
+func deprecated(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Set(legacyKey, true)
+		successor := apiPrefix + strings.TrimSuffix(c.Request().URL.Path, "/")
+		c.Response().Header().Set("Deprecation", "true")
+		c.Response().Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+		return next(c)
+	}
+}
+
+// legacy returns true if the request came in on a route from before /v1. Those keep answering the way they
+// always have, where that differs.
+func legacy(c echo.Context) bool {
+	l, _ := c.Get(legacyKey).(bool)
+	return l
 }
 
 // StartCfgAPI starts the JSON config API server...
-func StartCfgAPI(cachesend chan rt.Envelope, configsend chan rt.Envelope, port int, httpuser string, httppasswd string) (echoSrv *echo.Echo, err error) {
-	echoSrv = echo.New()
+func StartCfgAPI(store *cache.Store, bus *events.Broker, configsend chan rt.Envelope, port int, httpuser string, httppasswd string) (echoSrv *echo.Echo, err error) {
+	echoSrv = newCfgAPI(store, bus, configsend, httpuser, httppasswd)
+	echoport := fmt.Sprintf(":%v", port)
+
+	// Start server
+	go func() {
+		if err := echoSrv.Start(echoport); err != nil {
+			return
+		}
+	}()
+
+	return echoSrv, nil
+}
+
+// newCfgAPI returns the config API server with all of its routes, not yet started
+func newCfgAPI(store *cache.Store, bus *events.Broker, configsend chan rt.Envelope, httpuser string, httppasswd string) *echo.Echo {
+	echoSrv := echo.New()
 
 	echoSrv.Use(middleware.BasicAuth(func(username, password string, c echo.Context) (bool, error) {
 		if username == httpuser && password == httppasswd {
@@ -146,38 +647,40 @@ func StartCfgAPI(cachesend chan rt.Envelope, configsend chan rt.Envelope, port i
 	echoSrv.Use(middleware.Recover())
 	echoSrv.HideBanner = true
 	web := WebFuncs{}
-	web.cachesend = cachesend
+	web.store = store
+	web.bus = bus
 	web.configsend = configsend
 
-	// Routes
-	echoSrv.POST("/save", web.save)
-	echoSrv.POST("/save/", web.save)
-	echoSrv.POST("/hosts", web.createHost)
-	echoSrv.GET("/hosts", web.getHosts)
-	echoSrv.GET("/hosts/", web.getHosts)
-	echoSrv.GET("/hosts/:ip", web.getHost)
-	echoSrv.DELETE("/hosts/:ip", web.deleteHost)
-	echoSrv.PUT("/hosts/:ip", web.updateHost)
-	echoport := fmt.Sprintf(":%v", port)
+	echoSrv.HTTPErrorHandler = errorHandler(echoSrv)
 
-	// Start server
-	go func() {
-		if err := echoSrv.Start(echoport); err != nil {
-			return
-		}
-	}()
+	// Routes. The ones from before /v1 stay where they were, for now.
+	web.routes(echoSrv.Group(apiPrefix))
+	web.legacyRoutes(echoSrv, deprecated)
 
-	return echoSrv, nil
+	return echoSrv
 }
 
 // StartStaticAPI starts the file server...
-func StartStaticAPI(configfiles string, imagesfiles string, configname string, imagesname string) (echoSrv *echo.Echo, err error) {
+func StartStaticAPI(store *cache.Store, configfiles string, imagesfiles string, configname string, imagesname string) (echoSrv *echo.Echo, err error) {
 	echoSrv = echo.New()
 	echoSrv.Use(middleware.Recover())
 
 	cfgprefix := fmt.Sprintf("/%s", configname)
 	imgprefix := fmt.Sprintf("/%s", imagesname)
 
+	// A host that fetches one of its configs or scripts is provisioned
+	echoSrv.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := next(c)
+			if err == nil && c.Response().Status == http.StatusOK && strings.HasPrefix(c.Request().URL.Path, cfgprefix+"/") {
+				if addr, _, e := net.SplitHostPort(c.Request().RemoteAddr); e == nil {
+					store.MarkFetched(addr)
+				}
+			}
+			return err
+		}
+	})
+
 	echoSrv.Static(cfgprefix, configfiles)
 	echoSrv.Static(imgprefix, imagesfiles)
 	echoSrv.HideBanner = true
@@ -0,0 +1,207 @@
+// Protected by BSD 3 clause license
+
+package rest
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/labstack/echo"
+	"github.com/networkbootstrap/ztpmanagercode/cache"
+	"github.com/networkbootstrap/ztpmanagercode/cfg"
+	"github.com/networkbootstrap/ztpmanagercode/events"
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// newWebFuncs returns WebFuncs over a store of hosts, answered by the config responder of a config with
+// one group, "lab". stop has to be called once the test is done.
+func newWebFuncs(t *testing.T, hosts map[string]rt.Hosts) (w WebFuncs, stop func()) {
+	c := cfg.NewCfg()
+	c.Groups["lab"] = cfg.GroupCfg{Vars: rt.Vars{"ntp": "10.9.0.254"}}
+	store, err := cache.New(hosts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bus := events.NewBroker()
+	store.SetBroker(bus)
+
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	configsend, finish := c.APIResponder(store, bus, "config.toml", wg)
+	w = WebFuncs{store: store, bus: bus, configsend: configsend}
+	return w, func() {
+		close(finish)
+		wg.Wait()
+	}
+}
+
+// newAPI returns the config API server over a store of hosts, as newWebFuncs does, with the user and
+// password serve logs in as
+func newAPI(t *testing.T, hosts map[string]rt.Hosts) (e *echo.Echo, w WebFuncs, stop func()) {
+	w, stop = newWebFuncs(t, hosts)
+	return newCfgAPI(w.store, w.bus, w.configsend, "admin", "secret"), w, stop
+}
+
+// serve sends a request through every route and middleware of e
+func serve(e *echo.Echo, method string, target string, contentType string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	req.SetBasicAuth("admin", "secret")
+	if contentType != "" {
+		req.Header.Set(echo.HeaderContentType, contentType)
+	}
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+// call runs handler for a request, and returns the status it answered with
+func call(handler echo.HandlerFunc, method string, target string, contentType string, body io.Reader) (*httptest.ResponseRecorder, error) {
+	e := echo.New()
+	req := httptest.NewRequest(method, target, body)
+	if contentType != "" {
+		req.Header.Set(echo.HeaderContentType, contentType)
+	}
+	rec := httptest.NewRecorder()
+	return rec, handler(e.NewContext(req, rec))
+}
+
+func TestRoutes(t *testing.T) {
+	sw1 := rt.Hosts{FixedIP: "10.0.0.1", HostName: "sw1", Ethernet: "02:00:00:00:00:01", Vendor: "junos", Groups: []string{"lab"}}
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		contentType string
+		body        string
+		want        int
+		deprecated  bool
+	}{
+		{name: "get", method: http.MethodGet, target: "/v1/hosts/10.0.0.1", want: http.StatusOK},
+		{name: "legacy get", method: http.MethodGet, target: "/hosts/10.0.0.1", want: http.StatusOK, deprecated: true},
+		{name: "get missing", method: http.MethodGet, target: "/v1/hosts/10.0.0.9", want: http.StatusNotFound},
+		{name: "legacy get missing", method: http.MethodGet, target: "/hosts/10.0.0.9", want: http.StatusNoContent, deprecated: true},
+		{name: "legacy list with a slash", method: http.MethodGet, target: "/hosts/", want: http.StatusOK, deprecated: true},
+		{
+			name: "create", method: http.MethodPost, target: "/v1/hosts", contentType: echo.MIMEApplicationJSON,
+			body: `{"fixedipaddress": "10.0.0.2", "hostname": "sw2"}`, want: http.StatusCreated,
+		},
+		{
+			name: "legacy create", method: http.MethodPost, target: "/hosts", contentType: echo.MIMEApplicationJSON,
+			body: `{"fixedipaddress": "10.0.0.2", "hostname": "sw2"}`, want: http.StatusOK, deprecated: true,
+		},
+		{
+			name: "create from a form", method: http.MethodPost, target: "/v1/hosts", contentType: echo.MIMEApplicationForm,
+			body: "fixedip=10.0.0.2&hostname=sw2", want: http.StatusBadRequest,
+		},
+		{
+			name: "legacy create from a form", method: http.MethodPost, target: "/hosts", contentType: echo.MIMEApplicationForm,
+			body: "fixedip=10.0.0.2&hostname=sw2", want: http.StatusOK, deprecated: true,
+		},
+		{
+			name: "legacy create from XML", method: http.MethodPost, target: "/hosts", contentType: echo.MIMEApplicationXML,
+			body: "<Hosts><FixedIP>10.0.0.2</FixedIP><HostName>sw2</HostName></Hosts>", want: http.StatusOK, deprecated: true,
+		},
+		{
+			name: "update missing", method: http.MethodPut, target: "/v1/hosts/10.0.0.2", contentType: echo.MIMEApplicationJSON,
+			body: `{"fixedipaddress": "10.0.0.2", "hostname": "sw2"}`, want: http.StatusNotFound,
+		},
+		{
+			name: "legacy update missing", method: http.MethodPut, target: "/hosts/10.0.0.2", contentType: echo.MIMEApplicationJSON,
+			body: `{"fixedipaddress": "10.0.0.2", "hostname": "sw2"}`, want: http.StatusOK, deprecated: true,
+		},
+		{name: "delete missing", method: http.MethodDelete, target: "/v1/hosts/10.0.0.9", want: http.StatusNotFound},
+		{name: "legacy delete missing", method: http.MethodDelete, target: "/hosts/10.0.0.9", want: http.StatusBadRequest, deprecated: true},
+		{name: "groups", method: http.MethodGet, target: "/v1/groups", want: http.StatusOK},
+		{name: "no legacy groups", method: http.MethodGet, target: "/groups", want: http.StatusNotFound},
+		{name: "no legacy generations", method: http.MethodGet, target: "/generations/", want: http.StatusNotFound},
+		{name: "no legacy config", method: http.MethodGet, target: "/config", want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, w, stop := newAPI(t, map[string]rt.Hosts{"10.0.0.1": sw1})
+			defer stop()
+
+			rec := serve(e, tt.method, tt.target, tt.contentType, tt.body)
+			if rec.Code != tt.want {
+				t.Errorf("answered %d, expected %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			if deprecated := rec.Header().Get("Deprecation") == "true"; deprecated != tt.deprecated {
+				t.Errorf("deprecated is %v, expected %v", deprecated, tt.deprecated)
+			}
+			if tt.want == http.StatusOK && tt.method != http.MethodGet {
+				if h, err := w.store.Get("10.0.0.2"); err != nil || h.HostName != "sw2" {
+					t.Errorf("store has %v, %v, expected sw2 at 10.0.0.2", h, err)
+				}
+			}
+		})
+	}
+}
+
+func TestHostETags(t *testing.T) {
+	sw1 := rt.Hosts{FixedIP: "10.0.0.1", HostName: "sw1", Ethernet: "02:00:00:00:00:01"}
+	update := `{"fixedipaddress": "10.0.0.1", "hostname": "sw1-new"}`
+	tests := []struct {
+		name    string
+		method  string
+		header  string
+		value   string // Sent with the current ETag in place of CURRENT
+		want    int
+		changed bool
+	}{
+		{name: "get", method: http.MethodGet, want: http.StatusOK},
+		{name: "get not modified", method: http.MethodGet, header: "If-None-Match", value: "CURRENT", want: http.StatusNotModified},
+		{name: "get weak not modified", method: http.MethodGet, header: "If-None-Match", value: "W/CURRENT", want: http.StatusNotModified},
+		{name: "get one of several", method: http.MethodGet, header: "If-None-Match", value: `"1", CURRENT`, want: http.StatusNotModified},
+		{name: "get any", method: http.MethodGet, header: "If-None-Match", value: "*", want: http.StatusNotModified},
+		{name: "get modified", method: http.MethodGet, header: "If-None-Match", value: `"1"`, want: http.StatusOK},
+		{name: "update", method: http.MethodPut, want: http.StatusOK, changed: true},
+		{name: "update matching", method: http.MethodPut, header: "If-Match", value: "CURRENT", want: http.StatusOK, changed: true},
+		{name: "update any", method: http.MethodPut, header: "If-Match", value: "*", want: http.StatusOK, changed: true},
+		{name: "update stale", method: http.MethodPut, header: "If-Match", value: `"1"`, want: http.StatusPreconditionFailed},
+		{name: "update weak", method: http.MethodPut, header: "If-Match", value: "W/CURRENT", want: http.StatusPreconditionFailed},
+		{name: "delete matching", method: http.MethodDelete, header: "If-Match", value: "CURRENT", want: http.StatusAccepted, changed: true},
+		{name: "delete stale", method: http.MethodDelete, header: "If-Match", value: `"1"`, want: http.StatusPreconditionFailed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, w, stop := newAPI(t, map[string]rt.Hosts{"10.0.0.1": sw1})
+			defer stop()
+			// Moves the host on from its first revision, so "1" is stale
+			before, err := w.store.Update("10.0.0.1", sw1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			current := etag(before)
+
+			body := ""
+			if tt.method == http.MethodPut {
+				body = update
+			}
+			req := httptest.NewRequest(tt.method, "/v1/hosts/10.0.0.1", strings.NewReader(body))
+			req.SetBasicAuth("admin", "secret")
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			if tt.header != "" {
+				req.Header.Set(tt.header, strings.Replace(tt.value, "CURRENT", current, -1))
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("answered %d, expected %d: %s", rec.Code, tt.want, rec.Body)
+			}
+			after, err := w.store.Get("10.0.0.1")
+			if changed := err != nil || after.Revision != before.Revision; changed != tt.changed {
+				t.Errorf("host changed is %v, expected %v", changed, tt.changed)
+			}
+			if rec.Code == http.StatusOK || rec.Code == http.StatusNotModified {
+				if got := rec.Header().Get("ETag"); got != etag(after) {
+					t.Errorf("ETag is %s, expected %s", got, etag(after))
+				}
+			}
+		})
+	}
+}
@@ -2,49 +2,166 @@
 // Protected by BSD 3 clause license
 package roottypes
 
-// Enums for CRUD operations
+import (
+	"encoding/hex"
+	"net"
+	"time"
+)
+
+// Enums for operations on the config, hosts themselves live in the cache store
 const (
-	// CREATE = create action
-	CREATE = iota
-	// READHOST = read action for a single host
-	READHOST
-	// READHOSTS = read the list of hosts currently in the cache
-	READHOSTS
-	// UPDATE = update action
-	UPDATE
-	// DELETE = delete action
-	DELETE
+	// DELETE = a host has been deleted, its files go on the next save
+	DELETE = iota
 	// OK = Response encoded
 	OK
 	// ERROR = oh dear
 	ERROR
-	// STRING = get in memory DB in text form
-	STRING
-	// LOCK = locks the cache for reading
-	LOCK
-	// UNLOCK = unlocks the cache for normal operations
-	UNLOCK
 	// SAVECFG = saves the actual config in TOML for this application
 	SAVECFG
-	// SAVEDHCPD = saves the DHCPD config and isc-dhcp config which contains the interface stuffs, it also generates device templates
+	// READGROUP = read a single group of hosts
+	READGROUP
+	// READGROUPS = read the list of groups
+	READGROUPS
+	// UPDATEGROUP = create or replace a group
+	UPDATEGROUP
+	// DELETEGROUP = delete a group
+	DELETEGROUP
+	// RENDERHOST = render a host's device config in memory
+	RENDERHOST
+	// RENDERDHCP = render a host's DHCP stanza in memory
+	RENDERDHCP
+	// DRYRUN = renders everything SAVECFG would and diffs it against the disk, without writing
+	DRYRUN
+	// READGENS = read the list of saved generations
+	READGENS
+	// DIFFGENS = diff the files of two generations
+	DIFFGENS
+	// ROLLBACK = puts the hosts and groups of a generation back and saves them
+	ROLLBACK
+	// EXPORTCFG = read the config as TOML, with the hosts as they are now
+	EXPORTCFG
+	// IMPORTCFG = swap the hosts and groups for the ones in a TOML config
+	IMPORTCFG
+	// GITLOG = read the latest commits of the git repository saves go to
+	GITLOG
 )
 
 // Envelope gives us a dirty way to use the channel without infecting the Hosts struct with a chan (causes encoding issues).
 type Envelope struct {
-	Response chan Envelope `json:"-" toml:"-"`
-	CRUD     int           `json:"-"`
-	String   string        `json:"-" toml:"-"`
-	HostList []string      `json:"-" toml:"-"`
+	Response  chan Envelope `json:"-" toml:"-"`
+	CRUD      int           `json:"-"`
+	String    string        `json:"-" toml:"-"`
+	HostList  []string      `json:"-" toml:"-"`
+	Group     string        `json:"-" toml:"-"`
+	GroupList []string      `json:"-" toml:"-"`
+	Changes   []FileChange  `json:"-" toml:"-"`
+	Problems  []Problem     `json:"-" toml:"-"`
+	Hooks     []HookResult  `json:"-" toml:"-"`
+	Step      string        `json:"-" toml:"-"` // What a failed save or rollback was at, a SaveError step or "generation", "conflict" or "persist"
+	User      string        `json:"-" toml:"-"` // Who asked, from basic auth
+	From      int           `json:"-" toml:"-"` // Generation numbers for DIFFGENS and ROLLBACK
+	To        int           `json:"-" toml:"-"`
+	Gens      []Generation  `json:"-" toml:"-"`
+	Commits   []Commit      `json:"-" toml:"-"`
+	Limit     int           `json:"-" toml:"-"` // How many entries to return, for GITLOG
 	Hosts
 }
 
 // Hosts holds data for a single DHCP ISC ZTP host
 type Hosts struct {
-	Ethernet string `json:"ethernetaddress" dhcpd:"hardware ethernet "`
-	FixedIP  string `json:"fixedipaddress" dhcpd:"fixed-address "`
-	HostName string `json:"hostname" dhcpd:"option host-name "`
-	CfgFile  string `json:"cfgfile" dhcpd:"option ezjunosztp.config-file-name " toml:"-"`
-	CfgImage string `json:"imagefile" dhcpd:"option ezjunosztp.image-file-name "`
-	UpdateIP string `json:"-" toml:"-"`
-	Vendor   string `json:"vendor"`
+	Ethernet  string   `json:"ethernetaddress" dhcpd:"hardware ethernet "`
+	FixedIP   string   `json:"fixedipaddress" dhcpd:"fixed-address "`
+	FixedIPv6 string   `json:"fixedipv6address" dhcpd:"fixed-address6 "`
+	DUID      string   `json:"duid" dhcpd:"host-identifier option dhcp6.client-id "`
+	HostName  string   `json:"hostname" dhcpd:"option host-name "`
+	CfgFile   string   `json:"cfgfile" dhcpd:"option ezjunosztp.config-file-name " toml:"-"`
+	CfgImage  string   `json:"imagefile" dhcpd:"option ezjunosztp.image-file-name "`
+	Vendor    string   `json:"vendor"`
+	Model     string   `json:"model" toml:",omitempty"`
+	Role      string   `json:"role" toml:",omitempty"`
+	Groups    []string `json:"groups" toml:",omitempty"`
+	Vars      Vars     `json:"vars" toml:",omitempty"`
+	Revision  uint64   `json:"revision" toml:"-"` // Set by the cache, bumped on every change
+}
+
+// FileChange is what a save would do to a single file
+type FileChange struct {
+	Path   string `json:"path"`
+	Action string `json:"action"` // "create", "modify" or "delete"
+	Diff   string `json:"diff"`   // Unified diff against the file on disk
+}
+
+// Problem is something wrong with the config that stops it from being saved
+type Problem struct {
+	Host    string   `json:"host,omitempty"` // Key of the host at fault, if there is one
+	File    string   `json:"file,omitempty"` // Generated file at fault, if there is one
+	Line    int      `json:"line,omitempty"`
+	Message string   `json:"message"`
+	Lines   []string `json:"lines,omitempty"` // The offending lines, numbered if they are quoted from a generated file
+}
+
+// HookResult is what a hook command did during a save
+type HookResult struct {
+	Hook     string `json:"hook"` // "pre-save", "reload" or "post-save"
+	Command  string `json:"command"`
+	ExitCode int    `json:"exitcode"` // -1 if it never ran or was killed
+	Output   string `json:"output"`
+	Duration string `json:"duration"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Generation describes a successful save
+type Generation struct {
+	Number int       `json:"generation"`
+	Time   time.Time `json:"time"`
+	Author string    `json:"author"`
+	Note   string    `json:"note,omitempty"`
+}
+
+// Commit is a commit in the git repository saves go to
+type Commit struct {
+	Commit  string    `json:"commit"`
+	Author  string    `json:"author"`
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// Vars holds template variables by name
+type Vars map[string]interface{}
+
+// Key returns the address a host is stored under. That's FixedIP, or FixedIPv6 for IPv6-only hosts.
+func (h Hosts) Key() string {
+	if h.FixedIP == "" {
+		return h.FixedIPv6
+	}
+	return h.FixedIP
+}
+
+// AddrOrder returns a value that sorts host addresses numerically, IPv4 before IPv6, when values are compared
+// as strings. An empty address sorts first and anything that isn't an address last, as is.
+func AddrOrder(addr string) string {
+	ip := net.ParseIP(addr)
+	switch {
+	case addr == "":
+		return ""
+	case ip == nil:
+		return "9" + addr
+	case ip.To4() != nil:
+		return "4" + hex.EncodeToString(ip.To4())
+	}
+	return "6" + hex.EncodeToString(ip.To16())
+}
+
+// AddrLess returns true if host address a sorts before b, in the order of AddrOrder
+func AddrLess(a string, b string) bool {
+	return AddrOrder(a) < AddrOrder(b)
+}
+
+// WithKey returns the host stored under key with its address filled in. Hosts from the config file
+// don't carry the address they're keyed on, IPv6-only hosts are keyed on their IPv6 address.
+func (h Hosts) WithKey(key string) Hosts {
+	if h.FixedIPv6 != key {
+		h.FixedIP = key
+	}
+	return h
 }
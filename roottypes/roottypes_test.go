@@ -0,0 +1,28 @@
+// Protected by BSD 3 clause license
+
+package roottypes
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func TestAddrLess(t *testing.T) {
+	want := []string{"", "10.0.0.2", "10.0.0.10", "192.168.0.1", "::1", "2001:db8::2", "2001:db8::10", "bogus", "switch1"}
+
+	// Every way round, so an order that isn't transitive shows up
+	for i := range want {
+		for j := range want {
+			if got := AddrLess(want[i], want[j]); got != (i < j) {
+				t.Errorf("AddrLess(%q, %q) is %v", want[i], want[j], got)
+			}
+		}
+	}
+
+	keys := []string{"switch1", "2001:db8::10", "10.0.0.10", "", "bogus", "::1", "192.168.0.1", "2001:db8::2", "10.0.0.2"}
+	sort.Slice(keys, func(i, j int) bool { return AddrLess(keys[i], keys[j]) })
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("sorted to %v, expected %v", keys, want)
+	}
+}
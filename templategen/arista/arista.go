@@ -0,0 +1,65 @@
+// Protected by BSD 3 clause license
+
+// Package arista generates startup-configs for Arista EOS ZTP. EOS fetches the URL in the
+// bootfile-name option (67) and runs it, so each host gets a bootstrap script which downloads
+// its startup-config and, if it has one, the EOS SWI image.
+package arista
+
+import (
+	"fmt"
+	"path"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+	"github.com/networkbootstrap/ztpmanagercode/templategen"
+)
+
+// DHCP option EOS ZTP looks at
+const optBootfileName = 67
+
+func init() {
+	templategen.Register(Arista{})
+}
+
+// Arista is the templategen.Vendor for Arista EOS devices
+type Arista struct{}
+
+// Name returns the vendor name
+func (a Arista) Name() string {
+	return "arista"
+}
+
+// Template returns the template path
+func (a Arista) Template() string {
+	return "arista/arista.template"
+}
+
+// ConfigFile returns the startup-config file name for a host
+func (a Arista) ConfigFile(hostname string) string {
+	return hostname + ".cfg"
+}
+
+// Payload returns the payload as is, the config and image URLs are already in there
+func (a Arista) Payload(p templategen.TemplatePayload) interface{} {
+	return p
+}
+
+// Scripts returns the bootstrap script for a host
+func (a Arista) Scripts(hostname string) []templategen.Script {
+	return []templategen.Script{{
+		File:     a.scriptFile(hostname),
+		Template: "arista/bootstrap.template",
+	}}
+}
+
+// DHCPOptions points the host at its bootstrap script on the file server
+func (a Arista) DHCPOptions(h rt.Hosts, fileserver string) []templategen.DHCPOption {
+	// The script sits next to the config
+	script := fmt.Sprintf("http://%s/%s", fileserver, path.Join(path.Dir(h.CfgFile), a.scriptFile(h.HostName)))
+	return []templategen.DHCPOption{
+		{Code: optBootfileName, Value: script},
+	}
+}
+
+func (a Arista) scriptFile(hostname string) string {
+	return hostname + "-bootstrap"
+}
@@ -0,0 +1,90 @@
+// Protected by BSD 3 clause license
+
+// Package cisco generates day-0 configs for Cisco NX-OS (POAP) and IOS-XE (ZTP) devices.
+// Both platforms fetch a Python script named in the bootfile-name option (67), and the script
+// pulls down the config and image. The script is rendered per host with the URLs and image MD5 filled in.
+package cisco
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"path"
+	"regexp"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+	"github.com/networkbootstrap/ztpmanagercode/templategen"
+)
+
+// DHCP options the Cisco bootstrap looks at
+const (
+	optTFTPServerName = 66
+	optBootfileName   = 67
+)
+
+func init() {
+	templategen.Register(Cisco{Platform: "nxos", Script: "poap.py"})
+	templategen.Register(Cisco{Platform: "iosxe", Script: "ztp.py"})
+}
+
+// Cisco is the templategen.Vendor for a Cisco platform
+type Cisco struct {
+	Platform string // "nxos" or "iosxe"
+	Script   string // Name of the bootstrap script template, and the suffix of the rendered script
+}
+
+// Name returns the vendor name
+func (c Cisco) Name() string {
+	return "cisco-" + c.Platform
+}
+
+// Template returns the template path
+func (c Cisco) Template() string {
+	return c.Name() + "/" + c.Name() + ".template"
+}
+
+// ConfigFile returns the config file name for a host
+func (c Cisco) ConfigFile(hostname string) string {
+	return hostname + ".cfg"
+}
+
+// Payload returns the payload as is, the config and script URLs are already in there
+func (c Cisco) Payload(p templategen.TemplatePayload) interface{} {
+	return p
+}
+
+// Scripts returns the bootstrap script for a host
+func (c Cisco) Scripts(hostname string) []templategen.Script {
+	s := templategen.Script{
+		File:     c.scriptFile(hostname),
+		Template: c.Name() + "/" + c.Script + ".template",
+	}
+	// POAP refuses to run a script whose #md5sum line doesn't match the rest of it
+	if c.Platform == "nxos" {
+		s.Fixup = poapChecksum
+	}
+	return []templategen.Script{s}
+}
+
+// DHCPOptions points the host at its bootstrap script on the file server
+func (c Cisco) DHCPOptions(h rt.Hosts, fileserver string) []templategen.DHCPOption {
+	// The script sits next to the config
+	script := fmt.Sprintf("http://%s/%s", fileserver, path.Join(path.Dir(h.CfgFile), c.scriptFile(h.HostName)))
+	return []templategen.DHCPOption{
+		{Code: optTFTPServerName, Value: fileserver},
+		{Code: optBootfileName, Value: script},
+	}
+}
+
+func (c Cisco) scriptFile(hostname string) string {
+	return hostname + "-" + c.Script
+}
+
+var md5sumLine = regexp.MustCompile(`(?m)^#md5sum=.*\n`)
+
+// poapChecksum fills in the #md5sum line of a POAP script. The sum covers the script without that line.
+func poapChecksum(b []byte) []byte {
+	sum := md5.Sum(md5sumLine.ReplaceAll(b, nil))
+	line := []byte(fmt.Sprintf("#md5sum=\"%s\"\n", hex.EncodeToString(sum[:])))
+	return md5sumLine.ReplaceAllLiteral(b, line)
+}
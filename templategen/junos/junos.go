@@ -1,51 +1,54 @@
-package templategen
+// Protected by BSD 3 clause license
+
+// Package junos generates Junos ZTP configs. The config and image file names go in the
+// ezjunosztp option 43 sub-options, the file server and transfer mode are set per scope.
+package junos
 
 import (
-	"bufio"
-	"os"
-	"text/template"
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+	"github.com/networkbootstrap/ztpmanagercode/templategen"
 )
 
-// JunosTemplatePayload holds data for populating Junos device configs
-type JunosTemplatePayload struct {
-	Gateway    string
-	FixedIP    string
-	HostName   string
-	DomainName string
-	DNSServers []string
-	NTPServers []string
-}
-
-// SaveJunosConfig does as it says on the tin!
-func SaveJunosConfig(file string, templ string, payload JunosTemplatePayload) error {
-
-	t := template.Must(template.New("junos.template").ParseFiles(templ))
+// Option 43 sub-options Junos ZTP looks at
+const (
+	subImageFileName  = 0
+	subConfigFileName = 1
+)
 
-	// We don't care about erroring out. Error out silently here.
-	os.Remove(file)
+func init() {
+	templategen.Register(Junos{})
+}
 
-	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE, 0777)
-	if err != nil {
-		return err
-	}
+// Junos is the templategen.Vendor for Juniper devices
+type Junos struct{}
 
-	w := bufio.NewWriter(f)
+// Name returns the vendor name
+func (j Junos) Name() string {
+	return "junos"
+}
 
-	err = t.Execute(w, payload)
+// Template returns the template path
+func (j Junos) Template() string {
+	return "junos/junos.template"
+}
 
-	if err != nil {
-		return err
-	}
+// ConfigFile returns the config file name for a host
+func (j Junos) ConfigFile(hostname string) string {
+	return hostname + ".conf"
+}
 
-	err = w.Flush()
+// Payload returns the payload as is, the Junos template needs nothing extra
+func (j Junos) Payload(p templategen.TemplatePayload) interface{} {
+	return p
+}
 
-	if err != nil {
-		return err
+// DHCPOptions returns the config file and image sub-options for a host
+func (j Junos) DHCPOptions(h rt.Hosts, fileserver string) []templategen.DHCPOption {
+	opts := []templategen.DHCPOption{
+		{Code: subConfigFileName, Encap: true, Value: h.CfgFile},
 	}
-
-	if err = f.Close(); err != nil {
-		return err
+	if h.CfgImage != "" {
+		opts = append(opts, templategen.DHCPOption{Code: subImageFileName, Encap: true, Value: h.CfgImage})
 	}
-
-	return nil
+	return opts
 }
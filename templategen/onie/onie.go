@@ -0,0 +1,79 @@
+// Protected by BSD 3 clause license
+
+// Package onie generates bootstrap files for white-box switches that boot through ONIE.
+// ONIE takes its NOS installer URL from the default-url option (114). Once the NOS is up,
+// Cumulus runs the ZTP script named in option 239, and SONiC fetches the ztp.json named in
+// the bootfile-name option (67), which tells it where its config_db.json is.
+package onie
+
+import (
+	"fmt"
+	"path"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+	"github.com/networkbootstrap/ztpmanagercode/templategen"
+)
+
+// DHCP options the ONIE and NOS bootstrap look at
+const (
+	optBootfileName = 67
+	optDefaultURL   = 114
+	optProvisionURL = 239
+)
+
+func init() {
+	templategen.Register(ONIE{NOS: "cumulus", Config: ".interfaces", Script: "ztp.sh", ScriptOption: optProvisionURL})
+	templategen.Register(ONIE{NOS: "sonic", Config: ".json", Script: "ztp.json", ScriptOption: optBootfileName})
+}
+
+// ONIE is the templategen.Vendor for a NOS installed through ONIE
+type ONIE struct {
+	NOS          string // "cumulus" or "sonic"
+	Config       string // Suffix of the rendered config file
+	Script       string // Name of the ZTP template, and the suffix of the rendered file
+	ScriptOption int    // DHCP option carrying the URL of the ZTP file
+}
+
+// Name returns the vendor name
+func (o ONIE) Name() string {
+	return o.NOS
+}
+
+// Template returns the template path
+func (o ONIE) Template() string {
+	return o.NOS + "/" + o.NOS + ".template"
+}
+
+// ConfigFile returns the config file name for a host
+func (o ONIE) ConfigFile(hostname string) string {
+	return hostname + o.Config
+}
+
+// Payload returns the payload as is, the config and image URLs are already in there
+func (o ONIE) Payload(p templategen.TemplatePayload) interface{} {
+	return p
+}
+
+// Scripts returns the ZTP script or ztp.json for a host
+func (o ONIE) Scripts(hostname string) []templategen.Script {
+	return []templategen.Script{{
+		File:     o.scriptFile(hostname),
+		Template: o.NOS + "/" + o.Script + ".template",
+	}}
+}
+
+// DHCPOptions points ONIE at the installer image, if the host has one, and the NOS at its ZTP file
+func (o ONIE) DHCPOptions(h rt.Hosts, fileserver string) []templategen.DHCPOption {
+	opts := []templategen.DHCPOption{}
+	if h.CfgImage != "" {
+		opts = append(opts, templategen.DHCPOption{Code: optDefaultURL, Value: fmt.Sprintf("http://%s/%s", fileserver, h.CfgImage)})
+	}
+
+	// The ZTP file sits next to the config
+	script := fmt.Sprintf("http://%s/%s", fileserver, path.Join(path.Dir(h.CfgFile), o.scriptFile(h.HostName)))
+	return append(opts, templategen.DHCPOption{Code: o.ScriptOption, Value: script})
+}
+
+func (o ONIE) scriptFile(hostname string) string {
+	return hostname + "-" + o.Script
+}
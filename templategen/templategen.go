@@ -0,0 +1,144 @@
+// Protected by BSD 3 clause license
+
+// Package templategen holds the registry of device vendors and renders their day-0 configurations.
+// Each vendor lives in its own package under templategen and registers itself from init, so adding
+// a vendor is a new package and a blank import in main. Nothing else needs to know about it.
+package templategen
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+
+	rt "github.com/networkbootstrap/ztpmanagercode/roottypes"
+)
+
+// TemplatePayload holds the data every vendor gets for populating device configs
+type TemplatePayload struct {
+	Gateway       string
+	FixedIP       string
+	PrefixLength  int
+	SubnetMask    string
+	Gateway6      string
+	FixedIPv6     string
+	PrefixLength6 int
+	HostName      string
+	Model         string
+	Role          string
+	DomainName    string
+	DNSServers    []string
+	NTPServers    []string
+	FileServer    string // Address the host fetches its files from
+	ConfigURL     string
+	ImageFile     string // Name of the image, without the directory
+	ImageURL      string
+	ImageMD5      string // Empty if the image isn't in the images directory
+	Vars          rt.Vars
+}
+
+// DHCPOption is a single DHCPv4 option a vendor needs in a host's DHCP stanza.
+// If Encap is true, Code is a sub-option of the vendor-encapsulated options (43).
+type DHCPOption struct {
+	Code  int
+	Encap bool
+	Type  string // "text" (the default) or "ip-address"
+	Value string
+}
+
+// Vendor is implemented by each device vendor package
+type Vendor interface {
+	// Name returns the name hosts use in their Vendor field, e.g. "junos"
+	Name() string
+	// Template returns the path of the device config template, relative to the templates directory
+	Template() string
+	// ConfigFile returns the name the rendered config for a host is saved under
+	ConfigFile(hostname string) string
+	// Payload turns the common payload into whatever the template is executed with
+	Payload(p TemplatePayload) interface{}
+	// DHCPOptions returns the options a host needs to find its config. h has CfgFile and CfgImage set
+	// to paths on the file server, and fileserver is the address the host fetches them from.
+	DHCPOptions(h rt.Hosts, fileserver string) []DHCPOption
+}
+
+// Script is an extra file a vendor serves alongside the config, such as a bootstrap script
+type Script struct {
+	File     string // Name the rendered script is saved under in the configs directory
+	Template string // Path of the template, relative to the templates directory
+	// Fixup, if set, gets a last look at the rendered script before it's saved
+	Fixup func(b []byte) []byte
+}
+
+// Scripter is implemented by vendors whose devices need more than a config to bootstrap
+type Scripter interface {
+	// Scripts returns the extra files for a host
+	Scripts(hostname string) []Script
+}
+
+var (
+	vendorsMu sync.RWMutex
+	vendors   = map[string]Vendor{}
+)
+
+// Register makes a vendor available by name. It panics if the name is already taken.
+func Register(v Vendor) {
+	vendorsMu.Lock()
+	defer vendorsMu.Unlock()
+
+	name := strings.ToLower(v.Name())
+	if _, dup := vendors[name]; dup {
+		panic("templategen: Register called twice for vendor " + name)
+	}
+	vendors[name] = v
+}
+
+// Lookup returns the vendor registered under name
+func Lookup(name string) (Vendor, error) {
+	vendorsMu.RLock()
+	v, ok := vendors[strings.ToLower(name)]
+	vendorsMu.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown vendor %q, expected one of: %s", name, strings.Join(Names(), ", "))
+	}
+	return v, nil
+}
+
+// Names returns the names of the registered vendors in alphabetical order
+func Names() []string {
+	vendorsMu.RLock()
+	defer vendorsMu.RUnlock()
+
+	names := []string{}
+	for k := range vendors {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// CheckPathPart returns an error if s, such as a host's role or model, can't be used as part of a template path.
+// It mustn't lead out of the vendor's template directory.
+func CheckPathPart(s string) error {
+	if strings.ContainsAny(s, `/\`) || strings.Contains(s, "..") {
+		return fmt.Errorf("%q can't contain /, \\ or ..", s)
+	}
+	return nil
+}
+
+// Execute returns the template at templ executed with payload
+func Execute(templ string, payload interface{}) ([]byte, error) {
+	t, err := template.New(filepath.Base(templ)).ParseFiles(templ)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := new(bytes.Buffer)
+	if err = t.Execute(buf, payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}